@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"context"
+	"cs425_g12/common"
+	"cs425_g12/gossip"
+	"cs425_g12/logging"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// the failure detector commands, shared by the stdin CLI and the http admin api
+
+var logger = logging.New("admin")
+
+type SelfInfo struct {
+	Self          common.MachineId
+	InGroup       bool
+	DeclaredDead  int64
+	Rejoined      int64
+	FailurePolicy string
+}
+
+type ProtocolInfo struct {
+	Protocol    string // "gossip", "ping" or "hybrid"
+	Suspect     string // "suspect" or "nosuspect"
+	Epoch       uint64 // epoch of the cluster mode this node is running
+	InAgreement bool   // every alive member reported the same epoch
+	Disagreeing map[string]uint64
+	Unknown     []string
+}
+
+func (p ProtocolInfo) String() string {
+	if p.InAgreement {
+		return fmt.Sprintf("<%s, %s> epoch %d, cluster in agreement", p.Protocol, p.Suspect, p.Epoch)
+	}
+	return fmt.Sprintf("<%s, %s> epoch %d, cluster NOT in agreement (other epochs: %v, not heard from: %v)", p.Protocol, p.Suspect, p.Epoch, p.Disagreeing, p.Unknown)
+}
+
+func ListMembers(list *common.MembershipList) []common.Member {
+	logger.Printf("Called getEntireList")
+	return list.GetEntireList()
+}
+
+func ListSelf() SelfInfo {
+	declaredDead, rejoined := gossip.GetSelfFailureStats()
+	logger.Printf("Called getSelf")
+	return SelfInfo{
+		Self:          common.GetSelf(),
+		InGroup:       common.IsMemberInGroup,
+		DeclaredDead:  declaredDead,
+		Rejoined:      rejoined,
+		FailurePolicy: gossip.GetSelfFailurePolicy().String(),
+	}
+}
+
+func DisplaySuspects(list *common.MembershipList) []common.Member {
+	suspectedMachines := []common.Member{}
+	for _, machine := range list.GetEntireList() {
+		if machine.SuspicionState == common.StateSuspicious {
+			suspectedMachines = append(suspectedMachines, machine)
+		}
+	}
+	return suspectedMachines
+}
+
+func DisplayProtocol(list *common.MembershipList) ProtocolInfo {
+	agreement := list.GetModeAgreement()
+	info := ProtocolInfo{
+		Protocol:    common.GetProtocolMode().String(),
+		Suspect:     "nosuspect",
+		Epoch:       agreement.Epoch,
+		InAgreement: agreement.InAgreement,
+		Disagreeing: agreement.Disagreeing,
+		Unknown:     agreement.Unknown,
+	}
+	if common.GetSuspicionMode() {
+		info.Suspect = "suspect"
+	}
+	return info
+}
+
+// switch {gossip, pingack, hybrid}, {withSus, withNoSus}. the names from the README (ping, suspect, nosuspect) work too.
+// the switch is disseminated to the whole cluster
+func Switch(list *common.MembershipList, protocolMode string, susMode string) (common.ClusterMode, error) {
+	protocol, err := common.ParseProtocolMode(protocolMode)
+	if err != nil {
+		logger.Printf("Invalid switch parameters: %s %s", protocolMode, susMode)
+		return common.ClusterMode{}, err
+	}
+	var useSus bool
+	switch susMode {
+	case "withSus", "suspect":
+		useSus = true
+	case "withNoSus", "nosuspect":
+		useSus = false
+	default:
+		logger.Printf("Invalid switch parameters: %s %s", protocolMode, susMode)
+		return common.ClusterMode{}, fmt.Errorf("invalid suspicion mode %q (expected withSus or withNoSus)", susMode)
+	}
+
+	mode := gossip.SwitchClusterMode(list, protocol, useSus)
+	logger.Printf("Switching cluster to %s", mode)
+	return mode, nil
+}
+
+// voluntarily leave the group (different from a failure)
+func Leave(list *common.MembershipList) {
+	gossip.BroadcastLeave(list)
+	common.IsMemberInGroup = false
+	logger.Printf("Left the group voluntarily")
+}
+
+func Join(list *common.MembershipList) error {
+	if common.IsMemberInGroup {
+		return fmt.Errorf("already in the group")
+	}
+	if !gossip.JoinGroup(list) {
+		return fmt.Errorf("failed to join")
+	}
+	common.IsMemberInGroup = true
+	return nil
+}
+
+// fault add dir=out,peer=172.22.94.225,drop=1 (see gossip.ParseFaultRule for every option)
+func AddFault(spec string) (int, error) {
+	rule, err := gossip.ParseFaultRule(spec)
+	if err != nil {
+		return 0, err
+	}
+	return gossip.AddFaultRule(rule), nil
+}
+
+func RemoveFault(id string) error {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return fmt.Errorf("invalid fault rule id %q", id)
+	}
+	if !gossip.RemoveFaultRule(n) {
+		return fmt.Errorf("no fault rule with id %d", n)
+	}
+	return nil
+}
+
+// cancels the bandwidth logger of the running experiment, nil while none is running
+var (
+	stopBandwidthLog context.CancelFunc
+	experimentMutex  sync.Mutex
+)
+
+// starts logging bandwidth and recording which members this node suspects or declares failed,
+// the bandwidth logger stops with the experiment or when ctx is cancelled
+func StartExperiment(ctx context.Context) error {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	if err := common.StartExperimentRecording(common.Now()); err != nil {
+		return err
+	}
+	logCtx, cancel := context.WithCancel(ctx)
+	stopBandwidthLog = cancel
+	gossip.IsExperimentRunning.Store(true)
+	common.Go(func() { gossip.LogExperiments(logCtx) })
+	return nil
+}
+
+// returns the detections recorded since start_exp
+func StopExperiment() (common.ExperimentRecord, error) {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	record, err := common.StopExperimentRecording(common.Now())
+	if err != nil {
+		return record, err
+	}
+	gossip.IsExperimentRunning.Store(false)
+	if stopBandwidthLog != nil {
+		stopBandwidthLog()
+		stopBandwidthLog = nil
+	}
+	return record, nil
+}
@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"context"
+	"cs425_g12/common"
+	"cs425_g12/gossip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// default admin api address, only reachable from the machine itself
+const DefaultAddr = "127.0.0.1:7070"
+
+// body of every response
+type Response struct {
+	Ok     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// wraps a read only command
+func get(fn func(r *http.Request) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, Response{Error: "use GET"})
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Ok: true, Result: fn(r)})
+	}
+}
+
+// wraps a command that changes state
+func post(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, Response{Error: "use POST"})
+			return
+		}
+		result, err := fn(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Ok: true, Result: result})
+	}
+}
+
+// routes for every CLI command
+func NewMux(ctx context.Context, list *common.MembershipList) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/list_mem", get(func(r *http.Request) interface{} { return ListMembers(list) }))
+	mux.HandleFunc("/list_self", get(func(r *http.Request) interface{} { return ListSelf() }))
+	mux.HandleFunc("/display_suspects", get(func(r *http.Request) interface{} { return DisplaySuspects(list) }))
+	mux.HandleFunc("/display_protocol", get(func(r *http.Request) interface{} { return DisplayProtocol(list) }))
+	mux.HandleFunc("/display_partition", get(func(r *http.Request) interface{} { return list.GetPartitionStatus() }))
+	mux.HandleFunc("/display_queue", get(func(r *http.Request) interface{} { return gossip.GetQueueStats() }))
+	mux.HandleFunc("/fault_list", get(func(r *http.Request) interface{} { return gossip.ListFaultRules() }))
+
+	mux.HandleFunc("/join", post(func(r *http.Request) (interface{}, error) {
+		return "Joined the group", Join(list)
+	}))
+	mux.HandleFunc("/leave", post(func(r *http.Request) (interface{}, error) {
+		Leave(list)
+		return "Left the group voluntarily", nil
+	}))
+	// POST /switch?protocol=gossip&sus=withSus
+	mux.HandleFunc("/switch", post(func(r *http.Request) (interface{}, error) {
+		return Switch(list, r.URL.Query().Get("protocol"), r.URL.Query().Get("sus"))
+	}))
+	// POST /fault_add?spec=dir=out,peer=172.22.94.225,drop=1
+	mux.HandleFunc("/fault_add", post(func(r *http.Request) (interface{}, error) {
+		return AddFault(r.URL.Query().Get("spec"))
+	}))
+	mux.HandleFunc("/fault_remove", post(func(r *http.Request) (interface{}, error) {
+		return "Removed fault rule", RemoveFault(r.URL.Query().Get("id"))
+	}))
+	mux.HandleFunc("/fault_clear", post(func(r *http.Request) (interface{}, error) {
+		gossip.ClearFaultRules()
+		return "Cleared all fault rules", nil
+	}))
+	mux.HandleFunc("/start_exp", post(func(r *http.Request) (interface{}, error) {
+		return "Experiment started, logging bandwidth stats.", StartExperiment(ctx)
+	}))
+	// returns the detections recorded by this node, see common.ExperimentRecord
+	mux.HandleFunc("/stop_exp", post(func(r *http.Request) (interface{}, error) {
+		return StopExperiment()
+	}))
+
+	return mux
+}
+
+// serves the admin api on addr in its own goroutine until ctx is cancelled
+func Serve(ctx context.Context, addr string, list *common.MembershipList) {
+	server := &http.Server{Addr: addr, Handler: NewMux(ctx, list)}
+	common.Go(func() {
+		logger.Printf("Admin API listening on %s\n", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Println("Error serving admin API: ", err)
+		}
+	})
+	common.Go(func() {
+		<-ctx.Done()
+		// requests in flight get a moment to finish
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	})
+}
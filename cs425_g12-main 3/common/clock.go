@@ -0,0 +1,60 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// source of time for the protocol: timestamps, timeouts and the sleeps of the protocol loops. a
+// real node uses the wall clock, tests and the simulator use a FakeClock so timing logic can run
+// without real waits
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+	Sleep(d time.Duration)
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
+
+var RealClock Clock = realClock{}
+
+// clock of the process, new membership lists start with it
+var (
+	clock      Clock = RealClock
+	clockMutex sync.RWMutex
+)
+
+func SetClock(c Clock) {
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+	clock = c
+}
+
+func GetClock() Clock {
+	clockMutex.RLock()
+	defer clockMutex.RUnlock()
+	return clock
+}
+
+// current time according to the clock of the process
+func Now() time.Time {
+	return GetClock().Now()
+}
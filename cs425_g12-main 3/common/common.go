@@ -2,12 +2,12 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"cs425_g12/logging"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
 	"sort"
 	"sync"
 	"time"
@@ -16,16 +16,18 @@ import (
 // constant port for dialing in the machines (introducer is also on this port)
 const GlobalPort = 5051
 
-var Logger *log.Logger
+// logger of the membership list, the gossip and admin packages have their own
+var Logger = logging.New("membership")
 
-// logger file
-func InitializeLogger(machineName string) {
-	logPath := filepath.Join("/home/shared", machineName+".log")
-	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+// opens <machineName>.log in the log directory of the config, every logger without its own sink
+// writes there. the file is appended to and rotated, never truncated
+func InitializeLogger(machineName string, config logging.Config) {
+	config.File = machineName + ".log"
+	sink, err := logging.Open(config)
 	if err != nil {
 		log.Fatalf("could not open log file: %v", err)
 	}
-	Logger = log.New(file, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	logging.SetDefault(sink)
 }
 
 // used for starting the protocols only when the members are part of the group
@@ -64,6 +66,9 @@ func NewMachineId(ip string, port uint16, startTime time.Time) MachineId {
 // introducer machine : vm 1
 var Introducer MachineId
 
+// well known machines that are always worth contacting when reconnecting
+var Seeds []MachineId
+
 // state tracker for machine
 type SuspicionState uint8
 
@@ -80,7 +85,8 @@ type Member struct {
 	HeartbeatCounter  uint64
 	TimeLocal         time.Time // last updated time
 	SuspicionState    SuspicionState
-	IncarnationNumber uint64 // incarnation number
+	IncarnationNumber uint64    // incarnation number
+	FailedBy          MachineId // member that declared the failure, only set while failed
 
 	RingId       [20]byte
 	RingIdString string
@@ -97,7 +103,7 @@ func NewMember(machineId MachineId) Member {
 	return Member{
 		MachineId:         machineId,
 		HeartbeatCounter:  0,
-		TimeLocal:         time.Now(),
+		TimeLocal:         Now(),
 		SuspicionState:    StateAlive,
 		IncarnationNumber: 0,
 		RingId:            hash,
@@ -110,6 +116,9 @@ type MembershipList struct {
 	members    map[MachineId]*Member
 	sortedRing []*Member
 	mutex      sync.RWMutex
+	partition  *partitionDetector
+	removed    map[MachineId]time.Time // members removed by cleanup, kept around for reconnecting
+	clock      Clock
 }
 
 // constructor for membership list
@@ -117,9 +126,25 @@ func NewMembershipList() *MembershipList {
 	return &MembershipList{
 		members:    make(map[MachineId]*Member),
 		sortedRing: make([]*Member, 0),
+		partition:  newPartitionDetector(),
+		removed:    make(map[MachineId]time.Time),
+		clock:      GetClock(),
 	}
 }
 
+// clock used for the timers of this list and the protocol loops running on it
+func (list *MembershipList) SetClock(c Clock) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.clock = c
+}
+
+func (list *MembershipList) Clock() Clock {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	return list.clock
+}
+
 // pretty printing functions
 func (m MachineId) String() string {
 	return fmt.Sprintf("%s:%d (v%d)", m.Ip, m.Port, m.Version)
@@ -173,13 +198,12 @@ func (list *MembershipList) Insert(member Member) {
 		//if it does not exist, then we add it into the list
 		list.members[member.MachineId] = &member
 		list.updateSortedRing()
+		if member.MachineId != GetSelf() {
+			EmitEvent(Event{Type: EventMemberJoined, Members: []MachineId{member.MachineId}})
+		}
 	}
 
-	Logger.Printf("Inserted member: %+v\n", member)
-	Logger.Println("Membership list after insertion:")
-	for _, m := range list.members {
-		Logger.Printf("   %s\n", *m)
-	}
+	Logger.Debug("inserted member", "member", member.MachineId, "state", member.SuspicionState, "members", len(list.members))
 }
 
 // delete one member from the list
@@ -213,9 +237,32 @@ func (list *MembershipList) GetEntireList() []Member {
 	for _, member := range list.members {
 		out = append(out, *member)
 	}
+	// fixed order so target selection only depends on the random source
+	sort.Slice(out, func(i, j int) bool { return machineIdLess(out[i].MachineId, out[j].MachineId) })
 	return out
 }
 
+// orders machine ids by ip, port and version
+func machineIdLess(a MachineId, b MachineId) bool {
+	if a.Ip != b.Ip {
+		return a.Ip < b.Ip
+	}
+	if a.Port != b.Port {
+		return a.Port < b.Port
+	}
+	return a.Version < b.Version
+}
+
+// ids in the list in a fixed order, so a simulated run with the same seed takes the same steps
+func (list *MembershipList) sortedIdsLocked() []MachineId {
+	ids := make([]MachineId, 0, len(list.members))
+	for id := range list.members {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return machineIdLess(ids[i], ids[j]) })
+	return ids
+}
+
 // for accessing the unique members in the list (used when choosing target)
 func (list *MembershipList) GetUniqueMembers() []Member {
 	members := list.GetEntireList()
@@ -237,6 +284,49 @@ func (list *MembershipList) GetUniqueMembers() []Member {
 	return out
 }
 
+// members that were cleaned up within the retention time, plus the seeds, that are not in the
+// list (used for reconnecting after a partition). members still listed as failed are left out:
+// merging ignores updates about them until they are cleaned up
+func (list *MembershipList) GetReconnectCandidates(retention time.Duration) []MachineId {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	now := list.clock.Now()
+	self := GetSelf()
+	listed := make(map[string]bool)
+	for id := range list.members {
+		listed[fmt.Sprintf("%s:%d", id.Ip, id.Port)] = true
+	}
+	listed[fmt.Sprintf("%s:%d", self.Ip, self.Port)] = true
+
+	out := make([]MachineId, 0)
+	add := func(id MachineId) {
+		key := fmt.Sprintf("%s:%d", id.Ip, id.Port)
+		if !listed[key] {
+			listed[key] = true
+			out = append(out, id)
+		}
+	}
+
+	removed := make([]MachineId, 0, len(list.removed))
+	for id, removedAt := range list.removed {
+		if now.Sub(removedAt) > retention {
+			// forget about members removed a long time ago
+			delete(list.removed, id)
+			continue
+		}
+		removed = append(removed, id)
+	}
+	sort.Slice(removed, func(i, j int) bool { return machineIdLess(removed[i], removed[j]) })
+	for _, id := range removed {
+		add(id)
+	}
+	for _, seed := range Seeds {
+		add(seed)
+	}
+	return out
+}
+
 // returns the member if it exists
 func (list *MembershipList) GetMember(machine MachineId) *Member {
 	list.mutex.RLock()
@@ -345,7 +435,7 @@ func (list *MembershipList) IncrementHeartbeat() {
 		if member.MachineId.Ip == GetSelf().Ip {
 			if member.SuspicionState != StateFailed {
 				member.HeartbeatCounter++
-				member.TimeLocal = time.Now()
+				member.TimeLocal = list.clock.Now()
 				// member.SuspicionState = StateAlive
 				Logger.Printf("Incremented heartbeat for member: %+v\n", member)
 			}
@@ -377,37 +467,85 @@ func GetSuspicionMode() bool {
 	return useSuspicion
 }
 
-// pingack vs gossip
+// gossip vs pingack vs hybrid
+type ProtocolMode uint8
+
+const (
+	ProtocolGossip  ProtocolMode = iota // heartbeat gossip with timeouts
+	ProtocolPingAck                     // direct probing
+	ProtocolHybrid                      // heartbeat gossip for dissemination plus direct probing for fast detection
+)
+
+func (p ProtocolMode) String() string {
+	switch p {
+	case ProtocolGossip:
+		return "gossip"
+	case ProtocolPingAck:
+		return "ping"
+	case ProtocolHybrid:
+		return "hybrid"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseProtocolMode(s string) (ProtocolMode, error) {
+	switch s {
+	case "gossip":
+		return ProtocolGossip, nil
+	case "pingack", "ping":
+		return ProtocolPingAck, nil
+	case "hybrid":
+		return ProtocolHybrid, nil
+	}
+	return ProtocolGossip, fmt.Errorf("invalid protocol %q (expected gossip, pingack or hybrid)", s)
+}
+
+// heartbeats are gossiped and members time out if their heartbeat stops
+func (p ProtocolMode) UsesGossip() bool {
+	return p == ProtocolGossip || p == ProtocolHybrid
+}
+
+// members are probed directly and time out if they don't ack
+func (p ProtocolMode) UsesProbes() bool {
+	return p == ProtocolPingAck || p == ProtocolHybrid
+}
+
 var (
-	usePingAck    bool
+	protocolMode  ProtocolMode
 	protocolMutex sync.RWMutex
 )
 
-func SetProtocolMode(mode bool) {
+func SetProtocolMode(mode ProtocolMode) {
 	protocolMutex.Lock()
 	defer protocolMutex.Unlock()
-	usePingAck = mode
+	protocolMode = mode
 }
 
-func GetProtocolMode() bool {
+func GetProtocolMode() ProtocolMode {
 	protocolMutex.Lock()
 	defer protocolMutex.Unlock()
-	return usePingAck
-}
-
-// starts the checker based on the mode
-func (list *MembershipList) StartChecker(Tsus time.Duration, Tfail time.Duration, Tclean time.Duration, Tsuscheck time.Duration, Tfailcheck time.Duration) {
-	go func() {
-		for {
-			if GetSuspicionMode() {
-				list.StartSuspicionChecker(Tsus, Tfail, Tclean, Tsuscheck)
-				time.Sleep(Tsuscheck)
-			} else {
-				list.StartFailedChecker(Tfail, Tclean, Tfailcheck)
-				time.Sleep(Tfailcheck)
-			}
+	return protocolMode
+}
+
+// starts the checker based on the mode, runs until ctx is cancelled
+func (list *MembershipList) StartChecker(ctx context.Context, Tsus time.Duration, Tfail time.Duration, Tclean time.Duration, Tsuscheck time.Duration, Tfailcheck time.Duration) {
+	Go(func() {
+		for SleepContext(ctx, list.Clock(), list.RunCheckers(Tsus, Tfail, Tclean, Tsuscheck, Tfailcheck)) {
 		}
-	}()
+	})
+}
+
+// one round of the partition check and the checker for the current mode, returns the time
+// until the next round
+func (list *MembershipList) RunCheckers(Tsus time.Duration, Tfail time.Duration, Tclean time.Duration, Tsuscheck time.Duration, Tfailcheck time.Duration) time.Duration {
+	list.checkPartition(list.Clock().Now())
+	if GetSuspicionMode() {
+		list.StartSuspicionChecker(Tsus, Tfail, Tclean, Tsuscheck)
+		return Tsuscheck
+	}
+	list.StartFailedChecker(Tfail, Tclean, Tfailcheck)
+	return Tfailcheck
 }
 
 func (list *MembershipList) StartSuspicionChecker(Tsus time.Duration, Tfail time.Duration, Tclean time.Duration, Tsuscheck time.Duration) {
@@ -415,9 +553,11 @@ func (list *MembershipList) StartSuspicionChecker(Tsus time.Duration, Tfail time
 	// 	for {
 	// 		time.Sleep(Tsuscheck)
 
-	now := time.Now()
 	list.mutex.Lock()
-	for id, member := range list.members {
+	now := list.clock.Now()
+	removed := false // the ring is rebuilt once after the loop
+	for _, id := range list.sortedIdsLocked() {
+		member := list.members[id]
 		if id.Ip == GetSelf().Ip {
 			// Logger.Printf("I am self: %+v", GetSelf())
 			continue // skip self
@@ -425,28 +565,44 @@ func (list *MembershipList) StartSuspicionChecker(Tsus time.Duration, Tfail time
 
 		elapsed := now.Sub(member.TimeLocal)
 
-		if !GetProtocolMode() && member.SuspicionState == StateAlive {
+		if GetProtocolMode().UsesGossip() && member.SuspicionState == StateAlive {
 			if elapsed > Tsus {
 				// member is sus
 				member.SuspicionState = StateSuspicious
+				MetricSuspicions.Inc()
+				RecordDetection(id, StateSuspicious, "local", now)
 				fmt.Printf("Member %+v marked as Suspicious, elapsed time: %+v\n", member.MachineId, elapsed)
-				Logger.Printf("Member %+v marked as Suspicious, elapsed time: %+v\n", member.MachineId, elapsed)
+				LogMemberEvent(Logger, EventKeySuspect, member.MachineId, "source", "local", "elapsed", elapsed)
 			} // else still alive, continue being alive
 		} else if member.SuspicionState == StateSuspicious {
 			if elapsed > Tfail {
+				if list.failureDampedLocked(id, now) {
+					// partition suspected and no quorum agrees yet, keep the member suspicious
+					Logger.Info("failure damped", "member", member.MachineId, "reason", "no quorum")
+					continue
+				}
 				// member has failed
 				member.SuspicionState = StateFailed
-				fmt.Printf("[%s] Member %+v marked as Failed (timeout in suschecker)\n", time.Now().Format("15:04:05.000"), member.MachineId)
-				Logger.Printf("DropSearch Member %+v marked as Failed, elapsed time: %+v\n", member.MachineId, elapsed)
+				member.FailedBy = GetSelf()
+				fmt.Printf("[%s] Member %+v marked as Failed (timeout in suschecker)\n", now.Format("15:04:05.000"), member.MachineId)
+				LogMemberEvent(Logger, EventKeyFail, member.MachineId, "source", "local", "elapsed", elapsed)
+				list.reportFailureLocked(id, now)
+				MetricFailuresDeclared.With("local").Inc()
+				RecordDetection(id, StateFailed, "local", now)
 			}
 		} else if member.SuspicionState == StateFailed {
 			if elapsed > Tclean {
 				// remove member from list
 				delete(list.members, id)
-				Logger.Printf("Member %+v removed from membership list due to cleanup, elapsed time: %+v\n", member.MachineId, elapsed)
+				list.removed[id] = now
+				removed = true
+				Logger.Info("member removed", "member", member.MachineId, "elapsed", elapsed)
 			}
 		}
 	}
+	if removed {
+		list.updateSortedRing()
+	}
 	list.mutex.Unlock()
 }
 
@@ -457,30 +613,52 @@ func (list *MembershipList) StartFailedChecker(Tfail time.Duration, Tclean time.
 	// go func() {
 	// 	for {
 	// 		time.Sleep(Tfailcheck)
-	now := time.Now()
 	list.mutex.Lock()
+	now := list.clock.Now()
+	removed := false // the ring is rebuilt once after the loop
 
-	for id, member := range list.members {
+	for _, id := range list.sortedIdsLocked() {
+		member := list.members[id]
 		if id.Ip == GetSelf().Ip {
 			// Logger.Printf("I am self: %+v", GetSelf())
 			continue // skip self
 		}
 
 		elapsed := now.Sub(member.TimeLocal)
-		if !GetProtocolMode() && member.SuspicionState == StateAlive {
+		if GetProtocolMode().UsesGossip() && member.SuspicionState != StateFailed {
 			if elapsed > Tfail {
+				if list.failureDampedLocked(id, now) {
+					// partition suspected and no quorum agrees yet, suspect the member so our vote
+					// spreads with our list
+					if member.SuspicionState == StateAlive {
+						member.SuspicionState = StateSuspicious
+						MetricSuspicions.Inc()
+						RecordDetection(id, StateSuspicious, "local", now)
+					}
+					Logger.Info("failure damped", "member", member.MachineId, "reason", "no quorum")
+					continue
+				}
 				// remove member from list
 				member.SuspicionState = StateFailed
-				fmt.Printf("[%s] Member %+v marked as Failed (timeout in failchecker)\n", time.Now().Format("15:04:05.000"), member.MachineId)
-				Logger.Printf("DropSearch Member %+v marked as Failed, elapsed time: %+v\n", member.MachineId, elapsed)
+				member.FailedBy = GetSelf()
+				fmt.Printf("[%s] Member %+v marked as Failed (timeout in failchecker)\n", now.Format("15:04:05.000"), member.MachineId)
+				LogMemberEvent(Logger, EventKeyFail, member.MachineId, "source", "local", "elapsed", elapsed)
+				list.reportFailureLocked(id, now)
+				MetricFailuresDeclared.With("local").Inc()
+				RecordDetection(id, StateFailed, "local", now)
 			}
 		} else if member.SuspicionState == StateFailed {
 			if elapsed > Tclean {
 				delete(list.members, id)
-				Logger.Printf("Member %+v removed from membership list due to cleanup, elapsed time: %+v\n", member.MachineId, elapsed)
+				list.removed[id] = now
+				removed = true
+				Logger.Info("member removed", "member", member.MachineId, "elapsed", elapsed)
 			}
 		}
 	}
+	if removed {
+		list.updateSortedRing()
+	}
 	list.mutex.Unlock()
 }
 
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// types of events raised by the failure detector
+type EventType string
+
+const (
+	EventPartitionSuspected EventType = "PartitionSuspected"
+	EventPartitionHealed    EventType = "PartitionHealed"
+	EventSelfFailed         EventType = "SelfFailed"
+	EventRejoined           EventType = "Rejoined"
+	EventMemberFailed       EventType = "MemberFailed"
+	EventMemberJoined       EventType = "MemberJoined"
+)
+
+// event struct passed to every handler
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Members []MachineId // members the event is about
+	Detail  string
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("[%s] %s members=%v %s", e.Time.Format("15:04:05.000"), e.Type, e.Members, e.Detail)
+}
+
+// registered event handlers
+var (
+	eventHandlers []func(Event)
+	eventMutex    sync.RWMutex
+)
+
+// registers a handler that gets called for every event
+func OnEvent(handler func(Event)) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	eventHandlers = append(eventHandlers, handler)
+}
+
+// logs the event and hands it to the handlers
+func EmitEvent(event Event) {
+	if event.Time.IsZero() {
+		event.Time = Now()
+	}
+	Logger.Info(string(event.Type), "members", fmt.Sprint(event.Members), "detail", event.Detail)
+
+	eventMutex.RLock()
+	defer eventMutex.RUnlock()
+	for _, handler := range eventHandlers {
+		// events can be raised while the membership list is locked, so handlers run on their own goroutine
+		go handler(event)
+	}
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// detection recording for experiments: between start_exp and stop_exp every node remembers when
+// it marked a member suspicious or failed and by which path it learned about it. the experiment
+// package puts the records of all nodes next to the kill times
+
+type Detection struct {
+	Member MachineId
+	State  SuspicionState // StateSuspicious or StateFailed
+	Source string         // "local" (own timeout or missed ack), "gossip" or "pingack"
+	At     time.Time
+}
+
+// what a node reports at the end of an experiment
+type ExperimentRecord struct {
+	Node       MachineId
+	Started    time.Time
+	Stopped    time.Time // zero while the experiment is running
+	Detections []Detection
+}
+
+var (
+	experiment      *ExperimentRecord // nil while no experiment is running
+	experimentMutex sync.Mutex
+)
+
+func StartExperimentRecording(now time.Time) error {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	if experiment != nil {
+		return fmt.Errorf("experiment already running")
+	}
+	experiment = &ExperimentRecord{Node: GetSelf(), Started: now}
+	return nil
+}
+
+// ends the experiment and returns what was recorded
+func StopExperimentRecording(now time.Time) (ExperimentRecord, error) {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	if experiment == nil {
+		return ExperimentRecord{}, fmt.Errorf("no experiment running")
+	}
+	record := *experiment
+	record.Stopped = now
+	experiment = nil
+	return record, nil
+}
+
+// copy of the running experiment, false if none is running
+func ExperimentSnapshot() (ExperimentRecord, bool) {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	if experiment == nil {
+		return ExperimentRecord{}, false
+	}
+	record := *experiment
+	record.Detections = append([]Detection(nil), experiment.Detections...)
+	return record, true
+}
+
+// called on every transition of another member to suspicious or failed
+func RecordDetection(member MachineId, state SuspicionState, source string, at time.Time) {
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	if experiment == nil || member == GetSelf() {
+		return
+	}
+	experiment.Detections = append(experiment.Detections, Detection{Member: member, State: state, Source: source, At: at})
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// clock that only moves when Advance is called. timers, tickers and sleeps fire once the time
+// passes their deadline, so a test can step through Tsus/Tfail/Tclean without real waits
+type FakeClock struct {
+	now     time.Time
+	waiters []*fakeWaiter
+	mutex   sync.Mutex
+}
+
+type fakeWaiter struct {
+	at      time.Time
+	period  time.Duration // 0 for timers and sleeps
+	ch      chan time.Time
+	stopped bool
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// blocks until another goroutine advanced the clock by d
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return &fakeTicker{clock: c, waiter: w}
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	waiter *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.waiter.ch }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	t.waiter.stopped = true
+}
+
+// moves the clock forward and fires every timer, ticker and sleep that is due. like time.Ticker,
+// a ticker whose last tick wasn't read yet drops the new one
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.stopped {
+			continue
+		}
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.ch <- w.at:
+		default:
+		}
+		if w.period > 0 {
+			for !w.at.After(c.now) {
+				w.at = w.at.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+}
+
+// moves the clock to t, never backwards
+func (c *FakeClock) AdvanceTo(t time.Time) {
+	if d := t.Sub(c.Now()); d > 0 {
+		c.Advance(d)
+	}
+}
+
+// number of timers, tickers and sleeps waiting on the clock, lets a test wait until the
+// goroutine under test is blocked before advancing
+func (c *FakeClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
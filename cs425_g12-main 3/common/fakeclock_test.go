@@ -0,0 +1,127 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	testTsus   = 2 * time.Second
+	testTfail  = 4 * time.Second
+	testTclean = 8 * time.Second
+	testTcheck = 100 * time.Millisecond
+)
+
+// state the tests use for a member that was removed from the list
+const stateRemoved SuspicionState = 255
+
+// a member that stops sending heartbeats, returns the list and the member
+func silentMemberList(t *testing.T, clock *FakeClock) (*MembershipList, MachineId) {
+	t.Helper()
+	self := NewMachineId("127.0.0.1", 5051, time.Unix(0, 1))
+	other := NewMachineId("127.0.0.2", 5051, time.Unix(0, 2))
+	SetSelf(self)
+	SetProtocolMode(ProtocolGossip)
+
+	list := NewMembershipList()
+	list.SetClock(clock)
+	for _, id := range []MachineId{self, other} {
+		member := NewMember(id)
+		member.TimeLocal = clock.Now()
+		list.Insert(member)
+	}
+	return list, other
+}
+
+// state of id, or stateRemoved once it was removed
+func stateOf(list *MembershipList, id MachineId) SuspicionState {
+	member := list.GetMember(id)
+	if member == nil {
+		return stateRemoved
+	}
+	return member.SuspicionState
+}
+
+// runs the checkers and advances the clock to their next round, returns the states the
+// member went through and when it entered each of them
+func driveCheckers(list *MembershipList, clock *FakeClock, id MachineId, until time.Duration) ([]SuspicionState, []time.Duration) {
+	start := clock.Now()
+	states := []SuspicionState{stateOf(list, id)}
+	entered := []time.Duration{0}
+	for clock.Now().Sub(start) < until {
+		next := list.RunCheckers(testTsus, testTfail, testTclean, testTcheck, testTcheck)
+		if state := stateOf(list, id); state != states[len(states)-1] {
+			states = append(states, state)
+			entered = append(entered, clock.Now().Sub(start))
+		}
+		clock.Advance(next)
+	}
+	return states, entered
+}
+
+func TestCheckersWithSuspicion(t *testing.T) {
+	SetSuspicionMode(true)
+	defer SetSuspicionMode(false)
+	clock := NewFakeClock(time.Unix(1000, 0))
+	list, other := silentMemberList(t, clock)
+
+	states, entered := driveCheckers(list, clock, other, testTclean+time.Second)
+
+	want := []SuspicionState{StateAlive, StateSuspicious, StateFailed, stateRemoved}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+	deadlines := []time.Duration{0, testTsus, testTfail, testTclean}
+	for i := 1; i < len(deadlines); i++ {
+		if entered[i] <= deadlines[i] || entered[i] > deadlines[i]+testTcheck {
+			t.Errorf("entered state %v after %v, want within one check after %v", states[i], entered[i], deadlines[i])
+		}
+	}
+}
+
+func TestCheckersWithoutSuspicion(t *testing.T) {
+	SetSuspicionMode(false)
+	clock := NewFakeClock(time.Unix(1000, 0))
+	list, other := silentMemberList(t, clock)
+
+	states, entered := driveCheckers(list, clock, other, testTclean+time.Second)
+
+	want := []SuspicionState{StateAlive, StateFailed, stateRemoved}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states = %v, want %v", states, want)
+		}
+	}
+	deadlines := []time.Duration{0, testTfail, testTclean}
+	for i := 1; i < len(deadlines); i++ {
+		if entered[i] <= deadlines[i] || entered[i] > deadlines[i]+testTcheck {
+			t.Errorf("entered state %v after %v, want within one check after %v", states[i], entered[i], deadlines[i])
+		}
+	}
+}
+
+func TestCheckersKeepMemberWithHeartbeats(t *testing.T) {
+	SetSuspicionMode(true)
+	defer SetSuspicionMode(false)
+	clock := NewFakeClock(time.Unix(1000, 0))
+	list, other := silentMemberList(t, clock)
+
+	for i := 0; i < 100; i++ {
+		clock.Advance(list.RunCheckers(testTsus, testTfail, testTclean, testTcheck, testTcheck))
+		// a heartbeat every second
+		if i%10 == 0 {
+			list.GetMember(other).TimeLocal = clock.Now()
+		}
+		if state := stateOf(list, other); state != StateAlive {
+			t.Fatalf("member is %v after %v with heartbeats", state, time.Duration(i+1)*testTcheck)
+		}
+	}
+}
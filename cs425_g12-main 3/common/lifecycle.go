@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// long running goroutines of the node, waited for on shutdown
+var goroutines sync.WaitGroup
+
+// starts a long running goroutine that WaitGoroutines waits for
+func Go(fn func()) {
+	goroutines.Add(1)
+	go func() {
+		defer goroutines.Done()
+		fn()
+	}()
+}
+
+// waits until every goroutine started with Go returned, or until ctx is done
+func WaitGoroutines(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		goroutines.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleeps for d on the clock, returns false if ctx was cancelled first
+func SleepContext(ctx context.Context, clock Clock, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-clock.After(d):
+		return ctx.Err() == nil
+	}
+}
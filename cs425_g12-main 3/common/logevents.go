@@ -0,0 +1,29 @@
+package common
+
+import (
+	"cs425_g12/logging"
+	"fmt"
+)
+
+// key membership events. the field names are stable so log queries keep working:
+//
+//	event=suspect|fail|refute|join|leave member=<ip>:<port> version=<version> source=local|gossip|pingack|...
+type LogEventKey string
+
+const (
+	EventKeySuspect LogEventKey = "suspect"
+	EventKeyFail    LogEventKey = "fail"
+	EventKeyRefute  LogEventKey = "refute"
+	EventKeyJoin    LogEventKey = "join"
+	EventKeyLeave   LogEventKey = "leave"
+)
+
+// logs a key event about member at info level, kv are extra key value pairs
+func LogMemberEvent(logger *logging.Logger, event LogEventKey, member MachineId, kv ...any) {
+	args := append([]any{
+		"event", string(event),
+		"member", fmt.Sprintf("%s:%d", member.Ip, member.Port),
+		"version", member.Version,
+	}, kv...)
+	logger.Info(string(event), args...)
+}
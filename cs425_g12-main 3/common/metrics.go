@@ -0,0 +1,36 @@
+package common
+
+import (
+	"cs425_g12/metrics"
+	"sync"
+)
+
+// failure detector metrics updated by the checkers and the merge functions
+var (
+	MetricSuspicions       = metrics.NewCounter("fd_suspicions_total", "Members marked suspicious by this node.")
+	MetricFailuresDeclared = metrics.NewCounterVec("fd_failures_declared_total", "Members this node marked as failed, by how it found out (local, gossip, pingack).", "source")
+	MetricRefutations      = metrics.NewCounter("fd_refutations_total", "Times this node refuted a suspicion or failure of itself.")
+	MetricFalsePositives   = metrics.NewCounterVec("fd_false_positives_total", "Members marked suspicious or failed that later refuted it.", "state")
+)
+
+var registerMetricsOnce sync.Once
+
+// cluster size by state, computed on every scrape. a gauge can only be registered once, so only
+// the first call registers it
+func (list *MembershipList) RegisterMetrics() {
+	registerMetricsOnce.Do(func() { list.registerMetrics() })
+}
+
+func (list *MembershipList) registerMetrics() {
+	metrics.NewGaugeFunc("fd_members", "Members in the membership list by state.", "state", func() map[string]float64 {
+		counts := map[string]float64{
+			StateAlive.String():      0,
+			StateSuspicious.String(): 0,
+			StateFailed.String():     0,
+		}
+		for _, member := range list.GetEntireList() {
+			counts[member.SuspicionState.String()]++
+		}
+		return counts
+	})
+}
@@ -0,0 +1,173 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cluster wide protocol and suspicion mode. a switch on any node creates a mode with a higher
+// epoch which is piggybacked on every message, so all nodes converge to the same mode
+
+type ClusterMode struct {
+	Protocol  ProtocolMode
+	Suspicion bool
+	Epoch     uint64
+	Origin    MachineId // node that issued the switch, for epoch 0 this is the node's own start config
+}
+
+func (m ClusterMode) String() string {
+	sus := "nosuspect"
+	if m.Suspicion {
+		sus = "suspect"
+	}
+	return fmt.Sprintf("<%s, %s> epoch %d from %s", m.Protocol, sus, m.Epoch, m.Origin)
+}
+
+// true if a should replace b: higher epoch wins, for the same epoch the older origin wins so a
+// newly started node adopts the mode the group is already running
+func (a ClusterMode) supersedes(b ClusterMode) bool {
+	if a.Origin.Ip == "" {
+		return false // no mode attached
+	}
+	if a.Epoch != b.Epoch {
+		return a.Epoch > b.Epoch
+	}
+	return a.Origin.Version < b.Origin.Version
+}
+
+var (
+	latestMode       ClusterMode               // newest mode we know of
+	runningMode      ClusterMode               // mode the protocol loops are running
+	peerModeEpochs   = make(map[string]uint64) // last epoch heard from each peer (ip:port)
+	clusterModeMutex sync.Mutex
+)
+
+// sets the start mode of this node and applies it right away
+func InitClusterMode(protocol ProtocolMode, suspicion bool) {
+	clusterModeMutex.Lock()
+	defer clusterModeMutex.Unlock()
+	latestMode = ClusterMode{Protocol: protocol, Suspicion: suspicion, Epoch: 0, Origin: GetSelf()}
+	runningMode = latestMode
+	SetProtocolMode(protocol)
+	SetSuspicionMode(suspicion)
+}
+
+// newest known mode, this is what gets piggybacked
+func GetClusterMode() ClusterMode {
+	clusterModeMutex.Lock()
+	defer clusterModeMutex.Unlock()
+	return latestMode
+}
+
+func GetRunningMode() ClusterMode {
+	clusterModeMutex.Lock()
+	defer clusterModeMutex.Unlock()
+	return runningMode
+}
+
+// switch issued on this node, applied at the next protocol round
+func ProposeMode(protocol ProtocolMode, suspicion bool) ClusterMode {
+	clusterModeMutex.Lock()
+	defer clusterModeMutex.Unlock()
+	latestMode = ClusterMode{Protocol: protocol, Suspicion: suspicion, Epoch: latestMode.Epoch + 1, Origin: GetSelf()}
+	Logger.Printf("Proposed cluster mode %s\n", latestMode)
+	return latestMode
+}
+
+// mode piggybacked by sender. returns true if it is newer than what we knew
+func ObserveMode(mode ClusterMode, sender MachineId) bool {
+	clusterModeMutex.Lock()
+	defer clusterModeMutex.Unlock()
+
+	if mode.Origin.Ip == "" {
+		return false
+	}
+	peerModeEpochs[fmt.Sprintf("%s:%d", sender.Ip, sender.Port)] = mode.Epoch
+
+	if !mode.supersedes(latestMode) {
+		return false
+	}
+	latestMode = mode
+	Logger.Printf("Learned cluster mode %s from %s\n", mode, sender)
+	return true
+}
+
+// called by the protocol loop between rounds, so a switch never happens while a probe is in flight
+func (list *MembershipList) ApplyPendingMode() {
+	clusterModeMutex.Lock()
+	if latestMode == runningMode {
+		clusterModeMutex.Unlock()
+		return
+	}
+	previous := runningMode
+	runningMode = latestMode
+	mode := runningMode
+	clusterModeMutex.Unlock()
+
+	if !previous.Protocol.UsesGossip() && mode.Protocol.UsesGossip() {
+		// ping/ack doesn't keep TimeLocal fresh for members we didn't probe, give everyone a full
+		// timeout before the heartbeat checkers start counting
+		list.refreshTimers(list.Clock().Now())
+	}
+	SetProtocolMode(mode.Protocol)
+	SetSuspicionMode(mode.Suspicion)
+
+	fmt.Printf("[%s] Switched to cluster mode %s\n", Now().Format("15:04:05.000"), mode)
+	Logger.Info("switched cluster mode", "mode", mode.String(), "previous", previous.String())
+}
+
+func (list *MembershipList) refreshTimers(now time.Time) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	for _, member := range list.members {
+		if member.SuspicionState != StateFailed {
+			member.TimeLocal = now
+		}
+	}
+}
+
+// whether every alive member reported the epoch we are running
+type ModeAgreement struct {
+	Epoch       uint64
+	InAgreement bool
+	Agreeing    []string
+	Disagreeing map[string]uint64 // peer -> epoch it reported
+	Unknown     []string          // peers we haven't heard a mode from yet
+}
+
+func (list *MembershipList) GetModeAgreement() ModeAgreement {
+	self := GetSelf()
+	selfKey := fmt.Sprintf("%s:%d", self.Ip, self.Port)
+	peers := make([]string, 0)
+	for _, member := range list.GetUniqueMembers() {
+		key := fmt.Sprintf("%s:%d", member.MachineId.Ip, member.MachineId.Port)
+		if member.SuspicionState != StateFailed && key != selfKey {
+			peers = append(peers, key)
+		}
+	}
+	sort.Strings(peers)
+
+	clusterModeMutex.Lock()
+	defer clusterModeMutex.Unlock()
+
+	agreement := ModeAgreement{
+		Epoch:       runningMode.Epoch,
+		InAgreement: latestMode == runningMode,
+		Disagreeing: make(map[string]uint64),
+	}
+	for _, peer := range peers {
+		epoch, heard := peerModeEpochs[peer]
+		if !heard {
+			agreement.Unknown = append(agreement.Unknown, peer)
+			agreement.InAgreement = false
+		} else if epoch != runningMode.Epoch {
+			agreement.Disagreeing[peer] = epoch
+			agreement.InAgreement = false
+		} else {
+			agreement.Agreeing = append(agreement.Agreeing, peer)
+		}
+	}
+	return agreement
+}
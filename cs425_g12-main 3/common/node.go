@@ -0,0 +1,68 @@
+package common
+
+// a real process runs a single node, so self, group membership and the modes are package
+// globals. the simulator runs many nodes in one process and activates the state of a node
+// before every step it runs for it
+
+type NodeState struct {
+	self           MachineId
+	inGroup        bool
+	protocol       ProtocolMode
+	suspicion      bool
+	latestMode     ClusterMode
+	runningMode    ClusterMode
+	peerModeEpochs map[string]uint64
+	experiment     *ExperimentRecord
+}
+
+func NewNodeState(self MachineId) *NodeState {
+	return &NodeState{self: self, peerModeEpochs: make(map[string]uint64)}
+}
+
+var activeNode *NodeState
+
+// saves the globals into the state of the active node and loads this node's state
+func (state *NodeState) Activate() {
+	if activeNode == state {
+		return
+	}
+	if activeNode != nil {
+		activeNode.save()
+	}
+	state.load()
+	activeNode = state
+}
+
+func (state *NodeState) save() {
+	state.self = GetSelf()
+	state.inGroup = IsMemberInGroup
+	state.protocol = GetProtocolMode()
+	state.suspicion = GetSuspicionMode()
+
+	clusterModeMutex.Lock()
+	defer clusterModeMutex.Unlock()
+	state.latestMode = latestMode
+	state.runningMode = runningMode
+	state.peerModeEpochs = peerModeEpochs
+
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	state.experiment = experiment
+}
+
+func (state *NodeState) load() {
+	SetSelf(state.self)
+	IsMemberInGroup = state.inGroup
+	SetProtocolMode(state.protocol)
+	SetSuspicionMode(state.suspicion)
+
+	clusterModeMutex.Lock()
+	defer clusterModeMutex.Unlock()
+	latestMode = state.latestMode
+	runningMode = state.runningMode
+	peerModeEpochs = state.peerModeEpochs
+
+	experimentMutex.Lock()
+	defer experimentMutex.Unlock()
+	experiment = state.experiment
+}
@@ -0,0 +1,296 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// partition detection: if a large part of the group fails inside a short window it is much
+// more likely that the network split than that all of those machines crashed together. with
+// damping, a member is only failed locally while a partition is suspected if a majority of the
+// members we can still reach agrees: every member whose list shows it suspicious or failed votes
+// for failing it
+
+// config for the partition detector
+type PartitionConfig struct {
+	Window      time.Duration // failures inside this window are counted together
+	Threshold   float64       // fraction of the group that has to fail inside the window
+	MinFailures int           // minimum number of failures, so a small group doesn't trigger on one crash
+	Damping     bool          // while a partition is suspected, only fail members a majority of the reachable group agrees on
+	Timeout     time.Duration // give up on the partition (and stop damping) if nothing comes back by then
+}
+
+var DefaultPartitionConfig = PartitionConfig{
+	Window:      5 * time.Second,
+	Threshold:   0.4,
+	MinFailures: 2,
+	Damping:     false,
+	Timeout:     time.Minute,
+}
+
+// snapshot of the partition detector for printing
+type PartitionStatus struct {
+	Suspected   bool
+	Since       time.Time
+	Reachable   []MachineId // members we can still hear from
+	Unreachable []MachineId // members that failed when the partition was detected
+	Merged      []MachineId // unreachable members that came back after healing started
+}
+
+type failureRecord struct {
+	machineId MachineId
+	time      time.Time
+}
+
+type partitionDetector struct {
+	mutex          sync.Mutex
+	config         PartitionConfig
+	recentFailures []failureRecord
+	suspected      bool
+	suspectedAt    time.Time
+	unreachable    map[MachineId]bool
+	merged         []MachineId
+	healingAt      time.Time                             // set when the first unreachable member came back
+	accusations    map[MachineId]map[MachineId]time.Time // member -> members that listed it suspicious or failed, and when
+}
+
+func newPartitionDetector() *partitionDetector {
+	return &partitionDetector{
+		config:      DefaultPartitionConfig,
+		unreachable: make(map[MachineId]bool),
+		accusations: make(map[MachineId]map[MachineId]time.Time),
+	}
+}
+
+func (list *MembershipList) SetPartitionConfig(config PartitionConfig) {
+	list.partition.mutex.Lock()
+	defer list.partition.mutex.Unlock()
+	list.partition.config = config
+}
+
+// returns true if target should not be failed locally right now: a partition is suspected,
+// damping is on and less than a majority of the reachable members, us included, agrees
+func (list *MembershipList) FailureDamped(target MachineId) bool {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	return list.failureDampedLocked(target, list.clock.Now())
+}
+
+// same as FailureDamped but for callers that already hold the list mutex
+func (list *MembershipList) failureDampedLocked(target MachineId, now time.Time) bool {
+	return list.partition.damped(target, list.reachableLocked(), now)
+}
+
+// records that accuser lists target as suspicious or failed, a vote for failing it
+func (list *MembershipList) RecordAccusation(target MachineId, accuser MachineId) {
+	now := list.Clock().Now()
+	p := list.partition
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.config.Damping {
+		return
+	}
+	if p.accusations[target] == nil {
+		p.accusations[target] = make(map[MachineId]time.Time)
+	}
+	p.accusations[target][accuser] = now
+}
+
+func (p *partitionDetector) damped(target MachineId, reachable []MachineId, now time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.config.Damping || !p.suspected {
+		return false
+	}
+
+	self := GetSelf()
+	voters, agreeing := 0, 0
+	for _, id := range reachable {
+		if id.Ip == target.Ip {
+			continue // the member doesn't vote on itself
+		}
+		voters++
+		if id.Ip == self.Ip {
+			agreeing++ // we are the one asking
+		} else if at, found := p.accusations[target][id]; found && now.Sub(at) <= p.config.Window {
+			agreeing++
+		}
+	}
+	return agreeing < voters/2+1
+}
+
+// called whenever a member is marked failed (by a checker, a missed ack or through merging)
+func (list *MembershipList) ReportFailure(machineId MachineId) {
+	list.mutex.RLock()
+	groupSize := len(list.members)
+	reachable := list.reachableLocked()
+	list.mutex.RUnlock()
+
+	now := list.Clock().Now()
+	list.partition.recordFailure(machineId, groupSize, reachable, now)
+	EmitEvent(Event{Type: EventMemberFailed, Time: now, Members: []MachineId{machineId}})
+}
+
+// same as ReportFailure but for callers that already hold the list mutex
+func (list *MembershipList) reportFailureLocked(machineId MachineId, now time.Time) {
+	list.partition.recordFailure(machineId, len(list.members), list.reachableLocked(), now)
+	EmitEvent(Event{Type: EventMemberFailed, Time: now, Members: []MachineId{machineId}})
+}
+
+// called whenever a member shows up alive again through merging
+func (list *MembershipList) ReportRecovered(machineId MachineId) {
+	list.partition.recordRecovered(machineId, list.Clock().Now())
+}
+
+// members that are not marked as failed
+func (list *MembershipList) reachableLocked() []MachineId {
+	out := make([]MachineId, 0, len(list.members))
+	for id, member := range list.members {
+		if member.SuspicionState != StateFailed {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func (list *MembershipList) GetPartitionStatus() PartitionStatus {
+	list.mutex.RLock()
+	reachable := list.reachableLocked()
+	list.mutex.RUnlock()
+
+	p := list.partition
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	status := PartitionStatus{
+		Suspected: p.suspected,
+		Since:     p.suspectedAt,
+		Reachable: reachable,
+		Merged:    append([]MachineId(nil), p.merged...),
+	}
+	for id := range p.unreachable {
+		status.Unreachable = append(status.Unreachable, id)
+	}
+	return status
+}
+
+func (p *partitionDetector) recordFailure(machineId MachineId, groupSize int, reachable []MachineId, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.recentFailures = append(p.recentFailures, failureRecord{machineId: machineId, time: now})
+	p.pruneLocked(now)
+
+	if p.suspected {
+		// keep track of everything that fails while we are split
+		p.unreachable[machineId] = true
+		return
+	}
+
+	if groupSize == 0 || len(p.recentFailures) < p.config.MinFailures {
+		return
+	}
+
+	fraction := float64(len(p.recentFailures)) / float64(groupSize)
+	if fraction < p.config.Threshold {
+		return
+	}
+
+	// too many failures too fast, most likely a partition
+	p.suspected = true
+	p.suspectedAt = now
+	p.healingAt = time.Time{}
+	p.merged = nil
+	p.unreachable = make(map[MachineId]bool)
+	unreachable := make([]MachineId, 0, len(p.recentFailures))
+	for _, record := range p.recentFailures {
+		if !p.unreachable[record.machineId] {
+			p.unreachable[record.machineId] = true
+			unreachable = append(unreachable, record.machineId)
+		}
+	}
+
+	fmt.Printf("[%s] Partition suspected: %d of %d members failed within %s, reachable: %v\n", now.Format("15:04:05.000"), len(unreachable), groupSize, p.config.Window, reachable)
+	EmitEvent(Event{
+		Type:    EventPartitionSuspected,
+		Time:    now,
+		Members: unreachable,
+		Detail:  fmt.Sprintf("%.0f%% of the group failed within %s, reachable: %v, damping: %t", fraction*100, p.config.Window, reachable, p.config.Damping),
+	})
+}
+
+func (p *partitionDetector) recordRecovered(machineId MachineId, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.suspected {
+		return
+	}
+
+	// the member may have rejoined with a new version, so match on the address
+	for id := range p.unreachable {
+		if id.Ip == machineId.Ip && id.Port == machineId.Port {
+			delete(p.unreachable, id)
+			p.merged = append(p.merged, machineId)
+			if p.healingAt.IsZero() {
+				p.healingAt = now
+			}
+			Logger.Printf("Merged member %s back after partition (%d still unreachable)\n", machineId, len(p.unreachable))
+			return
+		}
+	}
+}
+
+// drops failures and accusations that are outside the window
+func (p *partitionDetector) pruneLocked(now time.Time) {
+	kept := p.recentFailures[:0]
+	for _, record := range p.recentFailures {
+		if now.Sub(record.time) <= p.config.Window {
+			kept = append(kept, record)
+		}
+	}
+	p.recentFailures = kept
+
+	for target, accusers := range p.accusations {
+		for accuser, at := range accusers {
+			if now.Sub(at) > p.config.Window {
+				delete(accusers, accuser)
+			}
+		}
+		if len(accusers) == 0 {
+			delete(p.accusations, target)
+		}
+	}
+}
+
+// called on every checker tick, finishes healing or gives up on the partition
+func (list *MembershipList) checkPartition(now time.Time) {
+	p := list.partition
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pruneLocked(now)
+	if !p.suspected {
+		return
+	}
+
+	if !p.healingAt.IsZero() && (len(p.unreachable) == 0 || now.Sub(p.healingAt) > p.config.Window) {
+		// everyone came back, or whoever is still missing most likely really failed
+		fmt.Printf("[%s] Partition healed: merged %v, still missing %d\n", now.Format("15:04:05.000"), p.merged, len(p.unreachable))
+		EmitEvent(Event{
+			Type:    EventPartitionHealed,
+			Time:    now,
+			Members: append([]MachineId(nil), p.merged...),
+			Detail:  fmt.Sprintf("merged %d members after %s, %d still missing", len(p.merged), now.Sub(p.suspectedAt).Round(time.Millisecond), len(p.unreachable)),
+		})
+		p.suspected = false
+		return
+	}
+
+	if p.healingAt.IsZero() && now.Sub(p.suspectedAt) > p.config.Timeout {
+		// nobody came back, stop treating it as a partition
+		Logger.Warn("partition suspicion expired", "timeout", p.config.Timeout, "unreachable", len(p.unreachable))
+		p.suspected = false
+	}
+}
@@ -0,0 +1,206 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// events raised while a test runs. handlers can't be removed, so every test shares one
+var (
+	testEvents      []Event
+	testEventsMutex sync.Mutex
+	testEventsOnce  sync.Once
+)
+
+// starts recording events, dropping the ones raised before
+func recordEvents() {
+	testEventsOnce.Do(func() {
+		OnEvent(func(event Event) {
+			testEventsMutex.Lock()
+			defer testEventsMutex.Unlock()
+			testEvents = append(testEvents, event)
+		})
+	})
+	testEventsMutex.Lock()
+	defer testEventsMutex.Unlock()
+	testEvents = nil
+}
+
+// waits for the first event of eventType, handlers run on their own goroutine
+func waitForEvent(t *testing.T, eventType EventType) Event {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		testEventsMutex.Lock()
+		for _, event := range testEvents {
+			if event.Type == eventType {
+				testEventsMutex.Unlock()
+				return event
+			}
+		}
+		testEventsMutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no %s event", eventType)
+	return Event{}
+}
+
+// a group of n members with self first, every member heard from just now
+func partitionGroup(t *testing.T, clock *FakeClock, n int, config PartitionConfig) (*MembershipList, []MachineId) {
+	t.Helper()
+	SetSuspicionMode(false)
+	SetProtocolMode(ProtocolGossip)
+
+	ids := make([]MachineId, n)
+	for i := range ids {
+		ids[i] = NewMachineId(fmt.Sprintf("127.0.0.%d", i+1), 5051, time.Unix(0, int64(i+1)))
+	}
+	SetSelf(ids[0])
+
+	list := NewMembershipList()
+	list.SetClock(clock)
+	list.SetPartitionConfig(config)
+	for _, id := range ids {
+		member := NewMember(id)
+		member.TimeLocal = clock.Now()
+		list.Insert(member)
+	}
+	return list, ids
+}
+
+// runs the checkers until the clock passed until. the members in silent stop sending heartbeats
+// at the time given for them, every other member sends one every round
+func runGroup(list *MembershipList, clock *FakeClock, ids []MachineId, silent map[int]time.Duration, until time.Duration) {
+	start := clock.Now()
+	for clock.Now().Sub(start) < until {
+		for i, id := range ids[1:] {
+			if at, found := silent[i+1]; found && clock.Now().Sub(start) >= at {
+				continue
+			}
+			if member := list.GetMember(id); member != nil && member.SuspicionState != StateFailed {
+				member.TimeLocal = clock.Now()
+			}
+		}
+		clock.Advance(list.RunCheckers(testTsus, testTfail, testTclean, testTcheck, testTcheck))
+	}
+}
+
+func TestPartitionSuspected(t *testing.T) {
+	config := DefaultPartitionConfig
+	tests := []struct {
+		name          string
+		silent        map[int]time.Duration // member -> when it stops sending heartbeats
+		wantSuspected bool
+	}{
+		{"fraction fails inside the window", map[int]time.Duration{1: 0, 2: 0}, true},
+		{"fraction fails spread over the window", map[int]time.Duration{1: 0, 2: config.Window - time.Second}, true},
+		{"single failure", map[int]time.Duration{1: 0}, false},
+		{"failures further apart than the window", map[int]time.Duration{1: 0, 2: config.Window + time.Second}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recordEvents()
+			clock := NewFakeClock(time.Unix(1000, 0))
+			list, ids := partitionGroup(t, clock, 5, config)
+
+			runGroup(list, clock, ids, test.silent, 2*config.Window+testTfail)
+
+			status := list.GetPartitionStatus()
+			if status.Suspected != test.wantSuspected {
+				t.Fatalf("suspected = %v, want %v", status.Suspected, test.wantSuspected)
+			}
+			if !test.wantSuspected {
+				return
+			}
+			if len(status.Unreachable) != len(test.silent) {
+				t.Errorf("unreachable = %v, want the %d silent members", status.Unreachable, len(test.silent))
+			}
+			event := waitForEvent(t, EventPartitionSuspected)
+			if len(event.Members) != len(test.silent) {
+				t.Errorf("event members = %v, want the %d silent members", event.Members, len(test.silent))
+			}
+		})
+	}
+}
+
+func TestPartitionDampsFailureWithoutQuorum(t *testing.T) {
+	config := DefaultPartitionConfig
+	config.Threshold = 0.25
+	config.Damping = true
+	tests := []struct {
+		name      string
+		accusers  []int // members that list the late member as failed, 5 members vote with us
+		wantState SuspicionState
+	}{
+		{"no accusations", nil, StateSuspicious},
+		{"minority", []int{4}, StateSuspicious},
+		{"quorum", []int{4, 5}, StateFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recordEvents()
+			clock := NewFakeClock(time.Unix(1000, 0))
+			// 1 and 2 fail together and raise the partition, 3 goes silent once it is suspected
+			list, ids := partitionGroup(t, clock, 8, config)
+			runGroup(list, clock, ids, map[int]time.Duration{1: 0, 2: 0}, testTfail+2*testTcheck)
+			if !list.GetPartitionStatus().Suspected {
+				t.Fatal("partition not suspected")
+			}
+			waitForEvent(t, EventPartitionSuspected)
+
+			late := ids[3]
+			for _, accuser := range test.accusers {
+				list.RecordAccusation(late, ids[accuser])
+			}
+			runGroup(list, clock, ids, map[int]time.Duration{1: 0, 2: 0, 3: 0}, testTfail+2*testTcheck)
+
+			if state := stateOf(list, late); state != test.wantState {
+				t.Errorf("late member is %v, want %v", state, test.wantState)
+			}
+		})
+	}
+}
+
+func TestPartitionHealed(t *testing.T) {
+	config := DefaultPartitionConfig
+	tests := []struct {
+		name       string
+		recovered  []int
+		healWithin time.Duration // after the first member came back
+	}{
+		{"every member back", []int{1, 2}, testTcheck},
+		{"one member back", []int{1}, config.Window + testTcheck},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recordEvents()
+			clock := NewFakeClock(time.Unix(1000, 0))
+			list, ids := partitionGroup(t, clock, 5, config)
+			runGroup(list, clock, ids, map[int]time.Duration{1: 0, 2: 0}, testTfail+2*testTcheck)
+			if !list.GetPartitionStatus().Suspected {
+				t.Fatal("partition not suspected")
+			}
+
+			for _, i := range test.recovered {
+				list.ReportRecovered(ids[i])
+			}
+			back := clock.Now()
+			for list.GetPartitionStatus().Suspected {
+				if clock.Now().Sub(back) > test.healWithin {
+					t.Fatalf("partition not healed %v after the members came back", test.healWithin)
+				}
+				clock.Advance(list.RunCheckers(testTsus, testTfail, testTclean, testTcheck, testTcheck))
+			}
+
+			event := waitForEvent(t, EventPartitionHealed)
+			if len(event.Members) != len(test.recovered) {
+				t.Errorf("healed event merged %v, want %d members", event.Members, len(test.recovered))
+			}
+			if merged := list.GetPartitionStatus().Merged; len(merged) != len(test.recovered) {
+				t.Errorf("merged = %v, want %d members", merged, len(test.recovered))
+			}
+		})
+	}
+}
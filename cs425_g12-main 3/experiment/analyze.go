@@ -0,0 +1,239 @@
+package experiment
+
+import (
+	"cs425_g12/common"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// puts the detection records of every node next to the times the controller killed nodes:
+// first detection and full dissemination latency per kill, the path each node learned of the
+// failure by, and false positives. the same analysis runs on records of real nodes (collected by
+// run/expctl) and of simulated ones
+
+// a node killed by the controller
+type Kill struct {
+	Member common.MachineId // ip and port of the node, the version is ignored
+	At     time.Time        // controller clock
+}
+
+// record of one node as the controller received it
+type NodeReport struct {
+	Record common.ExperimentRecord
+	Offset time.Duration // clock of the node minus clock of the controller
+}
+
+type KillResult struct {
+	Member            string
+	At                time.Time
+	FirstDetection    time.Duration // -1 if no node declared it failed
+	FirstBy           string
+	FirstSource       string
+	FullDissemination time.Duration // -1 until every reporting node declared it failed
+	DetectedBy        int
+	Reporting         int            // nodes that reported and were running at the kill
+	Sources           map[string]int // path by which each node first learned of the failure
+	AlreadyFailed     []string       // nodes that had declared it failed before the kill and didn't again
+	Missing           []string       // nodes that never declared it failed
+}
+
+type Result struct {
+	Nodes    int
+	Duration time.Duration
+
+	Kills []KillResult
+
+	FalseSuspicions   int     // members marked suspicious that were not killed
+	FalseFailures     int     // members declared failed that were not killed, or before they were
+	FalsePositiveRate float64 // false failures per node per minute
+	FalseBySource     map[string]int
+}
+
+func memberKey(id common.MachineId) string {
+	return fmt.Sprintf("%s:%d", id.Ip, id.Port)
+}
+
+// time of a detection on the controller clock
+func (r NodeReport) controllerTime(at time.Time) time.Time {
+	return at.Add(-r.Offset)
+}
+
+func Analyze(kills []Kill, reports []NodeReport) Result {
+	result := Result{FalseBySource: make(map[string]int)}
+
+	killedAt := make(map[string]time.Time)
+	for _, kill := range kills {
+		killedAt[memberKey(kill.Member)] = kill.At
+	}
+	// a killed node reports what it saw while cut off, only what it saw before the kill counts
+	reports = append([]NodeReport(nil), reports...)
+	for i, report := range reports {
+		if at, killed := killedAt[memberKey(report.Record.Node)]; killed {
+			reports[i] = report.until(at)
+		}
+	}
+	result.Nodes = len(reports)
+
+	for _, report := range reports {
+		stopped := report.Record.Stopped
+		if stopped.IsZero() {
+			stopped = report.Record.Started
+			for _, detection := range report.Record.Detections {
+				if detection.At.After(stopped) {
+					stopped = detection.At
+				}
+			}
+		}
+		if duration := stopped.Sub(report.Record.Started); duration > result.Duration {
+			result.Duration = duration
+		}
+
+		for _, detection := range report.Record.Detections {
+			at, killed := killedAt[memberKey(detection.Member)]
+			if killed && !report.controllerTime(detection.At).Before(at) {
+				continue
+			}
+			switch detection.State {
+			case common.StateSuspicious:
+				result.FalseSuspicions++
+			case common.StateFailed:
+				result.FalseFailures++
+				result.FalseBySource[detection.Source]++
+			}
+		}
+	}
+	if minutes := result.Duration.Minutes() * float64(result.Nodes); minutes > 0 {
+		result.FalsePositiveRate = float64(result.FalseFailures) / minutes
+	}
+
+	for _, kill := range kills {
+		result.Kills = append(result.Kills, analyzeKill(kill, reports, killedAt))
+	}
+	return result
+}
+
+// drops everything the node recorded after it was killed at
+func (r NodeReport) until(at time.Time) NodeReport {
+	out := r
+	out.Record.Detections = nil
+	for _, detection := range r.Record.Detections {
+		if r.controllerTime(detection.At).Before(at) {
+			out.Record.Detections = append(out.Record.Detections, detection)
+		}
+	}
+	if stopped := at.Add(r.Offset); r.Record.Stopped.IsZero() || stopped.Before(r.Record.Stopped) {
+		out.Record.Stopped = stopped
+	}
+	return out
+}
+
+func analyzeKill(kill Kill, reports []NodeReport, killedAt map[string]time.Time) KillResult {
+	key := memberKey(kill.Member)
+	out := KillResult{
+		Member:            key,
+		At:                kill.At,
+		FirstDetection:    -1,
+		FullDissemination: -1,
+		Sources:           make(map[string]int),
+	}
+
+	for _, report := range reports {
+		node := memberKey(report.Record.Node)
+		nodeKilledAt, killed := killedAt[node]
+		if node == key || (killed && !nodeKilledAt.After(kill.At)) {
+			continue // was not running at the kill
+		}
+
+		// first failure declared by this node after the kill
+		var first *common.Detection
+		var firstAt time.Time
+		failedBefore := false
+		for i, detection := range report.Record.Detections {
+			if detection.State != common.StateFailed || memberKey(detection.Member) != key {
+				continue
+			}
+			at := report.controllerTime(detection.At)
+			if at.Before(kill.At) {
+				failedBefore = true
+				continue
+			}
+			if first == nil || at.Before(firstAt) {
+				first = &report.Record.Detections[i]
+				firstAt = at
+			}
+		}
+		if first == nil {
+			if failedBefore {
+				out.AlreadyFailed = append(out.AlreadyFailed, node)
+			} else if !killed {
+				out.Missing = append(out.Missing, node)
+			}
+			// a node killed later without having detected this one doesn't count
+			continue
+		}
+		out.DetectedBy++
+		out.Sources[first.Source]++
+		latency := firstAt.Sub(kill.At)
+		if out.FirstDetection < 0 || latency < out.FirstDetection {
+			out.FirstDetection = latency
+			out.FirstBy = memberKey(report.Record.Node)
+			out.FirstSource = first.Source
+		}
+		if latency > out.FullDissemination {
+			out.FullDissemination = latency
+		}
+	}
+	out.Reporting = out.DetectedBy + len(out.Missing)
+	if len(out.Missing) > 0 {
+		out.FullDissemination = -1
+	}
+	sort.Strings(out.Missing)
+	sort.Strings(out.AlreadyFailed)
+	return out
+}
+
+func formatLatency(d time.Duration) string {
+	if d < 0 {
+		return "never"
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+func formatSources(sources map[string]int) string {
+	keys := make([]string, 0, len(sources))
+	for source := range sources {
+		keys = append(keys, source)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, source := range keys {
+		parts = append(parts, fmt.Sprintf("%s %d", source, sources[source]))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r Result) String() string {
+	var b strings.Builder
+	for _, kill := range r.Kills {
+		fmt.Fprintf(&b, "kill of %s: first detection %s", kill.Member, formatLatency(kill.FirstDetection))
+		if kill.FirstDetection >= 0 {
+			fmt.Fprintf(&b, " by %s (%s)", kill.FirstBy, kill.FirstSource)
+		}
+		fmt.Fprintf(&b, ", full dissemination %s (%d of %d nodes)\n", formatLatency(kill.FullDissemination), kill.DetectedBy, kill.Reporting)
+		fmt.Fprintf(&b, "  learned by: %s\n", formatSources(kill.Sources))
+		if len(kill.AlreadyFailed) > 0 {
+			fmt.Fprintf(&b, "  declared failed before the kill by: %s\n", strings.Join(kill.AlreadyFailed, ", "))
+		}
+		if len(kill.Missing) > 0 {
+			fmt.Fprintf(&b, "  never detected by: %s\n", strings.Join(kill.Missing, ", "))
+		}
+	}
+	fmt.Fprintf(&b, "false positives: %d suspicions, %d failures (%.4f per node per minute, %s) over %s on %d nodes\n",
+		r.FalseSuspicions, r.FalseFailures, r.FalsePositiveRate, formatSources(r.FalseBySource), r.Duration.Round(time.Millisecond), r.Nodes)
+	return b.String()
+}
@@ -0,0 +1,322 @@
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cs425_g12/common"
+)
+
+// what the protocol needs from the network, net.PacketConn satisfies it
+type Transport interface {
+	WriteTo(p []byte, addr net.Addr) (int, error)
+	ReadFrom(p []byte) (int, net.Addr, error)
+	Close() error
+}
+
+// fault injection on the transport: drops, latency with jitter, duplication and reordering per
+// peer and message type, with optional schedules. drops apply in both directions, everything
+// else only to outgoing messages. a one way partition is a drop rule in one direction only
+
+type FaultRule struct {
+	Id        int
+	Direction string        // "in", "out" or "both"
+	Peer      string        // ip or ip:port, empty for every peer
+	MsgType   string        // message type, empty for every type
+	Drop      float64       // probability of dropping the message
+	Delay     time.Duration // added latency
+	Jitter    time.Duration // random extra latency up to this much
+	Duplicate float64       // probability of sending the message twice
+	Reorder   float64       // probability of holding the message back so later ones overtake it
+	After     time.Duration // rule starts this long after it was added
+	For       time.Duration // rule stays active this long, 0 means until removed
+	AddedAt   time.Time
+}
+
+// parses a rule like "dir=out,peer=172.22.94.225,type=ping,drop=0.5,delay=100ms,jitter=20ms,dup=0.1,reorder=0.2,after=10s,for=30s"
+func ParseFaultRule(spec string) (FaultRule, error) {
+	rule := FaultRule{Direction: "both"}
+	options := 0
+	for _, part := range strings.Split(spec, ",") {
+		if part == "" {
+			continue
+		}
+		options++
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			return rule, fmt.Errorf("invalid fault option %q (expected key=value)", part)
+		}
+
+		var err error
+		switch key {
+		case "dir":
+			if value != "in" && value != "out" && value != "both" {
+				return rule, fmt.Errorf("invalid direction %q (expected in, out or both)", value)
+			}
+			rule.Direction = value
+		case "peer":
+			rule.Peer = value
+		case "type":
+			rule.MsgType = value
+		case "drop":
+			rule.Drop, err = parseProbability(value)
+		case "dup":
+			rule.Duplicate, err = parseProbability(value)
+		case "reorder":
+			rule.Reorder, err = parseProbability(value)
+		case "delay":
+			rule.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			rule.Jitter, err = time.ParseDuration(value)
+		case "after":
+			rule.After, err = time.ParseDuration(value)
+		case "for":
+			rule.For, err = time.ParseDuration(value)
+		default:
+			return rule, fmt.Errorf("unknown fault option %q", key)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	if options == 0 {
+		return rule, fmt.Errorf("empty fault rule (expected options like drop=0.5,delay=100ms)")
+	}
+	return rule, nil
+}
+
+func parseProbability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("%v is not between 0 and 1", p)
+	}
+	return p, nil
+}
+
+func (r FaultRule) String() string {
+	parts := []string{fmt.Sprintf("#%d dir=%s", r.Id, r.Direction)}
+	if r.Peer != "" {
+		parts = append(parts, "peer="+r.Peer)
+	}
+	if r.MsgType != "" {
+		parts = append(parts, "type="+r.MsgType)
+	}
+	if r.Drop > 0 {
+		parts = append(parts, fmt.Sprintf("drop=%g", r.Drop))
+	}
+	if r.Delay > 0 || r.Jitter > 0 {
+		parts = append(parts, fmt.Sprintf("delay=%s jitter=%s", r.Delay, r.Jitter))
+	}
+	if r.Duplicate > 0 {
+		parts = append(parts, fmt.Sprintf("dup=%g", r.Duplicate))
+	}
+	if r.Reorder > 0 {
+		parts = append(parts, fmt.Sprintf("reorder=%g", r.Reorder))
+	}
+	if r.After > 0 || r.For > 0 {
+		parts = append(parts, fmt.Sprintf("after=%s for=%s", r.After, r.For))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r FaultRule) active(now time.Time) bool {
+	start := r.AddedAt.Add(r.After)
+	if now.Before(start) {
+		return false
+	}
+	return r.For == 0 || now.Before(start.Add(r.For))
+}
+
+func (r FaultRule) matches(direction string, peer net.Addr, msgType string) bool {
+	if r.Direction != "both" && r.Direction != direction {
+		return false
+	}
+	if r.MsgType != "" && r.MsgType != msgType {
+		return false
+	}
+	if r.Peer != "" && peer != nil {
+		host, _, err := net.SplitHostPort(peer.String())
+		if err != nil {
+			host = peer.String()
+		}
+		if r.Peer != host && r.Peer != peer.String() {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	faultRules  []FaultRule
+	nextFaultId = 1
+	faultMutex  sync.Mutex
+)
+
+// adds a rule and returns its id, the schedule starts now
+func AddFaultRule(rule FaultRule) int {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	rule.Id = nextFaultId
+	rule.AddedAt = common.Now()
+	nextFaultId++
+	faultRules = append(faultRules, rule)
+	logger.Printf("Added fault rule %s\n", rule)
+	return rule.Id
+}
+
+func RemoveFaultRule(id int) bool {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	for i, rule := range faultRules {
+		if rule.Id == id {
+			faultRules = append(faultRules[:i], faultRules[i+1:]...)
+			logger.Printf("Removed fault rule %s\n", rule)
+			return true
+		}
+	}
+	return false
+}
+
+func ClearFaultRules() {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	faultRules = nil
+	logger.Printf("Cleared all fault rules\n")
+}
+
+func ListFaultRules() []FaultRule {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	return append([]FaultRule(nil), faultRules...)
+}
+
+func matchingRules(direction string, peer net.Addr, msgType string) []FaultRule {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	now := common.Now()
+	out := make([]FaultRule, 0)
+	for _, rule := range faultRules {
+		if rule.active(now) && rule.matches(direction, peer, msgType) {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+// only decodes the type of the message
+func peekType(data []byte) string {
+	var msg struct{ Type string }
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return ""
+	}
+	return msg.Type
+}
+
+// transport wrapper applying the fault rules
+type faultyTransport struct {
+	inner   Transport
+	pending sync.WaitGroup // delayed sends that haven't gone out yet
+}
+
+func NewFaultyTransport(inner Transport) Transport {
+	return &faultyTransport{inner: inner}
+}
+
+func (t *faultyTransport) WriteTo(p []byte, addr net.Addr) (int, error) {
+	rules := matchingRules("out", addr, peekType(p))
+	if len(rules) == 0 {
+		return t.inner.WriteTo(p, addr)
+	}
+
+	var delay time.Duration
+	copies := 1
+	for _, rule := range rules {
+		if randFloat64() < rule.Drop {
+			metricDrops.With("simulated").Inc()
+			logger.Printf("Fault rule #%d dropped outgoing message to %s\n", rule.Id, addr)
+			return len(p), nil // looks like a successful udp send
+		}
+		delay += rule.Delay
+		if rule.Jitter > 0 {
+			delay += time.Duration(randInt63n(int64(rule.Jitter)))
+		}
+		if randFloat64() < rule.Reorder {
+			// hold the message back long enough that later messages overtake it
+			delay += rule.Delay + rule.Jitter + time.Duration(randInt63n(int64(50*time.Millisecond)))
+		}
+		if randFloat64() < rule.Duplicate {
+			copies++
+		}
+	}
+
+	if delay == 0 {
+		for range copies {
+			if _, err := t.inner.WriteTo(p, addr); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+
+	// the caller may reuse p, so the delayed send gets its own copy
+	data := append([]byte(nil), p...)
+	t.pending.Add(1)
+	go func() {
+		defer t.pending.Done()
+		<-common.GetClock().After(delay)
+		for range copies {
+			t.inner.WriteTo(data, addr)
+		}
+	}()
+	return len(p), nil
+}
+
+func (t *faultyTransport) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := t.inner.ReadFrom(p)
+		if err != nil {
+			return n, from, err
+		}
+
+		dropped := false
+		for _, rule := range matchingRules("in", from, peekType(p[:n])) {
+			if randFloat64() < rule.Drop {
+				dropped = true
+				metricDrops.With("simulated").Inc()
+				logger.Printf("Fault rule #%d dropped incoming message from %s\n", rule.Id, from)
+				break
+			}
+		}
+		if !dropped {
+			return n, from, nil
+		}
+	}
+}
+
+func (t *faultyTransport) Close() error {
+	return t.inner.Close()
+}
+
+// waits until the delayed sends went out, or until ctx is done
+func (t *faultyTransport) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,250 @@
+package gossip
+
+import (
+	"cs425_g12/common"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseFaultRule(t *testing.T) {
+	tests := []struct {
+		spec string
+		want FaultRule
+	}{
+		{"drop=0.5", FaultRule{Direction: "both", Drop: 0.5}},
+		{"dir=out,peer=172.22.94.225,drop=1", FaultRule{Direction: "out", Peer: "172.22.94.225", Drop: 1}},
+		{"dir=in,peer=127.0.0.1:5051,type=ping", FaultRule{Direction: "in", Peer: "127.0.0.1:5051", MsgType: "ping"}},
+		{"delay=100ms,jitter=20ms", FaultRule{Direction: "both", Delay: 100 * time.Millisecond, Jitter: 20 * time.Millisecond}},
+		{"dup=0.1,reorder=0.2", FaultRule{Direction: "both", Duplicate: 0.1, Reorder: 0.2}},
+		{"drop=1,after=10s,for=30s", FaultRule{Direction: "both", Drop: 1, After: 10 * time.Second, For: 30 * time.Second}},
+		{",drop=0,", FaultRule{Direction: "both"}},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			rule, err := ParseFaultRule(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rule != test.want {
+				t.Errorf("rule = %+v, want %+v", rule, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFaultRuleErrors(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr string
+	}{
+		{"", "empty fault rule"},
+		{",,", "empty fault rule"},
+		{"drop", "expected key=value"},
+		{"drop=1,color=red", "unknown fault option \"color\""},
+		{"dir=up", "invalid direction"},
+		{"drop=1.5", "invalid value for drop"},
+		{"dup=-0.1", "invalid value for dup"},
+		{"reorder=often", "invalid value for reorder"},
+		{"delay=fast", "invalid value for delay"},
+		{"jitter=10", "invalid value for jitter"},
+		{"after=soon", "invalid value for after"},
+		{"for=ever", "invalid value for for"},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			_, err := ParseFaultRule(test.spec)
+			if err == nil {
+				t.Fatalf("parsed %q without an error", test.spec)
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %q, want it to contain %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// packet conn that records what is written and reads what the test queued, then reports
+// itself closed
+type fakePacketConn struct {
+	mutex    sync.Mutex
+	incoming []fakePacket
+	written  []fakePacket
+}
+
+type fakePacket struct {
+	data string
+	addr net.Addr
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.written = append(c.written, fakePacket{data: string(p), addr: addr})
+	return len(p), nil
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.incoming) == 0 {
+		return 0, nil, net.ErrClosed
+	}
+	packet := c.incoming[0]
+	c.incoming = c.incoming[1:]
+	return copy(p, packet.data), packet.addr, nil
+}
+
+func (c *fakePacketConn) writes() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.written)
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5051}
+}
+
+func (c *fakePacketConn) Close() error                       { return nil }
+func (c *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var _ net.PacketConn = (*fakePacketConn)(nil)
+
+// runs the test on a fake clock with no fault rules, both are reset afterwards
+func withFaultClock(t *testing.T) *common.FakeClock {
+	t.Helper()
+	clock := common.NewFakeClock(time.Unix(1000, 0))
+	previous := common.GetClock()
+	common.SetClock(clock)
+	ClearFaultRules()
+	t.Cleanup(func() {
+		ClearFaultRules()
+		common.SetClock(previous)
+	})
+	return clock
+}
+
+func TestFaultRuleMatching(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5051}
+	ping := `{"Type":"ping","Data":null}`
+	gossip := `{"Type":"gossip","Data":null}`
+	tests := []struct {
+		name          string
+		spec          string
+		direction     string // direction of the message, "in" or "out"
+		msg           string
+		wantDelivered bool
+	}{
+		{"out rule drops outgoing", "dir=out,drop=1", "out", ping, false},
+		{"out rule keeps incoming", "dir=out,drop=1", "in", ping, true},
+		{"in rule drops incoming", "dir=in,drop=1", "in", ping, false},
+		{"in rule keeps outgoing", "dir=in,drop=1", "out", ping, true},
+		{"both drops outgoing", "dir=both,drop=1", "out", ping, false},
+		{"both drops incoming", "drop=1", "in", ping, false},
+		{"matching ip", "peer=127.0.0.2,drop=1", "out", ping, false},
+		{"matching ip and port", "peer=127.0.0.2:5051,drop=1", "in", ping, false},
+		{"other ip", "peer=127.0.0.3,drop=1", "out", ping, true},
+		{"other port", "peer=127.0.0.2:5052,drop=1", "in", ping, true},
+		{"matching type", "type=ping,drop=1", "out", ping, false},
+		{"other type", "type=ping,drop=1", "in", gossip, true},
+		{"no drop", "dir=out,type=ping", "out", ping, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFaultClock(t)
+			rule, err := ParseFaultRule(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			AddFaultRule(rule)
+
+			conn := &fakePacketConn{}
+			transport := NewFaultyTransport(conn)
+			delivered := false
+			if test.direction == "out" {
+				if _, err := transport.WriteTo([]byte(test.msg), peer); err != nil {
+					t.Fatal(err)
+				}
+				delivered = conn.writes() == 1
+			} else {
+				conn.incoming = []fakePacket{{data: test.msg, addr: peer}}
+				buffer := make([]byte, 1024)
+				n, _, err := transport.ReadFrom(buffer)
+				if err == nil && string(buffer[:n]) != test.msg {
+					t.Fatalf("read %q, want %q", buffer[:n], test.msg)
+				}
+				delivered = err == nil
+			}
+			if delivered != test.wantDelivered {
+				t.Errorf("delivered = %v, want %v", delivered, test.wantDelivered)
+			}
+		})
+	}
+}
+
+func TestFaultRuleSchedule(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5051}
+	tests := []struct {
+		name     string
+		spec     string
+		at       time.Duration // time since the rule was added
+		wantDrop bool
+	}{
+		{"no schedule", "drop=1", 0, true},
+		{"before after", "drop=1,after=10s", 9 * time.Second, false},
+		{"at after", "drop=1,after=10s", 10 * time.Second, true},
+		{"inside for", "drop=1,for=30s", 29 * time.Second, true},
+		{"end of for", "drop=1,for=30s", 30 * time.Second, false},
+		{"inside after and for", "drop=1,after=10s,for=30s", 39 * time.Second, true},
+		{"past after and for", "drop=1,after=10s,for=30s", 40 * time.Second, false},
+		{"no end without for", "drop=1,after=10s", time.Hour, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := withFaultClock(t)
+			rule, err := ParseFaultRule(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			AddFaultRule(rule)
+			clock.Advance(test.at)
+
+			conn := &fakePacketConn{}
+			if _, err := NewFaultyTransport(conn).WriteTo([]byte(`{"Type":"ping"}`), peer); err != nil {
+				t.Fatal(err)
+			}
+			if dropped := conn.writes() == 0; dropped != test.wantDrop {
+				t.Errorf("dropped = %v, want %v", dropped, test.wantDrop)
+			}
+		})
+	}
+}
+
+func TestFaultRuleDelay(t *testing.T) {
+	clock := withFaultClock(t)
+	AddFaultRule(FaultRule{Direction: "out", Delay: 100 * time.Millisecond})
+
+	conn := &fakePacketConn{}
+	transport := NewFaultyTransport(conn).(*faultyTransport)
+	if _, err := transport.WriteTo([]byte(`{"Type":"ping"}`), &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5051}); err != nil {
+		t.Fatal(err)
+	}
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(99 * time.Millisecond)
+	if conn.writes() != 0 {
+		t.Fatal("delayed message sent before the delay")
+	}
+	clock.Advance(time.Millisecond)
+	if err := transport.drain(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if conn.writes() != 1 {
+		t.Fatalf("sent %d messages after the delay, want 1", conn.writes())
+	}
+}
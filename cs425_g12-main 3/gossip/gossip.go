@@ -1,11 +1,13 @@
 package gossip
 
 import (
+	"context"
 	"cs425_g12/common"
+	"cs425_g12/logging"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"sync/atomic"
@@ -29,36 +31,51 @@ var ip_addresses = []string{
 // port for udp communication
 const gossipPort = 5051
 
-var globalConn net.PacketConn
+var globalConn Transport
+
+var logger = logging.New("gossip")
 
 // varibles for measuring bandwidth
 var experimentBytesSent uint64
 var experimentBytesRecv uint64
 var IsExperimentRunning atomic.Bool
 
-func recordSend(size int) {
+func recordSend(msgType string, size int) {
+	metricMessagesSent.With(msgType).Inc()
+	metricBytesSent.Add(float64(size))
 	if IsExperimentRunning.Load() {
 		atomic.AddUint64(&experimentBytesSent, uint64(size))
 	}
 }
 
 func recordRecv(size int) {
+	metricBytesRecv.Add(float64(size))
 	if IsExperimentRunning.Load() {
 		atomic.AddUint64(&experimentBytesRecv, uint64(size))
 	}
 }
 
-func LogExperiments() {
+// logs the bandwidth every 2 minutes until ctx is cancelled, every experiment cancels its own ctx
+// so only one logger swaps the counters
+func LogExperiments(ctx context.Context) {
 	file, _ := os.OpenFile("experiment_bandwidth.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	defer file.Close()
 	logger := log.New(file, "", log.LstdFlags)
 
+	// bytes left over from an earlier experiment don't count
+	atomic.StoreUint64(&experimentBytesSent, 0)
+	atomic.StoreUint64(&experimentBytesRecv, 0)
+
 	// recording for every 2 mintues
-	ticker := time.NewTicker(2 * time.Minute)
+	ticker := common.GetClock().NewTicker(2 * time.Minute)
 	defer ticker.Stop()
 
-	for IsExperimentRunning.Load() {
-		<-ticker.C
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
 
 		sent := atomic.SwapUint64(&experimentBytesSent, 0)
 		recv := atomic.SwapUint64(&experimentBytesRecv, 0)
@@ -66,18 +83,19 @@ func LogExperiments() {
 		avgSentSec := float64(sent) / (2 * 60)
 		avgRecvSec := float64(recv) / (2 * 60)
 
-		logger.Printf("Bytes avg sent ==%.2f B/s, recv=%.2f B/s, total=%.2f B/s\n", avgSentSec, avgRecvSec, avgRecvSec+avgSentSec)
+		logger.Printf("mode=%s Bytes avg sent ==%.2f B/s, recv=%.2f B/s, total=%.2f B/s\n", common.GetRunningMode(), avgSentSec, avgRecvSec, avgRecvSec+avgSentSec)
 	}
 }
 
 // this is the info sent over to other machines
 type GossipInfo struct {
-	MemberSummary []common.Member  // this is the output of the getter GetEntireList, don't confuse this with the MembershipList struct which contains the mutex and a map of members
-	Sender        common.MachineId // this is to identify the sender, not sure if needed
+	MemberSummary []common.Member    // this is the output of the getter GetEntireList, don't confuse this with the MembershipList struct which contains the mutex and a map of members
+	Sender        common.MachineId   // this is to identify the sender, not sure if needed
+	Mode          common.ClusterMode // newest cluster mode the sender knows of
 }
 
 type MessageType struct {
-	Type string // "join", "gossip", "updatedList"
+	Type string // see handlers.go for the registered types, "updatedList" is only read by RequestJoin
 	Data json.RawMessage
 }
 
@@ -96,24 +114,25 @@ func SendGossip(list *common.MembershipList, Tgossip time.Duration) {
 	for {
 		currList := list.GetUniqueMembers()
 		if len(currList) == 0 {
-			common.Logger.Println("Membership list is empty, skipping gossip")
-			time.Sleep(Tgossip)
+			logger.Println("Membership list is empty, skipping gossip")
+			list.Clock().Sleep(Tgossip)
 			continue
 		}
-		target = currList[rand.Intn(len(currList))].MachineId.Ip
+		target = currList[randIntn(len(currList))].MachineId.Ip
 		if target != self.Ip {
 			//cannot choose self as target
 			break
 		}
 	}
 
-	common.Logger.Printf("Chose target %s for gossip\n", target)
+	logger.Printf("Chose target %s for gossip\n", target)
 
 	// get the entire list to send
 	currList := list.GetEntireList()
 	infoToSend := GossipInfo{
 		MemberSummary: currList,
 		Sender:        self,
+		Mode:          common.GetClusterMode(),
 	}
 
 	// wrap the gossip info in a MessageType
@@ -136,8 +155,8 @@ func SendGossip(list *common.MembershipList, Tgossip time.Duration) {
 		return
 	}
 
-	common.Logger.Printf("Data to be sent: %s\n", string(data))
-	recordSend(len(data))
+	logger.Printf("Data to be sent: %s\n", string(data))
+	recordSend("gossip", len(data))
 
 	// randomly chosen target with hardcoded port, not sure if single port is ok
 	addr := fmt.Sprintf("%s:%d", target, gossipPort)
@@ -149,147 +168,55 @@ func SendGossip(list *common.MembershipList, Tgossip time.Duration) {
 	}
 
 	// log this gossip event
-	common.Logger.Printf("Gossiped to %s with %d members\n", addr, len(currList))
+	logger.Printf("Gossiped to %s with %d members\n", addr, len(currList))
 }
 
-// listen for gossip
-func GossipListener(list *common.MembershipList, DropRate float64) {
+// listen for gossip. the receive loop only reads and queues datagrams, the workers handle them.
+// the workers stop when ctx is cancelled, the receive loop once Shutdown closes the socket
+func GossipListener(ctx context.Context, list *common.MembershipList, DropRate float64, config PipelineConfig) {
 	self := common.GetSelf()
 	addr := fmt.Sprintf("%s:%d", self.Ip, self.Port)
 
-	var err error
 	// udp listener setup
-	globalConn, err = net.ListenPacket("udp", addr)
+	conn, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		fmt.Println("Error setting up UDP listener: ", err)
 		return
 	}
+	globalConn = NewFaultyTransport(conn)
 
-	go func() {
-		// defer globalConn.Close()
-		buffer := make([]byte, 65535) // configured with random large size for now
+	// the drop rate from the command line is an inbound drop rule for every peer
+	if DropRate > 0 {
+		AddFaultRule(FaultRule{Direction: "in", Drop: DropRate})
+	}
 
-		for {
-			bytesRead, from, err := globalConn.ReadFrom(buffer)
+	startWorkers(ctx, list, config)
 
-			common.Logger.Printf("Received message from %s: %s\n", from.String(), string(buffer[:bytesRead]))
-			if rand.Float64() < DropRate {
-				common.Logger.Print("Dropping the message.")
-				continue
-			}
+	transport := globalConn
+	common.Go(func() {
+		buffer := make([]byte, 65535) // configured with random large size for now
 
+		for {
+			bytesRead, from, err := transport.ReadFrom(buffer)
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				fmt.Println("Error reading from UDP: ", err)
 				continue
 			}
-			recordRecv(bytesRead)
 
-			// decode the msg type
-			var msgType MessageType
-			err = json.Unmarshal(buffer[:bytesRead], &msgType)
-			if err != nil {
-				fmt.Println("Error unmarshaling message type: ", err)
-				continue
-			}
-			//join message
-			if msgType.Type == "join" {
-				var newMember common.Member
-				err = json.Unmarshal(msgType.Data, &newMember)
-				if err != nil {
-					fmt.Println("Error unmarshaling new member: ", err)
-					continue
-				}
-
-				// insert the new member into the membership list
-				list.Insert(newMember)
-				common.Logger.Printf("New member joined: %+v\n", newMember)
-
-				// send list back to new joiner
-				members := list.GetEntireList()
-				reply := MessageType{
-					Type: "updatedList",
-					Data: func() json.RawMessage {
-						data, err := json.Marshal(members)
-						if err != nil {
-							fmt.Println("Error marshaling member list: ", err)
-							return nil
-						}
-						return data
-					}(),
-				}
-				globalConn.WriteTo([]byte(func() string {
-					data, err := json.Marshal(reply)
-					if err != nil {
-						fmt.Println("Error marshaling reply: ", err)
-						return ""
-					}
-					recordSend(len(data))
-					return string(data)
-				}()), from)
-
-				// handling gossip message
-			} else if msgType.Type == "gossip" {
-				// unmarshal the Data field into receivedInfo
-				var receivedInfo GossipInfo
-				err = json.Unmarshal(msgType.Data, &receivedInfo)
-				if err != nil {
-					fmt.Println("Error unmarshaling gossip info: ", err)
-					continue
-				}
-
-				self = common.GetSelf()
-
-				// merging the incoming membership list into own
-				MergeGossip(list, receivedInfo.MemberSummary, self)
-
-				// common.Logger.Printf("Received gossip from %s with %d members\n", from.String(), len(receivedInfo.MemberSummary))
-				common.Logger.Printf("Received gossip from %s\n", receivedInfo.Sender)
-				for _, m := range receivedInfo.MemberSummary {
-					common.Logger.Printf("  %s\n", m)
-				}
-				// handling ping messages
-			} else if msgType.Type == "ping" {
-				var ping Ping
-				json.Unmarshal(msgType.Data, &ping)
-				// merging received membership list to own (piggpy back)
-				MergePingAck(list, ping.MemberSummary)
-
-				ack := Ack{
-					Sender:        self,
-					MemberSummary: list.GetEntireList(),
-				}
+			recordRecv(bytesRead)
 
-				reply := MessageType{Type: "ack", Data: helperMarshal(ack)}
-				out := helperMarshal(reply)
-				// send ack
-				globalConn.WriteTo(out, from)
-				recordSend(len(out))
-			} else if msgType.Type == "ack" {
-				var ack Ack
-				json.Unmarshal(msgType.Data, &ack)
-
-				// merging received membership list to own (piggpy back)
-				MergePingAck(list, ack.MemberSummary)
-
-				// merging logic should handle every change, don't need to explicitly modify anything
-				// if ackMachine := list.GetMember(ack.Sender); ackMachine != nil {
-				// ackMachine.SuspicionState = common.StateAlive
-				// ackMachine.TimeLocal = time.Now()
-				// shouldnt update from fail to alive
-				// } else {
-				//needs to rejoin - handle self failure
-				// }
-
-				ackMutex.Lock()
-				ackReceived = true
-				ackMutex.Unlock()
-			}
+			// the buffer is reused for the next read, so the queued message gets its own copy
+			raw := make([]byte, bytesRead)
+			copy(raw, buffer[:bytesRead])
+			enqueue(raw, from)
 		}
-	}()
+	})
 }
 
-// called by the main function during init when a new machine needs to be introduced to the group
-func RequestJoin(introducer common.MachineId, list *common.MembershipList) bool {
+func joinMessage() []byte {
 	self := common.GetSelf()
 	joinMember := common.NewMember(self)
 
@@ -306,6 +233,38 @@ func RequestJoin(introducer common.MachineId, list *common.MembershipList) bool
 		}(),
 	}
 
+	data, err := json.Marshal(msgType)
+	if err != nil {
+		fmt.Println("Error marshaling join message: ", err)
+		return nil
+	}
+	return data
+}
+
+func insertJoinedMembers(list *common.MembershipList, members []common.Member) {
+	for _, member := range members {
+		if member.SuspicionState != common.StateFailed {
+			// only inserting non failed members
+			list.Insert(member)
+		}
+	}
+	common.LogMemberEvent(logger, common.EventKeyJoin, common.GetSelf(), "source", "local", "members", len(members))
+}
+
+// sends a join over the listener socket without waiting, the answer is handled like any other
+// message. used by the simulator
+func SendJoin(introducer common.MachineId) {
+	data := joinMessage()
+	targetAddr := &net.UDPAddr{IP: net.ParseIP(introducer.Ip), Port: int(introducer.Port)}
+	if _, err := globalConn.WriteTo(data, targetAddr); err != nil {
+		fmt.Println("Error sending join request: ", err)
+		return
+	}
+	recordSend("join", len(data))
+}
+
+// called by the main function during init when a new machine needs to be introduced to the group
+func RequestJoin(introducer common.MachineId, list *common.MembershipList) bool {
 	addr := fmt.Sprintf("%s:%d", introducer.Ip, introducer.Port)
 
 	//dialing on the introducer
@@ -316,9 +275,8 @@ func RequestJoin(introducer common.MachineId, list *common.MembershipList) bool
 	}
 	defer conn.Close()
 
-	data, err := json.Marshal(msgType)
-	if err != nil {
-		fmt.Println("Error marshaling join message: ", err)
+	data := joinMessage()
+	if data == nil {
 		return false
 	}
 
@@ -327,7 +285,7 @@ func RequestJoin(introducer common.MachineId, list *common.MembershipList) bool
 		fmt.Println("Error sending join request: ", err)
 		return false
 	}
-	recordSend(len(data))
+	recordSend("join", len(data))
 
 	buffer := make([]byte, 65535)
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // wait for 5 seconds max, if not responds, introducer is prob dead
@@ -353,12 +311,7 @@ func RequestJoin(introducer common.MachineId, list *common.MembershipList) bool
 			return false
 		}
 
-		for _, member := range members {
-			if member.SuspicionState != common.StateFailed {
-				// only inserting non failed members
-				list.Insert(member)
-			}
-		}
+		insertJoinedMembers(list, members)
 
 		for _, m := range list.GetSortedRing() {
 			fmt.Printf("   Sorted Ring Member: %s\n", *m)
@@ -367,45 +320,8 @@ func RequestJoin(introducer common.MachineId, list *common.MembershipList) bool
 		fmt.Printf("    Predecessor: %s\n", list.FindPredecessor(list.GetMember(common.GetSelf()).RingId))
 		fmt.Printf("    Successor: %s\n", list.FindSuccessor(list.GetMember(common.GetSelf()).RingId))
 		fmt.Printf("    Two successors: %s\n", list.GetSuccessorNodes(list.GetMember(common.GetSelf()).RingId, 2))
-
-		common.Logger.Printf("Joined group, got %d members\n", len(members))
 		return true
 	}
 
 	return false
 }
-
-func handleSelfFailure(list *common.MembershipList) {
-
-	if !common.IsMemberInGroup {
-		// not a member of the group, no need to rejoin
-		return
-	}
-
-	// clear the entire membership list
-	self := common.GetSelf()
-
-	selfNewVersion := common.NewMachineId(self.Ip, self.Port, time.Now())
-
-	if (self.Ip == common.Introducer.Ip) && (self.Port == common.Introducer.Port) {
-		// no need to delete entire list
-		// inserting new self
-		list.Delete(self)
-		common.SetSelf(selfNewVersion)
-		list.Insert(common.NewMember(selfNewVersion))
-		common.Logger.Printf("I am the introducer.")
-	} else {
-		// delete entire list and request to rejoin
-		list.DeleteEntireList()
-		common.SetSelf(selfNewVersion)
-		RequestJoin(common.Introducer, list)
-		common.Logger.Printf("I am not the introducer. The introducer is: %+v", common.Introducer)
-	}
-
-	// common.SetSelf(selfNewVersion)
-
-	// RequestJoin(common.Introducer, list)
-
-	common.Logger.Printf("Handled self failure, new MachineId: %+v\n", selfNewVersion)
-
-}
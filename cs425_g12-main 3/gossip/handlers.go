@@ -0,0 +1,150 @@
+package gossip
+
+import (
+	"cs425_g12/common"
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// dispatch table for the built in message types, new message types register here too
+func init() {
+	RegisterHandler("join", handleJoin, false)
+	RegisterHandler("gossip", handleGossip, true)
+	RegisterHandler("ping", handlePing, false)
+	RegisterHandler("ack", handleAck, false)
+	RegisterHandler("alive", handleAlive, false)
+	RegisterHandler("reconnect", handleReconnectMessage, true)
+	RegisterHandler("reconnectAck", handleReconnectAckMessage, false)
+	RegisterHandler("mode", handleModeChange, false)
+	RegisterHandler("updatedList", handleUpdatedList, false)
+	RegisterHandler("leave", handleLeave, false)
+}
+
+// join message
+func handleJoin(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	if !common.IsMemberInGroup {
+		// we are out of the group ourselves, let the joiner try another seed
+		return nil
+	}
+	var newMember common.Member
+	if err := json.Unmarshal(data, &newMember); err != nil {
+		return fmt.Errorf("unmarshaling new member: %v", err)
+	}
+
+	// insert the new member into the membership list
+	list.Insert(newMember)
+	common.LogMemberEvent(logger, common.EventKeyJoin, newMember.MachineId, "source", "introducer")
+
+	// send list back to new joiner
+	reply := MessageType{Type: "updatedList", Data: helperMarshal(list.GetEntireList())}
+	out := helperMarshal(reply)
+	globalConn.WriteTo(out, from)
+	recordSend("updatedList", len(out))
+	return nil
+}
+
+// answer to a join sent over the listener socket (RequestJoin reads its answer itself)
+func handleUpdatedList(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var members []common.Member
+	if err := json.Unmarshal(data, &members); err != nil {
+		return fmt.Errorf("unmarshaling member list: %v", err)
+	}
+	insertJoinedMembers(list, members)
+	return nil
+}
+
+// gossip message
+func handleGossip(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var receivedInfo GossipInfo
+	if err := json.Unmarshal(data, &receivedInfo); err != nil {
+		return fmt.Errorf("unmarshaling gossip info: %v", err)
+	}
+
+	common.ObserveMode(receivedInfo.Mode, receivedInfo.Sender)
+	// merging the incoming membership list into own
+	mergeForMode(list, receivedInfo.MemberSummary, receivedInfo.Sender)
+	logger.Printf("Received gossip from %s with %d members\n", receivedInfo.Sender, len(receivedInfo.MemberSummary))
+	return nil
+}
+
+// ping message, merge and answer with an ack
+func handlePing(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var ping Ping
+	if err := json.Unmarshal(data, &ping); err != nil {
+		return fmt.Errorf("unmarshaling ping: %v", err)
+	}
+	common.ObserveMode(ping.Mode, ping.Sender)
+	// merging received membership list to own (piggpy back)
+	MergePingAck(list, ping.MemberSummary, ping.Sender)
+
+	ack := Ack{
+		Sender:        common.GetSelf(),
+		MemberSummary: list.GetEntireList(),
+		Mode:          common.GetClusterMode(),
+	}
+
+	reply := MessageType{Type: "ack", Data: helperMarshal(ack)}
+	out := helperMarshal(reply)
+	// send ack
+	globalConn.WriteTo(out, from)
+	recordSend("ack", len(out))
+	return nil
+}
+
+// ack message
+func handleAck(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var ack Ack
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return fmt.Errorf("unmarshaling ack: %v", err)
+	}
+
+	common.ObserveMode(ack.Mode, ack.Sender)
+	// merging received membership list to own (piggpy back)
+	// merging logic should handle every change, don't need to explicitly modify anything
+	MergePingAck(list, ack.MemberSummary, ack.Sender)
+
+	ackMutex.Lock()
+	ackReceived = true
+	ackReceivedAt = list.Clock().Now()
+	ackMutex.Unlock()
+	return nil
+}
+
+// refutation from a member we may have suspected or marked failed
+func handleAlive(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var alive Alive
+	if err := json.Unmarshal(data, &alive); err != nil {
+		return fmt.Errorf("unmarshaling alive message: %v", err)
+	}
+	mergeForMode(list, []common.Member{alive.Member}, alive.Sender)
+	return nil
+}
+
+func handleReconnectMessage(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var info GossipInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("unmarshaling reconnect info: %v", err)
+	}
+	handleReconnect(list, info, from)
+	return nil
+}
+
+func handleReconnectAckMessage(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var info GossipInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return fmt.Errorf("unmarshaling reconnect info: %v", err)
+	}
+	handleReconnectAck(list, info)
+	return nil
+}
+
+// cluster mode switch issued on another node
+func handleModeChange(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var change ModeChange
+	if err := json.Unmarshal(data, &change); err != nil {
+		return fmt.Errorf("unmarshaling mode change: %v", err)
+	}
+	common.ObserveMode(change.Mode, change.Sender)
+	return nil
+}
@@ -1,6 +1,7 @@
 package gossip
 
 import (
+	"context"
 	"cs425_g12/common"
 	"encoding/json"
 	"fmt"
@@ -17,25 +18,67 @@ func helperMarshal(v interface{}) json.RawMessage {
 	return data
 }
 
-// determines which protocol to run based on the protocol mode
-func StartProtocol(list *common.MembershipList, Tgossip time.Duration, Tping time.Duration, Tfail time.Duration) {
-	go func() {
+// merges a received list with the merge rules of the current protocol. hybrid uses the ping/ack
+// rules for everything so heartbeats and probes feed one suspicion pipeline with refutation
+func mergeForMode(list *common.MembershipList, received []common.Member, sender common.MachineId) {
+	if common.GetProtocolMode().UsesProbes() {
+		MergePingAck(list, received, sender)
+	} else {
+		recordAccusations(list, received, sender)
+		MergeGossip(list, received, common.GetSelf())
+	}
+}
+
+// every suspicious or failed entry in a received list is a vote of the sender for failing that
+// member, quorum damping counts them while a partition is suspected
+func recordAccusations(list *common.MembershipList, received []common.Member, sender common.MachineId) {
+	self := common.GetSelf()
+	if sender.Ip == self.Ip {
+		return
+	}
+	for _, member := range received {
+		if member.SuspicionState == common.StateAlive || member.MachineId.Ip == sender.Ip || member.MachineId.Ip == self.Ip || leftGroup(member) {
+			continue
+		}
+		current := list.GetMember(member.MachineId)
+		if current == nil || member.IncarnationNumber < current.IncarnationNumber {
+			continue // refuted since
+		}
+		list.RecordAccusation(member.MachineId, sender)
+	}
+}
+
+// runs heartbeat gossip and direct probing based on the protocol mode, each on its own period.
+// in hybrid mode both loops are active. both stop when ctx is cancelled
+func StartProtocol(ctx context.Context, list *common.MembershipList, Tgossip time.Duration, Tping time.Duration, Tfail time.Duration) {
+	// heartbeat gossip loop
+	common.Go(func() {
 		for {
-			if common.IsMemberInGroup && common.GetProtocolMode() {
-				common.Logger.Println("Running in pingack mode")
-				StartPinging(list, Tfail)
-				// sleeping to avoid infite loop
-				time.Sleep(Tping)
-			} else if common.IsMemberInGroup && !common.GetProtocolMode() {
-				common.Logger.Println("Running in gossip mode")
+			if common.IsMemberInGroup && common.GetProtocolMode().UsesGossip() {
+				logger.Printf("Running in %s mode, gossiping\n", common.GetProtocolMode())
 				SendGossip(list, Tgossip)
-				// sleeping to avoid infite loop
-				time.Sleep(Tgossip)
-			} else {
-				// sleeping to avoid infite loop
-				time.Sleep(Tgossip)
-				continue
+			}
+			// sleeping to avoid infite loop
+			if !common.SleepContext(ctx, list.Clock(), Tgossip) {
+				return
+			}
+		}
+	})
+
+	// probing loop
+	common.Go(func() {
+		for {
+			// mode switches only take effect between probes, never while a probe is waiting for its ack
+			list.ApplyPendingMode()
+
+			if common.IsMemberInGroup && common.GetProtocolMode().UsesProbes() {
+				logger.Printf("Running in %s mode, probing\n", common.GetProtocolMode())
+				StartPinging(list, Tfail)
+			}
+			// sleeping to avoid infite loop
+			if !common.SleepContext(ctx, list.Clock(), Tping) {
+				return
 			}
 		}
-	}()
+	})
 }
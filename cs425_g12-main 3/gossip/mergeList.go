@@ -3,13 +3,18 @@ package gossip
 import (
 	"cs425_g12/common"
 	"fmt"
-	"time"
+	"sync"
 )
 
+// merges update the members in place, with several listener workers only one may run at a time
+var mergeMutex sync.Mutex
+
 func MergeGossip(list *common.MembershipList, receivedGossip []common.Member, self common.MachineId) {
-	common.Logger.Printf("Merge function entered! Received gossip: %+v\n", receivedGossip)
+	mergeMutex.Lock()
+	defer mergeMutex.Unlock()
+	logger.Printf("Merge function entered! Received %d members\n", len(receivedGossip))
 
-	now := time.Now()
+	now := list.Clock().Now()
 
 	for _, receivedMember := range receivedGossip {
 		currentListMember := list.GetMember(receivedMember.MachineId)
@@ -19,22 +24,32 @@ func MergeGossip(list *common.MembershipList, receivedGossip []common.Member, se
 			if receivedMember.SuspicionState != common.StateFailed {
 				receivedMember.TimeLocal = now
 				list.Insert(receivedMember)
-				common.Logger.Printf("Added new member: %+v\n", receivedMember)
+				list.ReportRecovered(receivedMember.MachineId)
+				logger.Printf("Added new member: %+v\n", receivedMember)
 			}
 			continue
 		}
 
 		if receivedMember.SuspicionState == common.StateFailed {
 			// failure overrides everything
-			if currentListMember.SuspicionState != common.StateFailed {
-				fmt.Printf("[%s] Member %+v marked as Failed (from gossip)\n", time.Now().Format("15:04:05.000"), currentListMember.MachineId)
-				common.Logger.Printf("DropSearch First notification of failure for member: %+v\n", currentListMember)
+			if currentListMember.SuspicionState != common.StateFailed && leftGroup(receivedMember) {
+				fmt.Printf("[%s] Member %+v marked as Failed (left the group)\n", common.Now().Format("15:04:05.000"), currentListMember.MachineId)
+				currentListMember.FailedBy = receivedMember.FailedBy
+			} else if currentListMember.SuspicionState != common.StateFailed {
+				fmt.Printf("[%s] Member %+v marked as Failed (from gossip)\n", common.Now().Format("15:04:05.000"), currentListMember.MachineId)
+				common.LogMemberEvent(logger, common.EventKeyFail, currentListMember.MachineId, "source", "gossip", "incarnation", receivedMember.IncarnationNumber)
+				if currentListMember.MachineId != self {
+					list.ReportFailure(currentListMember.MachineId)
+					common.MetricFailuresDeclared.With("gossip").Inc()
+					common.RecordDetection(currentListMember.MachineId, common.StateFailed, "gossip", now)
+				}
+				currentListMember.FailedBy = receivedMember.FailedBy
 			}
 			currentListMember.HeartbeatCounter = receivedMember.HeartbeatCounter
 			currentListMember.SuspicionState = common.StateFailed
 			currentListMember.IncarnationNumber = receivedMember.IncarnationNumber
 			// log this update
-			common.Logger.Printf("Updated member to Failed state: %+v\n", currentListMember)
+			logger.Printf("Updated member to Failed state: %+v\n", currentListMember)
 			if currentListMember.MachineId == self {
 				// handle failure
 				handleSelfFailure(list)
@@ -48,10 +63,14 @@ func MergeGossip(list *common.MembershipList, receivedGossip []common.Member, se
 
 		// higher inc number always takes priority
 		if receivedMember.IncarnationNumber > currentListMember.IncarnationNumber {
+			if currentListMember.SuspicionState == common.StateSuspicious && receivedMember.SuspicionState == common.StateAlive {
+				common.MetricFalsePositives.With("suspicious").Inc()
+			}
 			*currentListMember = receivedMember
 			currentListMember.TimeLocal = now
+			list.ReportRecovered(receivedMember.MachineId)
 			// log this update
-			common.Logger.Printf("Updated member due to higher incarnation number: %+v\n", currentListMember)
+			logger.Printf("Updated member due to higher incarnation number: %+v\n", currentListMember)
 			continue
 		}
 
@@ -63,31 +82,33 @@ func MergeGossip(list *common.MembershipList, receivedGossip []common.Member, se
 					currentListMember.IncarnationNumber++
 					currentListMember.TimeLocal = now
 					currentListMember.SuspicionState = common.StateAlive
-					common.Logger.Printf("Received gossip marking self as suspicious, incremented incarnation number: %+v\n", currentListMember)
+					common.MetricRefutations.Inc()
+					common.LogMemberEvent(logger, common.EventKeyRefute, currentListMember.MachineId, "source", "gossip", "incarnation", currentListMember.IncarnationNumber)
 					continue
 				}
 			} else {
 				// always check heartbeat first if same incarnation number
 				if receivedMember.HeartbeatCounter > currentListMember.HeartbeatCounter {
 					// received definitely has more recent info, update it
+					if currentListMember.SuspicionState == common.StateSuspicious && receivedMember.SuspicionState == common.StateAlive {
+						common.MetricFalsePositives.With("suspicious").Inc()
+					} else if currentListMember.SuspicionState == common.StateAlive && receivedMember.SuspicionState == common.StateSuspicious {
+						common.RecordDetection(currentListMember.MachineId, common.StateSuspicious, "gossip", now)
+					}
 					currentListMember.HeartbeatCounter = receivedMember.HeartbeatCounter
 					currentListMember.TimeLocal = now
 					currentListMember.SuspicionState = receivedMember.SuspicionState
-					common.Logger.Printf("Updated member due to higher heartbeat: %+v\n", currentListMember)
+					logger.Printf("Updated member due to higher heartbeat: %+v\n", currentListMember)
 				} else if receivedMember.HeartbeatCounter == currentListMember.HeartbeatCounter {
 					// same heartbeat, so sus takes priority over alive
 					if receivedMember.SuspicionState == common.StateSuspicious && currentListMember.SuspicionState == common.StateAlive {
 						currentListMember.SuspicionState = common.StateSuspicious
 						currentListMember.TimeLocal = now
-						common.Logger.Printf("Updated member to Suspicious due to same heartbeat but received is suspicious: %+v\n", currentListMember)
+						common.RecordDetection(currentListMember.MachineId, common.StateSuspicious, "gossip", now)
+						common.LogMemberEvent(logger, common.EventKeySuspect, currentListMember.MachineId, "source", "gossip", "incarnation", currentListMember.IncarnationNumber)
 					} // else do nothing, either both are sus or current is sus
 				} // else received hearbeat < current heartbeat, ignore that
 			}
 		}
 	}
-
-	common.Logger.Printf("Membership list after merging gossip:")
-	for _, member := range list.GetEntireList() {
-		common.Logger.Printf("  %s\n", member)
-	}
 }
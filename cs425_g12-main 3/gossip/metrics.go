@@ -0,0 +1,30 @@
+package gossip
+
+import (
+	"cs425_g12/metrics"
+	"time"
+)
+
+// message level metrics, the detector level ones are in common/metrics.go
+var (
+	metricMessagesSent = metrics.NewCounterVec("fd_messages_sent_total", "Messages sent by type.", "type")
+	metricMessagesRecv = metrics.NewCounterVec("fd_messages_received_total", "Messages received by type.", "type")
+	metricBytesSent    = metrics.NewCounter("fd_bytes_sent_total", "Bytes sent over UDP.")
+	metricBytesRecv    = metrics.NewCounter("fd_bytes_received_total", "Bytes received over UDP.")
+	metricDrops        = metrics.NewCounterVec("fd_messages_dropped_total", "Received messages that were dropped, by reason (simulated, decode, unknown_type, overload).", "reason")
+	metricProbes       = metrics.NewCounterVec("fd_probes_total", "Direct probes sent in ping/ack mode, by result (ack, timeout).", "result")
+	metricAckRTT       = metrics.NewHistogram("fd_ack_rtt_seconds", "Time between sending a ping and receiving its ack.", metrics.DefaultBuckets)
+)
+
+func init() {
+	metrics.NewGaugeFunc("fd_queue_depth", "Messages waiting in the listener queues.", "queue", func() map[string]float64 {
+		return map[string]float64{
+			"droppable": float64(len(queue)),
+			"priority":  float64(len(priorityQueue)),
+		}
+	})
+}
+
+func observeAckRTT(rtt time.Duration) {
+	metricAckRTT.Observe(rtt.Seconds())
+}
@@ -0,0 +1,34 @@
+package gossip
+
+import (
+	"cs425_g12/common"
+	"fmt"
+	"net"
+)
+
+// mode messages data
+type ModeChange struct {
+	Sender common.MachineId
+	Mode   common.ClusterMode
+}
+
+// switches the whole cluster: the new mode gets a higher epoch, is sent to every member right away
+// and keeps being piggybacked on gossip, pings and acks until everyone runs it
+func SwitchClusterMode(list *common.MembershipList, protocol common.ProtocolMode, suspicion bool) common.ClusterMode {
+	mode := common.ProposeMode(protocol, suspicion)
+	self := common.GetSelf()
+
+	data := helperMarshal(MessageType{Type: "mode", Data: helperMarshal(ModeChange{Sender: self, Mode: mode})})
+	for _, member := range list.GetUniqueMembers() {
+		if member.MachineId.Ip == self.Ip || member.SuspicionState == common.StateFailed {
+			continue
+		}
+		targetAddr := &net.UDPAddr{IP: net.ParseIP(member.MachineId.Ip), Port: int(member.MachineId.Port)}
+		if _, err := globalConn.WriteTo(data, targetAddr); err != nil {
+			fmt.Println("error sending mode change: ", err)
+			continue
+		}
+		recordSend("mode", len(data))
+	}
+	return mode
+}
@@ -0,0 +1,74 @@
+package gossip
+
+import (
+	"cs425_g12/common"
+	"time"
+)
+
+// per node state of the gossip package, see common.NodeState. the simulator activates both
+// before every step of a node
+
+type NodeState struct {
+	conn               Transport
+	ackReceived        bool
+	ackReceivedAt      time.Time
+	pingSentAt         time.Time
+	selfFailureReports map[common.MachineId]time.Time
+	pendingAlive       int
+	declaredDead       int64
+	rejoined           int64
+}
+
+func NewNodeState(conn Transport) *NodeState {
+	return &NodeState{conn: conn, selfFailureReports: make(map[common.MachineId]time.Time)}
+}
+
+var activeNode *NodeState
+
+// saves the globals into the state of the active node and loads this node's state
+func (state *NodeState) Activate() {
+	if activeNode == state {
+		return
+	}
+	if activeNode != nil {
+		activeNode.save()
+	}
+	state.load()
+	activeNode = state
+}
+
+func (state *NodeState) save() {
+	state.conn = globalConn
+
+	ackMutex.Lock()
+	state.ackReceived = ackReceived
+	state.ackReceivedAt = ackReceivedAt
+	state.pingSentAt = pingSentAt
+	ackMutex.Unlock()
+
+	refuteMutex.Lock()
+	state.selfFailureReports = selfFailureReports
+	state.pendingAlive = pendingAlive
+	refuteMutex.Unlock()
+
+	state.declaredDead = declaredDeadCount.Load()
+	state.rejoined = rejoinCount.Load()
+}
+
+func (state *NodeState) load() {
+	globalConn = state.conn
+
+	ackMutex.Lock()
+	ackReceived = state.ackReceived
+	ackReceivedAt = state.ackReceivedAt
+	pingSentAt = state.pingSentAt
+	ackMutex.Unlock()
+
+	refuteMutex.Lock()
+	selfFailureReports = state.selfFailureReports
+	pendingAlive = state.pendingAlive
+	refuteMutex.Unlock()
+
+	declaredDeadCount.Store(state.declaredDead)
+	rejoinCount.Store(state.rejoined)
+}
@@ -4,7 +4,6 @@ import (
 	"cs425_g12/common"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -14,47 +13,94 @@ import (
 type Ping struct {
 	Sender        common.MachineId
 	MemberSummary []common.Member
+	Mode          common.ClusterMode
 }
 
 // ack messages data
 type Ack struct {
 	Sender        common.MachineId
 	MemberSummary []common.Member
+	Mode          common.ClusterMode
 }
 
 // tracker for if ack has been received
 var (
-	ackReceived bool
-	ackMutex    sync.Mutex
+	ackReceived   bool
+	ackReceivedAt time.Time // used for the ack rtt
+	pingSentAt    time.Time
+	ackMutex      sync.Mutex
 )
 
 func StartPinging(list *common.MembershipList, Tfail time.Duration) {
+	target, ok := prepareProbe(list)
+	if !ok {
+		return
+	}
+	// handling ping and waiting for ack with a time out
+	PingAndWait(target, list, Tfail)
+}
 
-	list.IncrementHeartbeat()
+// heartbeat, pending refutations and the choice of the probe target
+func prepareProbe(list *common.MembershipList) (common.MachineId, bool) {
+	if !common.GetProtocolMode().UsesGossip() {
+		// in hybrid mode the gossip loop already increments the heartbeat
+		list.IncrementHeartbeat()
+	}
+
+	// a pending refutation goes out before the regular probe
+	disseminatePendingAlive(list)
 
 	self := common.GetSelf()
 	members := list.GetUniqueMembers()
 
 	if len(members) == 1 && members[0].MachineId.Ip == self.Ip {
-		return // only self in the list, skip the pinging
+		return common.MachineId{}, false // only self in the list, skip the pinging
 	}
 
 	var target common.MachineId
 
 	for {
 		//only choosing non self target
-		chosen := members[rand.Intn(len(members))]
+		chosen := members[randIntn(len(members))]
 		if chosen.MachineId.Ip != self.Ip {
 			target = chosen.MachineId
 			break
 		}
 	}
-
-	// handling ping and waiting for ack with a time out
-	PingAndWait(target, list, Tfail)
+	return target, true
 }
 
 func PingAndWait(target common.MachineId, list *common.MembershipList, Tfail time.Duration) {
+	sendPing(target, list)
+
+	// set ack receive timeout
+	clock := list.Clock()
+	ackTimeout := clock.Now().Add(Tfail)
+
+	// wait till ack as long as before timeout
+	for clock.Now().Before(ackTimeout) {
+		clock.Sleep(5 * time.Millisecond)
+		if ProbeAcked(target) {
+			// ack received, no need to handle further
+			return
+		}
+	}
+
+	// havent received ack and timer has expired
+	ProbeTimedOut(target, list)
+}
+
+// one probe without waiting for the ack, for the simulator which delivers the ack and checks
+// the timeout itself. returns false if there was no one to probe
+func SendProbe(list *common.MembershipList) (common.MachineId, bool) {
+	target, ok := prepareProbe(list)
+	if ok {
+		sendPing(target, list)
+	}
+	return target, ok
+}
+
+func sendPing(target common.MachineId, list *common.MembershipList) {
 	self := common.GetSelf()
 
 	// ack tracker reset to false
@@ -65,13 +111,14 @@ func PingAndWait(target common.MachineId, list *common.MembershipList, Tfail tim
 	ping := Ping{
 		Sender:        self,
 		MemberSummary: list.GetEntireList(),
+		Mode:          common.GetClusterMode(),
 	}
 
 	pingMessage := MessageType{Type: "ping", Data: helperMarshal(ping)}
 
 	data, _ := json.Marshal(pingMessage)
 
-	common.Logger.Printf("data to be sent: %s\n", string(data))
+	logger.Printf("data to be sent: %s\n", string(data))
 
 	addr := fmt.Sprintf("%s:%d", target.Ip, target.Port)
 
@@ -81,132 +128,171 @@ func PingAndWait(target common.MachineId, list *common.MembershipList, Tfail tim
 	if err != nil {
 		fmt.Println("error sending ping: ", err)
 	}
-	recordSend(len(data))
-
-	common.Logger.Printf("sent ping to %s with %d members piggbacked ", addr, len(ping.MemberSummary))
-	// recordSend()
-	// set ack receive timeout
-	ackTimeout := time.Now().Add(Tfail)
+	ackMutex.Lock()
+	pingSentAt = list.Clock().Now()
+	ackMutex.Unlock()
+	recordSend("ping", len(data))
 
-	// wait till ack as long as before timeout
-	for time.Now().Before(ackTimeout) {
-		time.Sleep(5 * time.Millisecond)
+	logger.Printf("sent ping to %s with %d members piggbacked ", addr, len(ping.MemberSummary))
+}
 
-		ackMutex.Lock()
-		if ackReceived {
-			ackMutex.Unlock()
-			common.Logger.Printf("Ack received from %s", target)
-			// ack received, no need to handle further
-			return
-		}
+// true once the ack for the last ping arrived, records the rtt
+func ProbeAcked(target common.MachineId) bool {
+	ackMutex.Lock()
+	if !ackReceived {
 		ackMutex.Unlock()
+		return false
 	}
+	rtt := ackReceivedAt.Sub(pingSentAt)
+	ackMutex.Unlock()
 
-	// havent received ack and timer has expired
-	// common.Logger.Printf("Have not received ack. Marking machine %s as failed.", target)
-	// if failedTargetEntry := list.GetMember(target); failedTargetEntry != nil {
-	// 	failedTargetEntry.SuspicionState = common.StateFailed
-	// }
+	metricProbes.With("ack").Inc()
+	observeAckRTT(rtt)
+	logger.Printf("Ack received from %s", target)
+	return true
+}
 
-	// target did not respond marking as failed or sus based on mode
+// target did not ack in time, marking it as failed or sus based on mode
+func ProbeTimedOut(target common.MachineId, list *common.MembershipList) {
+	metricProbes.With("timeout").Inc()
 	if failedTargetEntry := list.GetMember((target)); failedTargetEntry != nil {
 		if common.GetSuspicionMode() {
 			if failedTargetEntry.SuspicionState == common.StateAlive {
 				failedTargetEntry.SuspicionState = common.StateSuspicious
+				common.MetricSuspicions.Inc()
+				common.RecordDetection(target, common.StateSuspicious, "local", list.Clock().Now())
 				fmt.Printf("Marked %s as suspicious (no ack)", target)
-				common.Logger.Printf("Marked %s as suspicious (no ack)", target)
+				common.LogMemberEvent(logger, common.EventKeySuspect, target, "source", "local", "reason", "no ack")
+			}
+		} else if list.FailureDamped(target) {
+			// partition suspected and no quorum agrees yet, only suspect the target instead of failing it
+			if failedTargetEntry.SuspicionState == common.StateAlive {
+				failedTargetEntry.SuspicionState = common.StateSuspicious
+				common.MetricSuspicions.Inc()
+				common.RecordDetection(target, common.StateSuspicious, "local", list.Clock().Now())
+				common.LogMemberEvent(logger, common.EventKeySuspect, target, "source", "local", "reason", "no ack, no quorum while a partition is suspected")
 			}
 		} else {
-			fmt.Printf("[%s] Member %+v marked as Failed (from gossip)\n", time.Now().Format("15:04:05.000"), failedTargetEntry.MachineId)
+			fmt.Printf("[%s] Member %+v marked as Failed (from gossip)\n", common.Now().Format("15:04:05.000"), failedTargetEntry.MachineId)
 			failedTargetEntry.SuspicionState = common.StateFailed
-			common.Logger.Printf("DropSearch Have not received ack. Marking machine %s as failed.", target)
+			failedTargetEntry.FailedBy = common.GetSelf()
+			common.LogMemberEvent(logger, common.EventKeyFail, target, "source", "local", "reason", "no ack")
+			list.ReportFailure(target)
+			common.MetricFailuresDeclared.With("local").Inc()
+			common.RecordDetection(target, common.StateFailed, "local", list.Clock().Now())
 		}
 	}
 }
 
-func MergePingAck(list *common.MembershipList, received []common.Member) {
-	common.Logger.Printf("Merge Ping Ack function entered. Received gossip: %+v\n", received)
+func MergePingAck(list *common.MembershipList, received []common.Member, sender common.MachineId) {
+	mergeMutex.Lock()
+	defer mergeMutex.Unlock()
+	logger.Printf("Merge Ping Ack function entered. Received %d members from %s\n", len(received), sender)
 	self := common.GetSelf()
+	recordAccusations(list, received, sender)
 
-	now := time.Now()
+	now := list.Clock().Now()
 
 	// merging the received with current
 	for _, receivedMember := range received {
 		currentListMember := list.GetMember(receivedMember.MachineId)
 
-
 		if currentListMember == nil {
 			// new member because current does not have it
 			if receivedMember.SuspicionState != common.StateFailed {
-				// insert if not failed 
+				// insert if not failed
 				receivedMember.TimeLocal = now
 				list.Insert(receivedMember)
-				common.Logger.Printf("Added new member: %+v\n", receivedMember)
+				list.ReportRecovered(receivedMember.MachineId)
+				logger.Printf("Added new member: %+v\n", receivedMember)
+			}
+			continue
+		}
+
+		if currentListMember.MachineId == self {
+			// entries about ourselves are never taken over, we only refute them
+			if receivedMember.IncarnationNumber < currentListMember.IncarnationNumber {
+				continue // we already refuted this one
+			}
+			if receivedMember.SuspicionState == common.StateFailed {
+				// only the member that declared us failed counts as a reporter, not the ones relaying it
+				if receivedMember.FailedBy == sender && reportSelfFailure(list, sender) {
+					// a quorum declared us failed, give up this identity and rejoin
+					common.LogMemberEvent(logger, common.EventKeyFail, currentListMember.MachineId, "source", "pingack", "reason", "self declared failed by a quorum")
+					currentListMember.SuspicionState = common.StateFailed
+					handleSelfFailure(list)
+				} else {
+					refuteSelf(list, receivedMember.IncarnationNumber)
+				}
+			} else if receivedMember.SuspicionState == common.StateSuspicious {
+				// some other machine suspects us, but we know we are alive
+				refuteSelf(list, receivedMember.IncarnationNumber)
 			}
 			continue
 		}
 
 		if receivedMember.SuspicionState == common.StateFailed {
+			if receivedMember.IncarnationNumber < currentListMember.IncarnationNumber {
+				continue // the member already refuted this failure
+			}
 			// failure overrides everything
-			if currentListMember.SuspicionState != common.StateFailed {
-				fmt.Printf("[%s] Member %+v marked as Failed (from pingack)\n", time.Now().Format("15:04:05.000"), currentListMember.MachineId)
-				common.Logger.Printf("DropSearch First notification of failure for member: %+v\n", currentListMember)
+			if currentListMember.SuspicionState != common.StateFailed && leftGroup(receivedMember) {
+				fmt.Printf("[%s] Member %+v marked as Failed (left the group)\n", common.Now().Format("15:04:05.000"), currentListMember.MachineId)
+				currentListMember.FailedBy = receivedMember.FailedBy
+			} else if currentListMember.SuspicionState != common.StateFailed {
+				fmt.Printf("[%s] Member %+v marked as Failed (from pingack)\n", common.Now().Format("15:04:05.000"), currentListMember.MachineId)
+				common.LogMemberEvent(logger, common.EventKeyFail, currentListMember.MachineId, "source", "pingack", "incarnation", receivedMember.IncarnationNumber)
+				list.ReportFailure(currentListMember.MachineId)
+				common.MetricFailuresDeclared.With("pingack").Inc()
+				common.RecordDetection(currentListMember.MachineId, common.StateFailed, "pingack", now)
+				currentListMember.FailedBy = receivedMember.FailedBy
 			}
 			// updating everything except the time
 			currentListMember.HeartbeatCounter = receivedMember.HeartbeatCounter
 			currentListMember.SuspicionState = common.StateFailed
 			currentListMember.IncarnationNumber = receivedMember.IncarnationNumber
-			common.Logger.Printf("Updated member to Failed state: %+v\n", currentListMember)
-			if currentListMember.MachineId == self {
-				// handle failure
-				handleSelfFailure(list)
-			}
+			logger.Printf("Updated member to Failed state: %+v\n", currentListMember)
 			continue
 		}
 
 		if currentListMember.SuspicionState == common.StateFailed {
-			continue // do nothing, we have the newest info
+			if receivedMember.SuspicionState == common.StateAlive && receivedMember.IncarnationNumber > currentListMember.IncarnationNumber {
+				// only the member itself bumps its incarnation, so this is a refutation of the failure
+				common.MetricFalsePositives.With("failed").Inc()
+				*currentListMember = receivedMember
+				currentListMember.TimeLocal = now
+				list.ReportRecovered(receivedMember.MachineId)
+				fmt.Printf("[%s] Member %+v refuted its failure\n", common.Now().Format("15:04:05.000"), currentListMember.MachineId)
+				common.LogMemberEvent(logger, common.EventKeyRefute, currentListMember.MachineId, "source", "pingack", "incarnation", currentListMember.IncarnationNumber)
+			}
+			continue // otherwise do nothing, we have the newest info
 		}
 
 		// higher inc number always takes priority
 		if receivedMember.IncarnationNumber > currentListMember.IncarnationNumber {
+			if currentListMember.SuspicionState == common.StateSuspicious && receivedMember.SuspicionState == common.StateAlive {
+				common.MetricFalsePositives.With("suspicious").Inc()
+			}
 			*currentListMember = receivedMember
 			currentListMember.TimeLocal = now
+			list.ReportRecovered(receivedMember.MachineId)
 			// log this update
-			common.Logger.Printf("Updated member due to higher incarnation number: %+v\n", currentListMember)
+			logger.Printf("Updated member due to higher incarnation number: %+v\n", currentListMember)
 			continue
 		}
 
 		if receivedMember.IncarnationNumber == currentListMember.IncarnationNumber {
-			if currentListMember.MachineId == self {
-				if receivedMember.SuspicionState == common.StateSuspicious && currentListMember.SuspicionState == common.StateAlive {
-					// some other machine suspects us, but we know we are alive
-					currentListMember.IncarnationNumber++
+			// this means both are alive
+			if receivedMember.SuspicionState == common.StateAlive && currentListMember.SuspicionState == common.StateAlive {
+				// take the higher heartbeat
+				logger.Println("Both are alive!")
+				if receivedMember.HeartbeatCounter > currentListMember.HeartbeatCounter {
+					currentListMember.HeartbeatCounter = receivedMember.HeartbeatCounter
 					currentListMember.TimeLocal = now
-					currentListMember.SuspicionState = common.StateAlive
-					common.Logger.Printf("Received gossip marking self as suspicious, incremented incarnation number: %+v\n", currentListMember)
-					continue
-				}
-			} else {
-				// this means both are alive
-				if receivedMember.SuspicionState == common.StateAlive && currentListMember.SuspicionState == common.StateAlive {
-					// take the higher heartbeat
-					// dont know what to do abt inc # just yet, figure that out later
-					common.Logger.Println("Both are alive!")
-					if receivedMember.HeartbeatCounter > currentListMember.HeartbeatCounter {
-						currentListMember.HeartbeatCounter = receivedMember.HeartbeatCounter
-						currentListMember.TimeLocal = now
-						common.Logger.Printf("Updated member due to higher heartbeat: %+v\n", currentListMember)
-					}
-					continue
+					logger.Printf("Updated member due to higher heartbeat: %+v\n", currentListMember)
 				}
-
+				continue
 			}
 		}
 	}
-
-	common.Logger.Printf("Membership list after merging gossip:")
-	for _, member := range list.GetEntireList() {
-		common.Logger.Printf("  %s\n", member)
-	}
 }
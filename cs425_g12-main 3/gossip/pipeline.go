@@ -0,0 +1,209 @@
+package gossip
+
+import (
+	"context"
+	"cs425_g12/common"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// the listener only reads datagrams and decodes the message type, everything else happens on
+// worker goroutines so a burst of traffic doesn't back up the socket buffer
+
+// handles the Data of one message type
+type MessageHandler func(list *common.MembershipList, data json.RawMessage, from net.Addr) error
+
+type handlerEntry struct {
+	handler   MessageHandler
+	droppable bool // can be dropped when the queue is full
+}
+
+var (
+	handlers      = make(map[string]handlerEntry)
+	handlersMutex sync.RWMutex
+)
+
+// registers the handler for a message type. droppable messages (like gossip, which is resent
+// every round anyway) go to a queue that drops the oldest entry on overload, everything else
+// goes to the priority queue, which is never dropped from
+func RegisterHandler(msgType string, handler MessageHandler, droppable bool) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	handlers[msgType] = handlerEntry{handler: handler, droppable: droppable}
+}
+
+func getHandler(msgType string) (handlerEntry, bool) {
+	handlersMutex.RLock()
+	defer handlersMutex.RUnlock()
+	entry, ok := handlers[msgType]
+	return entry, ok
+}
+
+// config for the worker queues
+type PipelineConfig struct {
+	QueueSize int // size of each queue
+	Workers   int // number of worker goroutines
+}
+
+var DefaultPipelineConfig = PipelineConfig{
+	QueueSize: 1024,
+	Workers:   2,
+}
+
+// one received message waiting to be handled
+type datagram struct {
+	msg  MessageType
+	from net.Addr
+}
+
+// queue depth and counters for display_queue
+type QueueStats struct {
+	Depth           int // messages waiting in the droppable queue
+	PriorityDepth   int // messages waiting in the priority queue
+	MaxDepth        int // highest combined depth seen
+	Received        uint64
+	Processed       uint64
+	DroppedOverload uint64 // oldest droppable messages thrown away because the queue was full
+	DecodeErrors    uint64
+	UnknownType     uint64
+}
+
+var (
+	queue         chan datagram
+	priorityQueue chan datagram
+
+	statReceived        atomic.Uint64
+	statProcessed       atomic.Uint64
+	statDroppedOverload atomic.Uint64
+	statDecodeErrors    atomic.Uint64
+	statUnknownType     atomic.Uint64
+	statMaxDepth        atomic.Int64
+)
+
+func GetQueueStats() QueueStats {
+	return QueueStats{
+		Depth:           len(queue),
+		PriorityDepth:   len(priorityQueue),
+		MaxDepth:        int(statMaxDepth.Load()),
+		Received:        statReceived.Load(),
+		Processed:       statProcessed.Load(),
+		DroppedOverload: statDroppedOverload.Load(),
+		DecodeErrors:    statDecodeErrors.Load(),
+		UnknownType:     statUnknownType.Load(),
+	}
+}
+
+func startWorkers(ctx context.Context, list *common.MembershipList, config PipelineConfig) {
+	queue = make(chan datagram, config.QueueSize)
+	priorityQueue = make(chan datagram, config.QueueSize)
+
+	for range config.Workers {
+		common.Go(func() {
+			for {
+				// always empty the priority queue first
+				select {
+				case d := <-priorityQueue:
+					dispatch(list, d)
+					continue
+				default:
+				}
+
+				select {
+				case d := <-priorityQueue:
+					dispatch(list, d)
+				case d := <-queue:
+					dispatch(list, d)
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+}
+
+// decodes the message type and puts the message on the right queue
+func enqueue(raw []byte, from net.Addr) {
+	statReceived.Add(1)
+
+	var msg MessageType
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		statDecodeErrors.Add(1)
+		metricDrops.With("decode").Inc()
+		fmt.Println("Error unmarshaling message type: ", err)
+		return
+	}
+
+	entry, ok := getHandler(msg.Type)
+	if !ok {
+		statUnknownType.Add(1)
+		metricDrops.With("unknown_type").Inc()
+		logger.Warn("no handler for message", "type", msg.Type, "from", from)
+		return
+	}
+
+	metricMessagesRecv.With(msg.Type).Inc()
+	d := datagram{msg: msg, from: from}
+	if entry.droppable {
+		enqueueDropOldest(d)
+	} else {
+		// never dropped, if this is full the reader waits for the workers
+		priorityQueue <- d
+	}
+
+	depth := int64(len(queue) + len(priorityQueue))
+	for {
+		max := statMaxDepth.Load()
+		if depth <= max || statMaxDepth.CompareAndSwap(max, depth) {
+			break
+		}
+	}
+}
+
+func enqueueDropOldest(d datagram) {
+	for {
+		select {
+		case queue <- d:
+			return
+		default:
+		}
+
+		// queue is full, throw away the oldest message to make room
+		select {
+		case old := <-queue:
+			statDroppedOverload.Add(1)
+			metricDrops.With("overload").Inc()
+			logger.Warn("queue full, dropped oldest message", "type", old.msg.Type, "from", old.from)
+		default:
+		}
+	}
+}
+
+func dispatch(list *common.MembershipList, d datagram) {
+	entry, _ := getHandler(d.msg.Type)
+	if err := entry.handler(list, d.msg.Data, d.from); err != nil {
+		statDecodeErrors.Add(1)
+		metricDrops.With("decode").Inc()
+		fmt.Printf("Error handling %s message: %v\n", d.msg.Type, err)
+	}
+	statProcessed.Add(1)
+}
+
+// decodes and handles one message right away, without the queues. used by the simulator, which
+// delivers messages one at a time
+func HandleMessage(list *common.MembershipList, raw []byte, from net.Addr) error {
+	var msg MessageType
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		metricDrops.With("decode").Inc()
+		return fmt.Errorf("unmarshaling message type: %v", err)
+	}
+	entry, ok := getHandler(msg.Type)
+	if !ok {
+		metricDrops.With("unknown_type").Inc()
+		return fmt.Errorf("no handler for message type %q", msg.Type)
+	}
+	metricMessagesRecv.With(msg.Type).Inc()
+	return entry.handler(list, msg.Data, from)
+}
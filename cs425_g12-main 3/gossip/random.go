@@ -0,0 +1,38 @@
+package gossip
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// random source for target selection and fault injection. seeded from the start time unless the
+// simulator sets a seed, so a simulated run can be replayed exactly
+var (
+	random      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomMutex sync.Mutex
+)
+
+func SeedRandom(seed int64) {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	random = rand.New(rand.NewSource(seed))
+}
+
+func randIntn(n int) int {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return random.Intn(n)
+}
+
+func randInt63n(n int64) int64 {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return random.Int63n(n)
+}
+
+func randFloat64() float64 {
+	randomMutex.Lock()
+	defer randomMutex.Unlock()
+	return random.Float64()
+}
@@ -0,0 +1,102 @@
+package gossip
+
+import (
+	"context"
+	"cs425_g12/common"
+	"fmt"
+	"net"
+	"time"
+)
+
+// config for the reconnect loop
+type ReconnectConfig struct {
+	Interval  time.Duration // time between two reconnect probes
+	Retention time.Duration // how long failed/removed members are remembered and probed
+}
+
+var DefaultReconnectConfig = ReconnectConfig{
+	Interval:  2 * time.Second,
+	Retention: 5 * time.Minute,
+}
+
+// only members that are not failed are sent in reconnect messages, so stale failures
+// from one side of a healed partition don't get pushed onto the other side
+func reconnectSummary(list *common.MembershipList) []common.Member {
+	out := make([]common.Member, 0)
+	for _, member := range list.GetEntireList() {
+		if member.SuspicionState != common.StateFailed {
+			out = append(out, member)
+		}
+	}
+	return out
+}
+
+// periodically probes one recently removed member or seed at a low rate. if it
+// answers, both sides merge each other's lists (push-pull) so a healed partition converges
+func StartReconnect(ctx context.Context, list *common.MembershipList, config ReconnectConfig) {
+	common.Go(func() {
+		for common.SleepContext(ctx, list.Clock(), config.Interval) {
+			Reconnect(list, config)
+		}
+	})
+}
+
+// one reconnect probe to a random candidate, if there is any
+func Reconnect(list *common.MembershipList, config ReconnectConfig) {
+	if !common.IsMemberInGroup {
+		return
+	}
+
+	candidates := list.GetReconnectCandidates(config.Retention)
+	if len(candidates) == 0 {
+		return
+	}
+	target := candidates[randIntn(len(candidates))]
+	sendReconnect(list, target)
+}
+
+// push side of the push-pull merge
+func sendReconnect(list *common.MembershipList, target common.MachineId) {
+	info := GossipInfo{
+		MemberSummary: reconnectSummary(list),
+		Sender:        common.GetSelf(),
+		Mode:          common.GetClusterMode(),
+	}
+	data := helperMarshal(MessageType{Type: "reconnect", Data: helperMarshal(info)})
+
+	targetAddr := &net.UDPAddr{IP: net.ParseIP(target.Ip), Port: int(target.Port)}
+	if _, err := globalConn.WriteTo(data, targetAddr); err != nil {
+		fmt.Println("error sending reconnect probe: ", err)
+		return
+	}
+	recordSend("reconnect", len(data))
+	logger.Printf("Sent reconnect probe to %s with %d members\n", target, len(info.MemberSummary))
+}
+
+// pull side: merge the prober's list and answer with ours
+func handleReconnect(list *common.MembershipList, info GossipInfo, from net.Addr) {
+	if !common.IsMemberInGroup {
+		return
+	}
+	logger.Printf("Received reconnect probe from %s\n", info.Sender)
+	common.ObserveMode(info.Mode, info.Sender)
+	mergeForMode(list, info.MemberSummary, info.Sender)
+
+	reply := GossipInfo{
+		MemberSummary: reconnectSummary(list),
+		Sender:        common.GetSelf(),
+		Mode:          common.GetClusterMode(),
+	}
+	data := helperMarshal(MessageType{Type: "reconnectAck", Data: helperMarshal(reply)})
+	if _, err := globalConn.WriteTo(data, from); err != nil {
+		fmt.Println("error sending reconnect ack: ", err)
+		return
+	}
+	recordSend("reconnectAck", len(data))
+}
+
+func handleReconnectAck(list *common.MembershipList, info GossipInfo) {
+	logger.Printf("Reconnected with %s, merging %d members\n", info.Sender, len(info.MemberSummary))
+	common.ObserveMode(info.Mode, info.Sender)
+	mergeForMode(list, info.MemberSummary, info.Sender)
+}
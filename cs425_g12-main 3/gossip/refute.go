@@ -0,0 +1,131 @@
+package gossip
+
+import (
+	"cs425_g12/common"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// SWIM style refutation for ping/ack mode: when we learn that someone suspects us (or marked us
+// failed after a single missed ack) we bump our incarnation and actively send an alive message,
+// instead of throwing away our identity and rejoining with a new version
+
+// failure reports about self older than this are not counted towards the quorum
+var SelfFailureQuorumWindow = 10 * time.Second
+
+// number of protocol rounds the alive message is resent for after a refutation
+const aliveRetransmits = 3
+
+// alive messages data
+type Alive struct {
+	Sender common.MachineId
+	Member common.Member // self entry with the bumped incarnation number
+}
+
+var (
+	selfFailureReports = make(map[common.MachineId]time.Time) // who reported us failed and when
+	pendingAlive       int                                    // rounds left to resend the alive message
+	refuteMutex        sync.Mutex
+)
+
+// records that sender claims we failed. returns true if a quorum of the other members did so
+// within the window, which is the only case where we give up our identity and rejoin
+func reportSelfFailure(list *common.MembershipList, sender common.MachineId) bool {
+	self := common.GetSelf()
+
+	others := 0
+	for _, member := range list.GetUniqueMembers() {
+		if member.SuspicionState != common.StateFailed && member.MachineId.Ip != self.Ip {
+			others++
+		}
+	}
+	quorum := others/2 + 1
+
+	refuteMutex.Lock()
+	defer refuteMutex.Unlock()
+
+	now := list.Clock().Now()
+	if sender.Ip != self.Ip {
+		selfFailureReports[sender] = now
+	}
+	for reporter, reportedAt := range selfFailureReports {
+		if now.Sub(reportedAt) > SelfFailureQuorumWindow {
+			delete(selfFailureReports, reporter)
+		}
+	}
+
+	logger.Printf("Self reported failed by %s (%d of %d reports needed)\n", sender, len(selfFailureReports), quorum)
+	if len(selfFailureReports) >= quorum {
+		selfFailureReports = make(map[common.MachineId]time.Time)
+		return true
+	}
+	return false
+}
+
+// bumps our incarnation past the one we were suspected/failed at and starts disseminating it
+func refuteSelf(list *common.MembershipList, suspectedIncarnation uint64) {
+	selfEntry := list.GetMember(common.GetSelf())
+	if selfEntry == nil {
+		return
+	}
+
+	if suspectedIncarnation >= selfEntry.IncarnationNumber {
+		selfEntry.IncarnationNumber = suspectedIncarnation + 1
+	} else {
+		// already refuted this one
+		return
+	}
+	selfEntry.SuspicionState = common.StateAlive
+	selfEntry.TimeLocal = list.Clock().Now()
+	common.MetricRefutations.Inc()
+
+	fmt.Printf("[%s] Refuting suspicion of self, incarnation now %d\n", common.Now().Format("15:04:05.000"), selfEntry.IncarnationNumber)
+	common.LogMemberEvent(logger, common.EventKeyRefute, selfEntry.MachineId, "source", "local", "incarnation", selfEntry.IncarnationNumber)
+
+	refuteMutex.Lock()
+	pendingAlive = aliveRetransmits
+	refuteMutex.Unlock()
+
+	// send right away instead of waiting for the next ping to piggyback it
+	broadcastAlive(list)
+}
+
+// called every protocol round, resends the alive message while a refutation is pending
+func disseminatePendingAlive(list *common.MembershipList) {
+	refuteMutex.Lock()
+	if pendingAlive == 0 {
+		refuteMutex.Unlock()
+		return
+	}
+	pendingAlive--
+	refuteMutex.Unlock()
+
+	broadcastAlive(list)
+}
+
+// sends our own entry to every other member
+func broadcastAlive(list *common.MembershipList) {
+	self := common.GetSelf()
+	selfEntry := list.GetMember(self)
+	if selfEntry == nil {
+		return
+	}
+
+	alive := Alive{Sender: self, Member: *selfEntry}
+	data := helperMarshal(MessageType{Type: "alive", Data: helperMarshal(alive)})
+
+	for _, member := range list.GetUniqueMembers() {
+		if member.MachineId.Ip == self.Ip {
+			continue
+		}
+		targetAddr := &net.UDPAddr{IP: net.ParseIP(member.MachineId.Ip), Port: int(member.MachineId.Port)}
+		if _, err := globalConn.WriteTo(data, targetAddr); err != nil {
+			fmt.Println("error sending alive message: ", err)
+			continue
+		}
+		recordSend("alive", len(data))
+	}
+	logger.Printf("Broadcast alive message with incarnation %d\n", selfEntry.IncarnationNumber)
+}
@@ -0,0 +1,225 @@
+package gossip
+
+import (
+	"context"
+	"cs425_g12/common"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// what a node does once it learns that the group declared it failed
+type SelfFailurePolicy uint8
+
+const (
+	PolicyRejoin  SelfFailurePolicy = iota // rejoin with a new version, backing off between attempts
+	PolicyStayOut                          // stay out of the group until the join command is used
+	PolicyExit                             // exit the process
+)
+
+func (p SelfFailurePolicy) String() string {
+	switch p {
+	case PolicyRejoin:
+		return "rejoin"
+	case PolicyStayOut:
+		return "stayout"
+	case PolicyExit:
+		return "exit"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseSelfFailurePolicy(s string) (SelfFailurePolicy, error) {
+	switch s {
+	case "rejoin":
+		return PolicyRejoin, nil
+	case "stayout":
+		return PolicyStayOut, nil
+	case "exit":
+		return PolicyExit, nil
+	}
+	return PolicyRejoin, fmt.Errorf("unknown self failure policy %q (expected rejoin, stayout or exit)", s)
+}
+
+// backoff between rejoin attempts
+var RejoinBackoffInitial = time.Second
+var RejoinBackoffMax = 30 * time.Second
+
+var (
+	selfFailurePolicy SelfFailurePolicy
+	policyMutex       sync.RWMutex
+)
+
+func SetSelfFailurePolicy(policy SelfFailurePolicy) {
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+	selfFailurePolicy = policy
+}
+
+func GetSelfFailurePolicy() SelfFailurePolicy {
+	policyMutex.RLock()
+	defer policyMutex.RUnlock()
+	return selfFailurePolicy
+}
+
+// context of the node, the policy stops rejoining once it is cancelled
+var (
+	nodeCtx      = context.Background()
+	nodeCtxMutex sync.RWMutex
+)
+
+func SetNodeContext(ctx context.Context) {
+	nodeCtxMutex.Lock()
+	defer nodeCtxMutex.Unlock()
+	nodeCtx = ctx
+}
+
+func getNodeContext() context.Context {
+	nodeCtxMutex.RLock()
+	defer nodeCtxMutex.RUnlock()
+	return nodeCtx
+}
+
+// closed once the exit policy asks the node to shut down, main then runs Shutdown and exits
+var (
+	exitRequested     = make(chan struct{})
+	exitRequestedOnce sync.Once
+)
+
+func ExitRequested() <-chan struct{} {
+	return exitRequested
+}
+
+// counters shown by list_self
+var (
+	declaredDeadCount   atomic.Int64
+	rejoinCount         atomic.Int64
+	handlingSelfFailure atomic.Bool // only one policy run at a time
+)
+
+func GetSelfFailureStats() (declaredDead int64, rejoined int64) {
+	return declaredDeadCount.Load(), rejoinCount.Load()
+}
+
+// called from the merge functions when the group declared us failed. the policy runs on its own
+// goroutine so the listener keeps processing packets while we rejoin
+func handleSelfFailure(list *common.MembershipList) {
+
+	if !common.IsMemberInGroup {
+		// not a member of the group, no need to rejoin
+		return
+	}
+	if !handlingSelfFailure.CompareAndSwap(false, true) {
+		return // already handling it
+	}
+
+	self := common.GetSelf()
+	policy := GetSelfFailurePolicy()
+
+	// stop the protocol loops until the policy is done. exit stays a member so Shutdown still
+	// broadcasts the leave
+	if policy != PolicyExit {
+		common.IsMemberInGroup = false
+	}
+	declaredDeadCount.Add(1)
+
+	fmt.Printf("[%s] Self %s declared failed by the group, policy: %s\n", common.Now().Format("15:04:05.000"), self, policy)
+	common.EmitEvent(common.Event{
+		Type:    common.EventSelfFailed,
+		Members: []common.MachineId{self},
+		Detail:  fmt.Sprintf("policy: %s", policy),
+	})
+
+	ctx := getNodeContext()
+	if runPoliciesInline.Load() {
+		defer handlingSelfFailure.Store(false)
+		runSelfFailurePolicy(ctx, list, policy)
+		return
+	}
+	common.Go(func() {
+		defer handlingSelfFailure.Store(false)
+		runSelfFailurePolicy(ctx, list, policy)
+	})
+}
+
+// the simulator runs every node on one goroutine, so the policy has to run right away
+var runPoliciesInline atomic.Bool
+
+func RunPoliciesInline(inline bool) {
+	runPoliciesInline.Store(inline)
+}
+
+func runSelfFailurePolicy(ctx context.Context, list *common.MembershipList, policy SelfFailurePolicy) {
+	self := common.GetSelf()
+	selfNewVersion := common.NewMachineId(self.Ip, self.Port, common.Now())
+
+	switch policy {
+	case PolicyExit:
+		// main shuts down, the policy can't run Shutdown itself since Shutdown waits for it
+		logger.Printf("Declared failed, exiting (policy exit)\n")
+		fmt.Println("Declared failed by the group, exiting")
+		exitRequestedOnce.Do(func() { close(exitRequested) })
+
+	case PolicyStayOut:
+		// prepare a fresh identity so the join command starts clean
+		list.DeleteEntireList()
+		common.SetSelf(selfNewVersion)
+		logger.Printf("Declared failed, staying out of the group (policy stayout), new MachineId: %+v\n", selfNewVersion)
+		fmt.Println("Declared failed by the group, staying out. Use join to rejoin.")
+
+	case PolicyRejoin:
+		if (self.Ip == common.Introducer.Ip) && (self.Port == common.Introducer.Port) {
+			// no need to delete entire list
+			// inserting new self
+			list.Delete(self)
+			common.SetSelf(selfNewVersion)
+			list.Insert(common.NewMember(selfNewVersion))
+			common.IsMemberInGroup = true
+			logger.Printf("I am the introducer.")
+		} else {
+			// delete entire list and request to rejoin, backing off between attempts
+			list.DeleteEntireList()
+			common.SetSelf(selfNewVersion)
+			backoff := RejoinBackoffInitial
+			for !JoinGroup(list) {
+				logger.Printf("Rejoin failed, retrying in %s\n", backoff)
+				if !common.SleepContext(ctx, list.Clock(), backoff) {
+					logger.Printf("Stopped rejoining, shutting down\n")
+					return
+				}
+				backoff *= 2
+				if backoff > RejoinBackoffMax {
+					backoff = RejoinBackoffMax
+				}
+			}
+			common.IsMemberInGroup = true
+		}
+
+		rejoinCount.Add(1)
+		common.EmitEvent(common.Event{
+			Type:    common.EventRejoined,
+			Members: []common.MachineId{selfNewVersion},
+			Detail:  fmt.Sprintf("previous version %d", self.Version),
+		})
+		logger.Printf("Handled self failure, new MachineId: %+v\n", selfNewVersion)
+	}
+}
+
+// tries the introducer first and then every seed, any member of the group can let us in
+func JoinGroup(list *common.MembershipList) bool {
+	if RequestJoin(common.Introducer, list) {
+		return true
+	}
+	for _, seed := range common.Seeds {
+		if seed.Ip == common.Introducer.Ip && seed.Port == common.Introducer.Port {
+			continue
+		}
+		logger.Printf("Trying to join through seed %s\n", seed)
+		if RequestJoin(seed, list) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package gossip
+
+import (
+	"context"
+	"cs425_g12/common"
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// leave messages data, sent when a node leaves voluntarily so the others don't have to wait
+// for its heartbeat or probes to time out
+type Leave struct {
+	Sender common.MachineId
+	Member common.Member // self entry marked as failed
+}
+
+// marks self as failed and tells every other member right away
+func BroadcastLeave(list *common.MembershipList) {
+	self := common.GetSelf()
+	selfEntry := list.GetMember(self)
+	if selfEntry == nil {
+		return
+	}
+	selfEntry.SuspicionState = common.StateFailed
+	selfEntry.FailedBy = self
+
+	leave := Leave{Sender: self, Member: *selfEntry}
+	data := helperMarshal(MessageType{Type: "leave", Data: helperMarshal(leave)})
+
+	for _, member := range list.GetUniqueMembers() {
+		if member.MachineId.Ip == self.Ip || member.SuspicionState == common.StateFailed {
+			continue
+		}
+		targetAddr := &net.UDPAddr{IP: net.ParseIP(member.MachineId.Ip), Port: int(member.MachineId.Port)}
+		if _, err := globalConn.WriteTo(data, targetAddr); err != nil {
+			fmt.Println("error sending leave message: ", err)
+			continue
+		}
+		recordSend("leave", len(data))
+	}
+	common.LogMemberEvent(logger, common.EventKeyLeave, self, "source", "local")
+}
+
+// whether a failed entry comes from a member that left, it marked itself failed. a leave is not
+// a failure, so it is not reported to the partition detector or counted as a detection
+func leftGroup(member common.Member) bool {
+	return member.SuspicionState == common.StateFailed && member.FailedBy == member.MachineId
+}
+
+func handleLeave(list *common.MembershipList, data json.RawMessage, from net.Addr) error {
+	var leave Leave
+	if err := json.Unmarshal(data, &leave); err != nil {
+		return fmt.Errorf("unmarshaling leave message: %v", err)
+	}
+	common.LogMemberEvent(logger, common.EventKeyLeave, leave.Sender, "source", "gossip")
+	leave.Member.SuspicionState = common.StateFailed
+	leave.Member.FailedBy = leave.Member.MachineId
+	mergeForMode(list, []common.Member{leave.Member}, leave.Sender)
+	return nil
+}
+
+// stops the node: stop cancels the context the loops were started with, then the leave is
+// broadcast, delayed sends are drained, the socket is closed and the goroutines are waited for.
+// returns ctx.Err() if that didn't finish before ctx was done
+func Shutdown(ctx context.Context, list *common.MembershipList, stop context.CancelFunc) error {
+	logger.Printf("Shutting down\n")
+	wasMember := common.IsMemberInGroup
+	common.IsMemberInGroup = false
+	stop()
+
+	if globalConn == nil {
+		return common.WaitGoroutines(ctx)
+	}
+	if wasMember {
+		BroadcastLeave(list)
+	}
+	if transport, ok := globalConn.(*faultyTransport); ok {
+		if err := transport.drain(ctx); err != nil {
+			logger.Printf("Delayed messages not sent before shutdown: %v\n", err)
+		}
+	}
+	if err := globalConn.Close(); err != nil {
+		fmt.Println("Error closing UDP socket: ", err)
+	}
+	return common.WaitGoroutines(ctx)
+}
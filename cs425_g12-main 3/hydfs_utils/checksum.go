@@ -0,0 +1,130 @@
+package hydfs_utils
+
+import (
+	"crypto/sha256"
+	"cs425_g12/common"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// checksums at rest: every block records the sha256 of its data when the client writes it. a
+// replica checks an upload against it before storing it, and every download (get, merge,
+// re-replication, rebalancing) checks the block it received before using it. a replica that sent
+// a block that doesn't match is asked to repair its copy from a replica whose copy did match.
+// blocks written before checksums have none and are not checked
+
+var errBlockCorrupt = errors.New("block checksum mismatch")
+
+// a block a replica holds a corrupt copy of, with replicas that have a good one
+type RepairBlockArgs struct {
+	FileName string
+	FileId   string
+	Block    BlockInfo
+	Sources  []common.MachineId
+}
+
+func checksumOf(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sha256 and size of a local file
+func checksumFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	sum, err := checksumOf(file)
+	return sum, info.Size(), err
+}
+
+// checks the data at path against the size and checksum of block
+func checkData(path string, block BlockInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return checkContent(file, info.Size(), block)
+}
+
+// checks size bytes read from r against block
+func checkContent(r io.Reader, size int64, block BlockInfo) error {
+	if size != block.Size {
+		return fmt.Errorf("%w: block %s has %d bytes, expected %d", errBlockCorrupt, block.Id, size, block.Size)
+	}
+	if block.Checksum == "" {
+		return nil
+	}
+	sum, err := checksumOf(r)
+	if err != nil {
+		return fmt.Errorf("failed to read block %s: %v", block.Id, err)
+	}
+	if sum != block.Checksum {
+		return fmt.Errorf("%w: block %s", errBlockCorrupt, block.Id)
+	}
+	return nil
+}
+
+// checks the block that was downloaded to base in out
+func checkDownloaded(out *os.File, base int64, block BlockInfo) error {
+	if block.Checksum == "" {
+		return nil
+	}
+	sum, err := checksumOf(io.NewSectionReader(out, base, block.Size))
+	if err != nil {
+		return fmt.Errorf("failed to read block %s back: %v", block.Id, err)
+	}
+	if sum != block.Checksum {
+		return fmt.Errorf("%w: block %s", errBlockCorrupt, block.Id)
+	}
+	return nil
+}
+
+// checks the stored data of a block of a file
+func (s *fileStore) checkBlock(fileId string, block BlockInfo) error {
+	return checkData(s.blockPath(fileId, block.Id), block)
+}
+
+// deletes the data of a corrupt block, the meta keeps it so it is fetched again
+func (s *fileStore) dropBlock(fileId string, blockId string) error {
+	err := os.Remove(s.blockPath(fileId, blockId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// asks the replicas that sent a corrupt copy of block to fetch it again from healthy, in the
+// background
+func repairReplicas(corrupt []common.MachineId, fileName string, fileId string, block BlockInfo, healthy common.MachineId) {
+	for _, replica := range corrupt {
+		if replica.Ip == healthy.Ip {
+			continue
+		}
+		go func() {
+			args := &RepairBlockArgs{FileName: fileName, FileId: fileId, Block: block, Sources: []common.MachineId{healthy}}
+			var reply string
+			if err := callWithTimeout(replica, "HyDFSReceiver.RepairBlock", args, &reply, writeTimeout+transferThrottle.duration(block.Size)); err != nil {
+				HyDFSLogger.Warn("could not repair corrupt block", "file", fileName, "block", block.Id, "replica", replica.Ip, "err", err)
+				return
+			}
+			HyDFSLogger.Info("asked replica to repair block", "file", fileName, "block", block.Id, "replica", replica.Ip, "from", healthy.Ip, "reply", reply)
+		}()
+	}
+}
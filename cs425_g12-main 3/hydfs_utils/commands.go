@@ -0,0 +1,517 @@
+package hydfs_utils
+
+import (
+	"cs425_g12/common"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the hydfs commands of the CLI, run on the node the command was typed on
+
+// how long connecting to a replica may take
+var dialTimeout = 2 * time.Second
+
+// how long a read from one replica may take before the next one is tried
+var readTimeout = 10 * time.Second
+
+// how long a replica may take to ack a write
+var writeTimeout = 10 * time.Second
+
+var errTimedOut = errors.New("timed out")
+
+// per client state of the appends: the appends of this client are numbered per file and issued
+// one at a time, so every replica sees them in issue order
+var (
+	appendSeq      = make(map[string]uint64)         // fileId -> seq of the last append
+	ackedSeq       = make(map[string]uint64)         // fileId -> seq of the last write acked by W replicas, reads must see it
+	unconfirmed    = make(map[string]*pendingAppend) // fileId -> append no replica confirmed yet
+	countersClient string                            // client the counters belong to
+	lastTimestamp  int64
+	appendMutex    sync.Mutex
+)
+
+// an append that may be stored on some replica, but that no replica applied. it is sent again
+// with the same block before the next append of the file, the next seq is only issued once a
+// replica applied it. a replica that has the block already ignores it
+type pendingAppend struct {
+	args     BlockArgs
+	dataPath string // copy of the appended data, or the local file if it could not be copied
+	copied   bool
+}
+
+// deletes the copy of the data
+func (p *pendingAppend) drop() {
+	if p.copied {
+		os.Remove(p.dataPath)
+	}
+}
+
+// id of this client in the blocks it writes, a restarted node is a new client
+func ClientId() string {
+	self := common.GetSelf()
+	return fmt.Sprintf("%s:%d:%d", self.Ip, self.Port, self.Version)
+}
+
+// id of this client for the next write or read. a node that rejoins after it was declared failed
+// gets a new version and so is a new client, whose appends start over at seq 1: no replica has
+// seen the new id, so seqs continuing the old ones would be held back forever, and reads would
+// wait for writes of the new client that never happened. appendMutex must be held
+func currentClient() string {
+	client := ClientId()
+	if client != countersClient {
+		appendSeq = make(map[string]uint64)
+		ackedSeq = make(map[string]uint64)
+		for _, pending := range unconfirmed {
+			pending.drop()
+		}
+		unconfirmed = make(map[string]*pendingAppend)
+		countersClient = client
+	}
+	return client
+}
+
+// strictly increasing timestamp for the blocks of this client
+func nextTimestamp() int64 {
+	now := common.Now().UnixNano()
+	if now <= lastTimestamp {
+		now = lastTimestamp + 1
+	}
+	lastTimestamp = now
+	return now
+}
+
+func newBlock(client string, seq uint64) BlockInfo {
+	return BlockInfo{Id: fmt.Sprintf("%s_%d", client, seq), Client: client, Seq: seq, Timestamp: nextTimestamp()}
+}
+
+func dialAddr(addr string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to HyDFS RPC server at %s: %v", addr, err)
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func dialNode(machine common.MachineId) (*rpc.Client, error) {
+	return dialAddr(rpcAddr(machine))
+}
+
+// uploads the local file to every replica in parallel and calls method with the block on it once
+// the upload is through, waits for required acks, see quorumCall
+func writeReplicas(replicas []common.MachineId, required int, method string, args *BlockArgs, localPath string) ([]replicaAnswer, []replicaAnswer) {
+	return quorumCall(replicas, required, func(replica common.MachineId) (interface{}, error) {
+		if _, err := uploadFile(rpcAddr(replica), args.UploadId, localPath); err != nil {
+			return nil, err
+		}
+		var reply string
+		err := callWithTimeout(replica, method, args, &reply, writeTimeout)
+		return reply, err
+	})
+}
+
+// checksum and size of the local file a create or append sends, the replicas check the upload
+// against them
+func localFileChecksum(localPath string) (string, int64, error) {
+	sum, size, err := checksumFile(localPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read local file %s: %v", localPath, err)
+	}
+	return sum, size, nil
+}
+
+// name of the upload of a block on the replicas. it includes the checksum, so a seq that is used
+// again after no replica stored its block never continues the upload of other data
+func uploadIdOf(fileId string, block BlockInfo) string {
+	return fileId + "_" + block.Id + "_" + block.Checksum[:min(len(block.Checksum), 16)]
+}
+
+// calls method on one replica, gives up after timeout
+func callWithTimeout(machine common.MachineId, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	client, err := dialNode(machine)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return callClient(client, method, args, reply, timeout)
+}
+
+// order in which replicas are read: ourselves first, then alive replicas in ring order, replicas
+// the failure detector suspects last
+func readOrder(list *common.MembershipList, replicas []common.MachineId) []common.MachineId {
+	self := common.GetSelf()
+	rank := func(replica common.MachineId) int {
+		if replica.Ip == self.Ip {
+			return 0
+		}
+		if member := list.GetMember(replica); member != nil && member.SuspicionState == common.StateSuspicious {
+			return 2
+		}
+		return 1
+	}
+	ordered := append([]common.MachineId(nil), replicas...)
+	sort.SliceStable(ordered, func(i, j int) bool { return rank(ordered[i]) < rank(ordered[j]) })
+	return ordered
+}
+
+// create localfilename HyDFSfilename: writes the local file to every replica of the hydfs file and
+// succeeds if W of them acked. fails if the file already exists, a failed create is undone
+func Create(list *common.MembershipList, localPath string, fileName string) (OpReport, error) {
+	write, _ := GetConsistency()
+	report := OpReport{Op: "create", FileName: fileName, Consistency: write}
+	if localPath == "" || fileName == "" {
+		return report, fmt.Errorf("usage: create localfilename HyDFSfilename")
+	}
+	sum, size, err := localFileChecksum(localPath)
+	if err != nil {
+		return report, err
+	}
+
+	replicas := ReplicaSet(list, fileName)
+	if len(replicas) == 0 {
+		return report, fmt.Errorf("no replicas available for %s", fileName)
+	}
+	report.Replicas = len(replicas)
+	report.Required = write.Required(len(replicas))
+
+	fileId := FileIdOf(fileName)
+	appendMutex.Lock()
+	block := newBlock(currentClient(), 0)
+	appendMutex.Unlock()
+	block.Size = size
+	block.Checksum = sum
+
+	// a create waits for every replica: a replica that already has the file must fail it, also
+	// after W others acked, or the two creates would end up in one file
+	args := &BlockArgs{FileName: fileName, FileId: fileId, Block: block, UploadId: uploadIdOf(fileId, block)}
+	ok, failed := writeReplicas(replicas, 0, "HyDFSReceiver.CreateFile", args, localPath)
+	report.Answered = len(ok)
+
+	exists := false
+	created := make([]common.MachineId, 0, len(ok))
+	for _, answer := range ok {
+		created = append(created, answer.replica)
+	}
+	errs := make([]string, 0)
+	for _, answer := range failed {
+		if answer.err.Error() == errFileExists {
+			exists = true
+		}
+		// a replica that timed out may still have created it
+		if errors.Is(answer.err, errTimedOut) {
+			created = append(created, answer.replica)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", answer.replica.Ip, answer.err))
+	}
+	if exists {
+		undoCreate(created, args)
+		return report, fmt.Errorf("%s already exists in HyDFS", fileName)
+	}
+	if len(ok) < report.Required {
+		HyDFSLogger.Warn("create failed", "file", fileName, "consistency", write, "acked", len(ok), "required", report.Required)
+		undoCreate(created, args)
+		return report, fmt.Errorf("create of %s acked by %d of %d replicas, W=%s needs %d: %s", fileName, len(ok), len(replicas), write, report.Required, strings.Join(errs, "; "))
+	}
+
+	appendMutex.Lock()
+	if currentClient() == block.Client {
+		ackedSeq[fileId] = block.Seq
+	}
+	appendMutex.Unlock()
+	HyDFSLogger.Info("create", "file", fileName, "bytes", size, "consistency", write, "acked", len(ok), "replicas", fmt.Sprint(replicas))
+	return report, nil
+}
+
+// deletes the copies a failed create left on replicas, so that a retry doesn't find the file.
+// a replica only deletes a copy that still holds nothing but this create
+func undoCreate(replicas []common.MachineId, args *BlockArgs) {
+	for _, replica := range replicas {
+		var reply string
+		if err := callWithTimeout(replica, "HyDFSReceiver.UndoCreate", args, &reply, writeTimeout); err != nil {
+			HyDFSLogger.Warn("could not undo create", "file", args.FileName, "replica", replica.Ip, "err", err)
+		}
+	}
+}
+
+// get HyDFSfilename localfilename: asks the replicas for their version of the file, waits for R of
+// them and reads the newest copy that has every write of this client that was acked. falls back to
+// the next newest copy on an error or timeout
+func Get(list *common.MembershipList, fileName string, localPath string) (OpReport, error) {
+	_, read := GetConsistency()
+	report := OpReport{Op: "get", FileName: fileName, Consistency: read}
+	if fileName == "" || localPath == "" {
+		return report, fmt.Errorf("usage: get HyDFSfilename localfilename")
+	}
+	replicas := ReplicaSet(list, fileName)
+	if len(replicas) == 0 {
+		return report, fmt.Errorf("no replicas available for %s", fileName)
+	}
+	report.Replicas = len(replicas)
+	report.Required = read.Required(len(replicas))
+
+	fileId := FileIdOf(fileName)
+	args := &GetFileArgs{FileName: fileName, FileId: fileId}
+	appendMutex.Lock()
+	client := currentClient()
+	seq, wrote := ackedSeq[fileId]
+	appendMutex.Unlock()
+
+	// a replica without the file answers with a nil meta, it still counts towards R
+	getMeta := func(replica common.MachineId) (interface{}, error) {
+		var meta FileMeta
+		err := callWithTimeout(replica, "HyDFSReceiver.GetMeta", args, &meta, readTimeout)
+		if err != nil {
+			if err.Error() == errFileNotFound {
+				return (*FileMeta)(nil), nil
+			}
+			return nil, err
+		}
+		return &meta, nil
+	}
+	ok, failed := quorumCall(readOrder(list, replicas), report.Required, getMeta)
+	report.Answered = len(ok)
+
+	errs := make([]string, 0)
+	for _, answer := range failed {
+		HyDFSLogger.Warn("get could not reach replica", "file", fileName, "replica", answer.replica.Ip, "err", answer.err)
+		errs = append(errs, fmt.Sprintf("%s: %v", answer.replica.Ip, answer.err))
+	}
+	if len(ok) < report.Required {
+		return report, fmt.Errorf("get of %s answered by %d of %d replicas, R=%s needs %d: %s", fileName, len(ok), len(replicas), read, report.Required, strings.Join(errs, "; "))
+	}
+
+	// copies that have our own writes, newest first
+	usable := func(answers []replicaAnswer) []replicaAnswer {
+		out := make([]replicaAnswer, 0, len(answers))
+		for _, answer := range answers {
+			meta := answer.reply.(*FileMeta)
+			if meta != nil && (!wrote || meta.hasWritesOf(client, seq)) {
+				out = append(out, answer)
+			}
+		}
+		sort.SliceStable(out, func(i, j int) bool {
+			return out[i].reply.(*FileMeta).newerThan(out[j].reply.(*FileMeta))
+		})
+		return out
+	}
+	candidates := usable(ok)
+	if len(candidates) == 0 {
+		// the replicas that answered first don't have our last write yet, ask the others
+		asked := make(map[common.MachineId]bool)
+		for _, answer := range append(ok, failed...) {
+			asked[answer.replica] = true
+		}
+		for _, replica := range readOrder(list, replicas) {
+			if asked[replica] {
+				continue
+			}
+			if reply, err := getMeta(replica); err == nil {
+				ok = append(ok, replicaAnswer{replica: replica, reply: reply})
+			}
+		}
+		candidates = usable(ok)
+	}
+	if len(candidates) == 0 {
+		for _, answer := range ok {
+			if answer.reply.(*FileMeta) != nil {
+				return report, fmt.Errorf("no replica of %s has the last write of this client yet", fileName)
+			}
+		}
+		return report, fmt.Errorf("%s does not exist in HyDFS", fileName)
+	}
+
+	newest := candidates[0].reply.(*FileMeta)
+	from, err := downloadFile(newest, candidates, localPath)
+	if err != nil {
+		return report, fmt.Errorf("get of %s failed: %v", fileName, err)
+	}
+	report.From = strings.Join(from, ",")
+	report.Blocks = len(newest.Blocks)
+	HyDFSLogger.Info("get", "file", fileName, "bytes", newest.Size(), "consistency", read, "answered", len(ok), "replica", report.From)
+	return report, nil
+}
+
+// writes the blocks of meta into the local file, each block streamed from the first candidate
+// that has it. a block that breaks off continues from the next candidate where it stopped, one
+// that doesn't match its checksum is fetched again from the next candidate, and the candidate
+// that sent it is repaired. fails if no candidate has a good copy of a block. returns the
+// replicas the data came from
+func downloadFile(meta *FileMeta, candidates []replicaAnswer, localPath string) ([]string, error) {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directories for %s: %v", localPath, err)
+	}
+	out, err := os.Create(localPath + ".part")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer out.Close()
+
+	from := make([]string, 0, 1)
+	var base int64
+	for _, block := range meta.Blocks {
+		var done int64
+		fetched := false
+		corrupt := make([]common.MachineId, 0)
+		for _, candidate := range candidates {
+			if !candidate.reply.(*FileMeta).hasBlock(block.Id) {
+				continue
+			}
+			if done, err = downloadBlock(rpcAddr(candidate.replica), meta.FileId, block, out, base, done, false); err != nil {
+				if errors.Is(err, errBlockCorrupt) {
+					corrupt = append(corrupt, candidate.replica)
+					MetricCorruptBlocks.With("read").Inc()
+				}
+				HyDFSLogger.Warn("get failed on replica, trying the next one", "file", meta.FileName, "block", block.Id, "replica", candidate.replica.Ip, "at", done, "err", err)
+				continue
+			}
+			if !slices.Contains(from, candidate.replica.Ip) {
+				from = append(from, candidate.replica.Ip)
+			}
+			repairReplicas(corrupt, meta.FileName, meta.FileId, block, candidate.replica)
+			fetched = true
+			break
+		}
+		if !fetched {
+			os.Remove(localPath + ".part")
+			if len(corrupt) > 0 {
+				return nil, fmt.Errorf("%w: no replica has a good copy of block %s", errBlockCorrupt, block.Id)
+			}
+			return nil, fmt.Errorf("no replica could send block %s", block.Id)
+		}
+		base += block.Size
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	return from, os.Rename(localPath+".part", localPath)
+}
+
+// append localfilename HyDFSfilename: adds the local file as a new block at the end of the hydfs
+// file on every replica and returns once W of them acked. appends of this client are sent one at a
+// time, so they are applied in the order they were issued
+func Append(list *common.MembershipList, localPath string, fileName string) (OpReport, error) {
+	write, _ := GetConsistency()
+	report := OpReport{Op: "append", FileName: fileName, Consistency: write}
+	if localPath == "" || fileName == "" {
+		return report, fmt.Errorf("usage: append localfilename HyDFSfilename")
+	}
+	sum, size, err := localFileChecksum(localPath)
+	if err != nil {
+		return report, err
+	}
+	replicas := ReplicaSet(list, fileName)
+	if len(replicas) == 0 {
+		return report, fmt.Errorf("no replicas available for %s", fileName)
+	}
+	report.Replicas = len(replicas)
+	report.Required = write.Required(len(replicas))
+
+	fileId := FileIdOf(fileName)
+	appendMutex.Lock()
+	defer appendMutex.Unlock()
+	client := currentClient()
+	if err := confirmPending(replicas, fileId); err != nil {
+		return report, fmt.Errorf("earlier append to %s is not applied by any replica yet: %v", fileName, err)
+	}
+	block := newBlock(client, appendSeq[fileId]+1)
+	block.Size = size
+	block.Checksum = sum
+
+	args := &BlockArgs{FileName: fileName, FileId: fileId, Block: block, UploadId: uploadIdOf(fileId, block)}
+	ok, failed := writeReplicas(replicas, report.Required, "HyDFSReceiver.AppendFile", args, localPath)
+	report.Answered = len(ok)
+
+	notFound := 0
+	stored := false
+	errs := make([]string, 0)
+	for _, answer := range failed {
+		if answer.err.Error() == errFileNotFound {
+			notFound++
+		}
+		// a replica that held the block back or timed out may store it without having applied it
+		if answer.err.Error() == errHeldBack || errors.Is(answer.err, errTimedOut) {
+			stored = true
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", answer.replica.Ip, answer.err))
+	}
+	if notFound == len(replicas) {
+		return report, fmt.Errorf("%s does not exist in HyDFS", fileName)
+	}
+	if len(ok) > 0 {
+		appendSeq[fileId] = block.Seq
+	} else if stored {
+		keepPending(fileId, args, localPath)
+	}
+	if len(ok) < report.Required {
+		HyDFSLogger.Warn("append failed", "file", fileName, "block", block.Id, "consistency", write, "acked", len(ok), "required", report.Required)
+		return report, fmt.Errorf("append to %s acked by %d of %d replicas, W=%s needs %d: %s", fileName, len(ok), len(replicas), write, report.Required, strings.Join(errs, "; "))
+	}
+	ackedSeq[fileId] = block.Seq
+	HyDFSLogger.Info("append", "file", fileName, "block", block.Id, "bytes", size, "consistency", write, "acked", len(ok), "replicas", fmt.Sprint(replicas))
+	return report, nil
+}
+
+// keeps a copy of the data of an append no replica applied, to send it again. appendMutex must
+// be held
+func keepPending(fileId string, args *BlockArgs, localPath string) {
+	pending := &pendingAppend{args: *args, copied: true}
+	dataPath, err := copyToTemp(localPath)
+	if err != nil {
+		// the local file has to stay as it is until the block is applied
+		HyDFSLogger.Warn("could not keep a copy of an unapplied append, sending the local file again", "file", args.FileName, "block", args.Block.Id, "err", err)
+		dataPath, pending.copied = localPath, false
+	}
+	pending.dataPath = dataPath
+	unconfirmed[fileId] = pending
+	HyDFSLogger.Warn("append not applied by any replica, it is sent again before the next append", "file", args.FileName, "block", args.Block.Id)
+}
+
+// sends the unapplied append of the file again until a replica applied it. appendMutex must be
+// held
+func confirmPending(replicas []common.MachineId, fileId string) error {
+	pending := unconfirmed[fileId]
+	if pending == nil {
+		return nil
+	}
+	ok, failed := writeReplicas(replicas, 1, "HyDFSReceiver.AppendFile", &pending.args, pending.dataPath)
+	if len(ok) == 0 {
+		errs := make([]string, 0, len(failed))
+		for _, answer := range failed {
+			errs = append(errs, fmt.Sprintf("%s: %v", answer.replica.Ip, answer.err))
+		}
+		return fmt.Errorf("block %s: %s", pending.args.Block.Id, strings.Join(errs, "; "))
+	}
+	appendSeq[fileId] = pending.args.Block.Seq
+	pending.drop()
+	delete(unconfirmed, fileId)
+	HyDFSLogger.Info("unapplied append applied after sending it again", "file", pending.args.FileName, "block", pending.args.Block.Id, "replica", ok[0].replica.Ip)
+	return nil
+}
+
+// copies a local file to a new temporary file
+func copyToTemp(localPath string) (string, error) {
+	in, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp("", "hydfs-append-*")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
@@ -0,0 +1,132 @@
+package hydfs_utils
+
+import (
+	"cs425_g12/common"
+	"fmt"
+	"sync"
+)
+
+// how many replicas have to ack a write (W) or answer a read (R) before the command returns. the
+// default is quorum for both: a read quorum always overlaps the last write quorum, and on top of
+// that a read only returns a replica that has every write this client got acked, so a client
+// always reads its own writes
+type Consistency uint8
+
+const (
+	ConsistencyOne    Consistency = iota // one replica
+	ConsistencyQuorum                    // a majority of the replicas
+	ConsistencyAll                       // every replica
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseConsistency(s string) (Consistency, error) {
+	switch s {
+	case "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	}
+	return ConsistencyQuorum, fmt.Errorf("unknown consistency %q (expected one, quorum or all)", s)
+}
+
+// replicas out of n that have to answer
+func (c Consistency) Required(n int) int {
+	switch c {
+	case ConsistencyOne:
+		return min(1, n)
+	case ConsistencyAll:
+		return n
+	default:
+		return n/2 + 1
+	}
+}
+
+var (
+	writeConsistency = ConsistencyQuorum
+	readConsistency  = ConsistencyQuorum
+	consistencyMutex sync.RWMutex
+)
+
+func SetConsistency(write Consistency, read Consistency) {
+	consistencyMutex.Lock()
+	defer consistencyMutex.Unlock()
+	writeConsistency = write
+	readConsistency = read
+}
+
+func GetConsistency() (write Consistency, read Consistency) {
+	consistencyMutex.RLock()
+	defer consistencyMutex.RUnlock()
+	return writeConsistency, readConsistency
+}
+
+// what a create, append or get did, printed by the CLI after every command
+type OpReport struct {
+	Op          string
+	FileName    string
+	Consistency Consistency
+	Required    int    // replicas that had to ack or answer
+	Answered    int    // replicas that acked the write or answered the read before it returned
+	Replicas    int    // replicas of the file
+	From        string // replica a get read the data from
+	Blocks      int    // blocks of the file a get returned
+}
+
+func (r OpReport) String() string {
+	level := "W"
+	verb := "acked"
+	if r.Op == "get" {
+		level = "R"
+		verb = "answered"
+	}
+	s := fmt.Sprintf("%s %s: %s=%s, %d of %d replicas %s (%d required)", r.Op, r.FileName, level, r.Consistency, r.Answered, r.Replicas, verb, r.Required)
+	if r.From != "" {
+		s += fmt.Sprintf(", read %d blocks from %s", r.Blocks, r.From)
+	}
+	return s
+}
+
+type replicaAnswer struct {
+	replica common.MachineId
+	reply   interface{}
+	err     error
+}
+
+// runs call on every replica in parallel and returns once required of them succeeded or every
+// replica answered. calls that are still running finish in the background, a write they fail to
+// deliver is repaired by the next merge
+func quorumCall(replicas []common.MachineId, required int, call func(replica common.MachineId) (interface{}, error)) (ok []replicaAnswer, failed []replicaAnswer) {
+	answers := make(chan replicaAnswer, len(replicas))
+	for _, replica := range replicas {
+		go func() {
+			reply, err := call(replica)
+			answers <- replicaAnswer{replica: replica, reply: reply, err: err}
+		}()
+	}
+	for range replicas {
+		answer := <-answers
+		if answer.err != nil {
+			failed = append(failed, answer)
+		} else {
+			ok = append(ok, answer)
+		}
+		if required > 0 && len(ok) >= required {
+			break
+		}
+	}
+	return ok, failed
+}
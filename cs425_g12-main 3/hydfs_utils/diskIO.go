@@ -1,22 +1,24 @@
 package hydfs_utils
 
 import (
+	"cs425_g12/logging"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 )
 
-var HyDFSLogger *log.Logger
+var HyDFSLogger = logging.New("hydfs")
 
-// logger file
-func InitializeLogger(machineName string) {
-	logPath := filepath.Join("/home/shared/hydfs/logs", machineName+".log")
-	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+// hydfs keeps its own log file, <machineName>.log in the log directory of the config. appended
+// to and rotated like the membership log
+func InitializeLogger(machineName string, config logging.Config) {
+	config.File = machineName + ".log"
+	sink, err := logging.Open(config)
 	if err != nil {
 		log.Fatalf("could not open log file: %v", err)
 	}
-	HyDFSLogger = log.New(file, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	HyDFSLogger.SetSink(sink)
 }
 
 // init the Hydfs directories
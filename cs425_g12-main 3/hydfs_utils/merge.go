@@ -0,0 +1,148 @@
+package hydfs_utils
+
+import (
+	"context"
+	"cs425_g12/common"
+	"fmt"
+	"time"
+)
+
+// merge makes every replica of a file identical: the blocks of all replicas in canonical order
+// (see canonicalOrder). replicas that report the same digest and are already canonical are left
+// alone, so merging a file whose replicas agree only costs one small rpc per replica
+
+type MergeResult struct {
+	FileName      string
+	Replicas      int
+	AlreadyMerged bool // every replica agreed, nothing was changed
+	Blocks        int  // blocks in the merged file
+	Updated       int  // replicas that were changed
+}
+
+func (r MergeResult) String() string {
+	if r.AlreadyMerged {
+		return fmt.Sprintf("%s: %d replicas already identical (%d blocks)", r.FileName, r.Replicas, r.Blocks)
+	}
+	return fmt.Sprintf("%s: merged %d blocks, updated %d of %d replicas", r.FileName, r.Blocks, r.Updated, r.Replicas)
+}
+
+// merge HyDFSfilename
+func Merge(list *common.MembershipList, fileName string) (MergeResult, error) {
+	result := MergeResult{FileName: fileName}
+	if fileName == "" {
+		return result, fmt.Errorf("usage: merge HyDFSfilename")
+	}
+	replicas := ReplicaSet(list, fileName)
+	if len(replicas) == 0 {
+		return result, fmt.Errorf("no replicas available for %s", fileName)
+	}
+	fileId := FileIdOf(fileName)
+	args := &GetFileArgs{FileName: fileName, FileId: fileId}
+
+	// cheap check first
+	digests := make([]DigestReply, len(replicas))
+	agree := true
+	reachable := 0
+	for i, replica := range replicas {
+		if err := callWithTimeout(replica, "HyDFSReceiver.GetDigest", args, &digests[i], readTimeout); err != nil {
+			agree = false
+			if err.Error() != errFileNotFound {
+				HyDFSLogger.Warn("merge could not reach replica", "file", fileName, "replica", replica.Ip, "err", err)
+				continue
+			}
+		}
+		reachable++
+		if !digests[i].Canonical || digests[i].Digest != digests[0].Digest {
+			agree = false
+		}
+	}
+	result.Replicas = reachable
+	if agree {
+		result.AlreadyMerged = true
+		result.Blocks = digests[0].Blocks
+		return result, nil
+	}
+
+	// collect every block and who has it
+	all := make([]BlockInfo, 0)
+	sources := make(map[string][]common.MachineId)
+	metas := make(map[common.MachineId]*FileMeta)
+	for _, replica := range replicas {
+		var meta FileMeta
+		if err := callWithTimeout(replica, "HyDFSReceiver.GetMeta", args, &meta, readTimeout); err != nil {
+			continue
+		}
+		metas[replica] = &meta
+		for _, block := range append(meta.Blocks, meta.Pending...) {
+			all = append(all, block)
+			sources[block.Id] = append(sources[block.Id], replica)
+		}
+	}
+	if len(metas) == 0 {
+		return result, fmt.Errorf("%s does not exist in HyDFS", fileName)
+	}
+	order, _ := canonicalOrder(all)
+	result.Blocks = len(order)
+
+	target := &FileMeta{Blocks: order}
+	mergeArgs := &MergeArgs{FileName: fileName, FileId: fileId, Order: order, Sources: sources}
+	failed := 0
+	for _, replica := range replicas {
+		if meta, ok := metas[replica]; ok && meta.Canonical() && meta.Digest() == target.Digest() {
+			continue
+		}
+		var reply string
+		if err := callWithTimeout(replica, "HyDFSReceiver.MergeFile", mergeArgs, &reply, readTimeout); err != nil {
+			HyDFSLogger.Warn("merge failed on replica", "file", fileName, "replica", replica.Ip, "err", err)
+			failed++
+			continue
+		}
+		result.Updated++
+	}
+	HyDFSLogger.Info("merge", "file", fileName, "blocks", result.Blocks, "updated", result.Updated, "failed", failed)
+	if failed > 0 {
+		return result, fmt.Errorf("merge of %s failed on %d of %d replicas", fileName, failed, len(replicas))
+	}
+	return result, nil
+}
+
+// merges in the background every interval. every node merges the files it is the first replica
+// of, so each file is merged by one node
+func StartMerger(ctx context.Context, list *common.MembershipList, interval time.Duration) {
+	common.Go(func() {
+		for common.SleepContext(ctx, common.GetClock(), interval) {
+			MergeLocalFiles(list)
+		}
+	})
+}
+
+// one round of the background merger
+func MergeLocalFiles(list *common.MembershipList) {
+	if localStore == nil {
+		return
+	}
+	fileIds, err := localStore.list()
+	if err != nil {
+		HyDFSLogger.Error("could not list local files", "err", err)
+		return
+	}
+	self := common.GetSelf()
+	for _, fileId := range fileIds {
+		meta, err := localStore.meta(fileId)
+		if err != nil {
+			continue
+		}
+		replicas := ReplicaSet(list, meta.FileName)
+		if len(replicas) == 0 || replicas[0].Ip != self.Ip {
+			continue
+		}
+		result, err := Merge(list, meta.FileName)
+		if err != nil {
+			HyDFSLogger.Warn("background merge failed", "file", meta.FileName, "err", err)
+			continue
+		}
+		if !result.AlreadyMerged {
+			HyDFSLogger.Info("background merge", "file", meta.FileName, "blocks", result.Blocks, "updated", result.Updated)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package hydfs_utils
+
+import "cs425_g12/metrics"
+
+// hydfs metrics updated by the background re-replication, rebalancing and scrubbing and the
+// checksum checks
+var (
+	MetricReplicasCopied  = metrics.NewCounterVec("hydfs_rereplication_copies_total", "Replicas created by re-replication, by result (ok, failed).", "result")
+	MetricMissingReplicas = metrics.NewGauge("hydfs_missing_replicas", "Replicas of the files this node repairs that were still missing after the last re-replication pass.")
+	MetricRebalanced      = metrics.NewCounterVec("hydfs_rebalance_files_total", "Files moved by rebalancing after a join, by action (pulled, pull_failed, handed_off).", "action")
+	MetricReplicationLag  = metrics.NewGauge("hydfs_rereplication_lag_seconds", "Time since the oldest member failure whose files are not back at full replication, 0 if none.")
+	MetricCorruptBlocks   = metrics.NewCounterVec("hydfs_corrupt_blocks_total", "Blocks whose data did not match their checksum, by where it was found (write, read, replication, repair, scrub).", "found_by")
+	MetricBlockRepairs    = metrics.NewCounterVec("hydfs_block_repairs_total", "Corrupt blocks of this node fetched again from a healthy replica, by result (ok, failed).", "result")
+	MetricScrubbedBytes   = metrics.NewCounter("hydfs_scrub_bytes_total", "Bytes of stored blocks the scrubber read back and checked.")
+	MetricScrubFindings   = metrics.NewCounterVec("hydfs_scrub_findings_total", "Problems found by the scrubber, by finding (corrupt_block, missing_block, missing_copy, diverged_copy, merged).", "finding")
+	MetricScrubLastPass   = metrics.NewGauge("hydfs_scrub_last_pass_seconds", "Duration of the last scrub pass.")
+)
@@ -0,0 +1,139 @@
+package hydfs_utils
+
+import (
+	"cs425_g12/common"
+)
+
+// rebalancing after a join: a new node takes over the hash range between FindPredecessor and
+// itself, and with it a replica of the files in that range and the two ranges before it. those
+// files are on its successors, which held them before, so the new node pulls every file of its
+// successors that ReplicaSet now puts on it. a node that fell out of a file's replica set keeps
+// its copy until every replica in the set confirmed it has all of its blocks, then deletes it.
+// pulls go through transferThrottle
+
+// one rebalancing pass on this node
+func RebalanceLocalFiles(list *common.MembershipList) {
+	if localStore == nil {
+		return
+	}
+	pulled := pullOwnedFiles(list)
+	handedOff := handOffFiles(list)
+	if pulled > 0 || handedOff > 0 {
+		HyDFSLogger.Info("rebalance pass", "pulled", pulled, "handed_off", handedOff)
+	}
+
+	replicationMutex.Lock()
+	replicationStatus.Pulled += int64(pulled)
+	replicationStatus.HandedOff += int64(handedOff)
+	replicationMutex.Unlock()
+}
+
+// pulls the files of our successors that we replicate now and don't have
+func pullOwnedFiles(list *common.MembershipList) int {
+	self := common.GetSelf()
+	member := list.GetMember(self)
+	if member == nil {
+		return 0
+	}
+	pulled := 0
+	for _, successor := range list.GetSuccessorNodes(member.RingId, ReplicationFactor+1) {
+		if successor.MachineId.Ip == self.Ip || successor.SuspicionState == common.StateFailed {
+			continue
+		}
+		var metas []FileMeta
+		if err := callWithTimeout(successor.MachineId, "HyDFSReceiver.ListFiles", &ListFilesArgs{}, &metas, readTimeout); err != nil {
+			HyDFSLogger.Warn("could not list files of successor", "successor", successor.MachineId.Ip, "err", err)
+			continue
+		}
+		for i := range metas {
+			meta := &metas[i]
+			if _, err := localStore.meta(meta.FileId); err == nil || !inReplicaSet(list, meta.FileName, self) {
+				continue
+			}
+			if err := pullFile(successor.MachineId, meta); err != nil {
+				HyDFSLogger.Warn("could not pull file", "file", meta.FileName, "from", successor.MachineId.Ip, "err", err)
+				MetricRebalanced.With("pull_failed").Inc()
+				continue
+			}
+			HyDFSLogger.Info("pulled file", "file", meta.FileName, "from", successor.MachineId.Ip, "blocks", len(meta.Blocks), "bytes", meta.Size())
+			MetricRebalanced.With("pulled").Inc()
+			pulled++
+		}
+	}
+	return pulled
+}
+
+// copies the applied blocks of meta from source, at the transfer rate
+func pullFile(source common.MachineId, meta *FileMeta) error {
+	sources := []common.MachineId{source}
+	for _, block := range meta.Blocks {
+		if localStore.hasBlockData(meta.FileId, block.Id) {
+			continue
+		}
+		if err := fetchBlock(localStore, meta.FileName, meta.FileId, block, sources, true); err != nil {
+			return err
+		}
+	}
+	return localStore.setOrder(meta.FileName, meta.FileId, meta.Blocks)
+}
+
+// deletes our copy of every file we no longer replicate once its replicas confirmed they have it
+func handOffFiles(list *common.MembershipList) int {
+	fileIds, err := localStore.list()
+	if err != nil {
+		HyDFSLogger.Error("could not list local files", "err", err)
+		return 0
+	}
+	self := common.GetSelf()
+	handedOff := 0
+	for _, fileId := range fileIds {
+		meta, err := localStore.meta(fileId)
+		if err != nil || inReplicaSet(list, meta.FileName, self) || !replicasConfirmed(list, meta) {
+			continue
+		}
+		removed, err := localStore.removeIfDigest(fileId, meta.Digest())
+		if err != nil {
+			HyDFSLogger.Error("could not delete handed off file", "file", meta.FileName, "err", err)
+			continue
+		}
+		if !removed {
+			// the file changed after the replicas confirmed it, the next pass checks again
+			HyDFSLogger.Info("file changed while handing it off", "file", meta.FileName)
+			continue
+		}
+		HyDFSLogger.Info("handed off file", "file", meta.FileName, "replicas", ReplicaSet(list, meta.FileName))
+		MetricRebalanced.With("handed_off").Inc()
+		handedOff++
+	}
+	return handedOff
+}
+
+func inReplicaSet(list *common.MembershipList, fileName string, machine common.MachineId) bool {
+	for _, replica := range ReplicaSet(list, fileName) {
+		if replica.Ip == machine.Ip {
+			return true
+		}
+	}
+	return false
+}
+
+// whether a full replica set has every block of our copy of the file
+func replicasConfirmed(list *common.MembershipList, meta *FileMeta) bool {
+	replicas := ReplicaSet(list, meta.FileName)
+	if len(replicas) < ReplicationFactor {
+		return false
+	}
+	args := &GetFileArgs{FileName: meta.FileName, FileId: meta.FileId}
+	for _, replica := range replicas {
+		var theirs FileMeta
+		if err := callWithTimeout(replica, "HyDFSReceiver.GetMeta", args, &theirs, readTimeout); err != nil {
+			return false
+		}
+		for _, block := range append(meta.Blocks, meta.Pending...) {
+			if !theirs.hasBlock(block.Id) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+package hydfs_utils
+
+import (
+	"context"
+	"cs425_g12/common"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// re-replication: once a member is declared failed, ReplicaSet skips it and the files it held are
+// short of a replica. every node goes through the files it stores and copies each file it is the
+// first holder of (in the current replica set) to the replicas that don't have it. a pass runs
+// right after a failure and then every interval, until every file is back at full replication
+
+// how long a pass waits after a failure or join, so changes that come together are handled in
+// one pass
+var rereplicateSettle = 500 * time.Millisecond
+
+// progress of the re-replication on this node, shown by the replication command
+type ReplicationStatus struct {
+	Passes       int64
+	LastPass     time.Time
+	LastDuration time.Duration
+	Checked      int       // files of the last pass this node is responsible for
+	Short        int       // files of the last pass that were short of replicas
+	Missing      int       // replicas still missing after the last pass
+	Copied       int64     // replicas created since the start
+	Failed       int64     // copies that failed since the start
+	PendingSince time.Time // oldest failure whose files aren't fully replicated yet, zero if none
+	LastFailure  time.Time
+	Pulled       int64 // files pulled after a join since the start
+	HandedOff    int64 // copies deleted after the new replicas confirmed them since the start
+}
+
+// time the oldest unrepaired failure has been waiting
+func (s ReplicationStatus) Lag(now time.Time) time.Duration {
+	if s.PendingSince.IsZero() {
+		return 0
+	}
+	return now.Sub(s.PendingSince)
+}
+
+func (s ReplicationStatus) String() string {
+	if s.Passes == 0 {
+		return "no re-replication pass yet"
+	}
+	out := fmt.Sprintf("last pass %s (took %s): %d files checked, %d short of replicas, %d replicas still missing; %d copied, %d failed, %d pulled, %d handed off since start",
+		s.LastPass.Format("15:04:05.000"), s.LastDuration.Round(time.Millisecond), s.Checked, s.Short, s.Missing, s.Copied, s.Failed, s.Pulled, s.HandedOff)
+	if !s.PendingSince.IsZero() {
+		out += fmt.Sprintf("; lag %s", s.Lag(common.Now()).Round(time.Millisecond))
+	}
+	return out
+}
+
+var (
+	replicationStatus ReplicationStatus
+	replicationMutex  sync.Mutex
+)
+
+func GetReplicationStatus() ReplicationStatus {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	return replicationStatus
+}
+
+// runs a re-replication and a rebalancing pass after every failure and join, and every interval
+func StartRereplicator(ctx context.Context, list *common.MembershipList, interval time.Duration) {
+	trigger := make(chan struct{}, 1)
+	common.OnEvent(func(event common.Event) {
+		switch event.Type {
+		case common.EventMemberFailed:
+			replicationMutex.Lock()
+			replicationStatus.LastFailure = event.Time
+			if replicationStatus.PendingSince.IsZero() {
+				replicationStatus.PendingSince = event.Time
+			}
+			replicationMutex.Unlock()
+		case common.EventMemberJoined:
+		default:
+			return
+		}
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	})
+
+	common.Go(func() {
+		clock := common.GetClock()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+				if !common.SleepContext(ctx, clock, rereplicateSettle) {
+					return
+				}
+			case <-clock.After(interval):
+			}
+			RereplicateLocalFiles(list)
+			RebalanceLocalFiles(list)
+			if localStore != nil {
+				if dropped := localStore.dropStaleUploads(staleUploadAge, common.Now()); dropped > 0 {
+					HyDFSLogger.Info("dropped stale uploads", "uploads", dropped)
+				}
+			}
+		}
+	})
+}
+
+// one pass over the files stored on this node
+func RereplicateLocalFiles(list *common.MembershipList) {
+	if localStore == nil {
+		return
+	}
+	fileIds, err := localStore.list()
+	if err != nil {
+		HyDFSLogger.Error("could not list local files", "err", err)
+		return
+	}
+
+	start := common.Now()
+	checked, short, missing, copied, failed := 0, 0, 0, 0, 0
+	for _, fileId := range fileIds {
+		meta, err := localStore.meta(fileId)
+		if err != nil {
+			continue
+		}
+		targets, responsible := missingReplicas(list, meta)
+		if !responsible {
+			continue
+		}
+		checked++
+		if len(targets) == 0 {
+			continue
+		}
+		short++
+		for _, target := range targets {
+			if err := copyReplica(target, meta); err != nil {
+				HyDFSLogger.Warn("re-replication failed", "file", meta.FileName, "to", target.Ip, "err", err)
+				MetricReplicasCopied.With("failed").Inc()
+				failed++
+				missing++
+				continue
+			}
+			HyDFSLogger.Info("re-replicated", "file", meta.FileName, "to", target.Ip, "blocks", len(meta.Blocks))
+			MetricReplicasCopied.With("ok").Inc()
+			copied++
+		}
+	}
+	now := common.Now()
+
+	replicationMutex.Lock()
+	s := &replicationStatus
+	s.Passes++
+	s.LastPass = start
+	s.LastDuration = now.Sub(start)
+	s.Checked = checked
+	s.Short = short
+	s.Missing = missing
+	s.Copied += int64(copied)
+	s.Failed += int64(failed)
+	if missing == 0 {
+		if !s.PendingSince.IsZero() && short > 0 {
+			HyDFSLogger.Info("files back at full replication", "files", short, "lag", now.Sub(s.PendingSince))
+		}
+		s.PendingSince = time.Time{}
+		if s.LastFailure.After(start) {
+			// failed during the pass, the next pass repairs it
+			s.PendingSince = s.LastFailure
+		}
+	}
+	lag := s.Lag(now)
+	replicationMutex.Unlock()
+
+	MetricMissingReplicas.Set(float64(missing))
+	MetricReplicationLag.Set(lag.Seconds())
+	if short > 0 {
+		HyDFSLogger.Info("re-replication pass", "checked", checked, "short", short, "copied", copied, "failed", failed)
+	}
+}
+
+// replicas of the file that don't have it, and whether this node copies it to them: the first
+// replica that holds the file does, or this node if it holds the file and no replica does
+func missingReplicas(list *common.MembershipList, meta *FileMeta) ([]common.MachineId, bool) {
+	self := common.GetSelf()
+	args := &GetFileArgs{FileName: meta.FileName, FileId: meta.FileId}
+	targets := make([]common.MachineId, 0)
+	selfSeen := false
+	for _, replica := range ReplicaSet(list, meta.FileName) {
+		if replica.Ip == self.Ip {
+			selfSeen = true
+			continue
+		}
+		var reply DigestReply
+		err := callWithTimeout(replica, "HyDFSReceiver.GetDigest", args, &reply, readTimeout)
+		if err == nil {
+			if !selfSeen {
+				// a replica before us has the file and repairs it
+				return nil, false
+			}
+			continue
+		}
+		if err.Error() == errFileNotFound {
+			targets = append(targets, replica)
+		}
+	}
+	return targets, true
+}
+
+// copies our copy of the file to target: target pulls every block from us through MergeFile
+func copyReplica(target common.MachineId, meta *FileMeta) error {
+	self := common.GetSelf()
+	sources := make(map[string][]common.MachineId)
+	for _, block := range meta.Blocks {
+		sources[block.Id] = []common.MachineId{self}
+	}
+	args := &MergeArgs{FileName: meta.FileName, FileId: meta.FileId, Order: meta.Blocks, Sources: sources, Throttled: true}
+	var reply string
+	return callWithTimeout(target, "HyDFSReceiver.MergeFile", args, &reply, writeTimeout+transferThrottle.duration(meta.Size()))
+}
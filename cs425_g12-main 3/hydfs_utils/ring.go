@@ -0,0 +1,48 @@
+package hydfs_utils
+
+import (
+	"crypto/sha1"
+	"cs425_g12/common"
+	"encoding/hex"
+	"net"
+)
+
+// number of replicas of every file
+const ReplicationFactor = 3
+
+// position of a hydfs file on the ring, same hash as the RingId of a member in common.NewMember
+func HashFileName(fileName string) [20]byte {
+	return sha1.Sum([]byte(fileName))
+}
+
+// fileId of a hydfs file, used to store it on the replicas
+func FileIdOf(fileName string) string {
+	hash := HashFileName(fileName)
+	return hex.EncodeToString(hash[:])
+}
+
+// the first ReplicationFactor machines after the file on the ring. failed members and older
+// versions of a machine that is already in the set are skipped
+func ReplicaSet(list *common.MembershipList, fileName string) []common.MachineId {
+	ring := list.GetSortedRing()
+	successors := list.GetSuccessorNodes(HashFileName(fileName), len(ring))
+
+	replicas := make([]common.MachineId, 0, ReplicationFactor)
+	seen := make(map[string]bool)
+	for _, member := range successors {
+		if len(replicas) == ReplicationFactor {
+			break
+		}
+		if member.SuspicionState == common.StateFailed || seen[member.MachineId.Ip] {
+			continue
+		}
+		seen[member.MachineId.Ip] = true
+		replicas = append(replicas, member.MachineId)
+	}
+	return replicas
+}
+
+// address of the hydfs rpc server of a machine
+func rpcAddr(machine common.MachineId) string {
+	return net.JoinHostPort(machine.Ip, rpcPort)
+}
@@ -2,36 +2,36 @@ package hydfs_utils
 
 import (
 	"fmt"
-	"net/rpc"
 )
 
-// sends a local file to another hydfs node over tco
+// sends a local file to another hydfs node over tcp, in chunks, see uploadFile
 func SendFileToNode(targetAddr string, fileId string, localPath string) error {
-	// connect to target rpc server
-	client, err := rpc.Dial("tcp", targetAddr)
+	// the receiver checks what arrived against the checksum
+	sum, _, err := checksumFile(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to connect to HyDFS RPC server at %s: %v", targetAddr, err)
+		return fmt.Errorf("failed to read local file %s: %v", localPath, err)
 	}
-	defer client.Close()
 
-	// read local file into memory
-	data, err := ReadLocalFile(localPath)
+	// stream the file, an interrupted upload continues where it stopped
+	size, err := uploadFile(targetAddr, fileId, localPath)
 	if err != nil {
-		return fmt.Errorf("failed to read local file %s: %v", localPath, err)
+		return fmt.Errorf("failed to send file %s to %s: %v", fileId, targetAddr, err)
 	}
 
-	// make rpc args to send
-	args := &FileTransferArgs{
-		FileId:   fileId,
-		FileData: data,
+	// connect to target rpc server
+	client, err := dialAddr(targetAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to HyDFS RPC server at %s: %v", targetAddr, err)
 	}
+	defer client.Close()
 
-	// make rpc call
+	// move the upload into place
+	args := &StoreUploadArgs{UploadId: fileId, Name: fileId, Size: size, Checksum: sum}
 	var reply string
-	if err := client.Call("HyDFSReceiver.ReceiveFileFromNode", args, &reply); err != nil {
+	if err := callClient(client, "HyDFSReceiver.StoreUpload", args, &reply, writeTimeout); err != nil {
 		return fmt.Errorf("failed to send file %s to %s: %v", fileId, targetAddr, err)
 	}
 
 	HyDFSLogger.Printf("Successfully sent file %s to %s: %s", fileId, targetAddr, reply)
 	return nil
-}
\ No newline at end of file
+}
@@ -1,31 +1,363 @@
 package hydfs_utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"net"
 	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"cs425_g12/common"
 )
 
-type FileTransferArgs struct {
-	FileName string // user facing filename
-	FileId   string // filename is only for user facing functions, every internal function uses fileId
-	FileData []byte // is data sent as raw bytes?
+// a create or append of one block, its data was uploaded before as UploadId
+type BlockArgs struct {
+	FileName string
+	FileId   string
+	Block    BlockInfo
+	UploadId string
+}
+
+type GetFileArgs struct {
+	FileName string
+	FileId   string
+}
+
+type DigestReply struct {
+	Digest    string
+	Canonical bool // blocks in canonical order, nothing pending
+	Blocks    int
+}
+
+// order a merge settled on, with the replicas that have each block
+type MergeArgs struct {
+	FileName  string
+	FileId    string
+	Order     []BlockInfo
+	Sources   map[string][]common.MachineId
+	Throttled bool // a replica transfer, fetched at the transfer rate
 }
 
+type ListFilesArgs struct{}
+
 type HyDFSReceiver struct {
 	DataDir string // directory to store received files
+
+	once  sync.Once
+	store *fileStore
+}
+
+func (r *HyDFSReceiver) files() *fileStore {
+	r.once.Do(func() { r.store = newFileStore(r.DataDir) })
+	return r.store
+}
+
+// port of the hydfs rpc server, the same on every machine
+var rpcPort = "5052"
+
+// files of the receiver started by InitHyDFS, for the background tasks
+var localStore *fileStore
+
+// errors that are sent back over rpc are only strings, callers compare the message
+const (
+	errFileExists   = "file already exists"
+	errFileNotFound = "file not found"
+	errHeldBack     = "append held back until earlier appends of the client arrive" // stored, but not applied
+)
+
+// size of what this node has of an upload, the sender continues from there
+func (r *HyDFSReceiver) UploadOffset(args *UploadOffsetArgs, reply *UploadReply) error {
+	path, err := r.files().uploadPath(args.UploadId)
+	if err != nil {
+		return err
+	}
+	size, err := fileSize(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	reply.Offset = size
+	return nil
+}
+
+// writes one chunk of an upload at its offset
+func (r *HyDFSReceiver) UploadChunk(args *UploadChunkArgs, reply *UploadReply) error {
+	if len(args.Data) > maxChunkSize {
+		return fmt.Errorf("chunk of %d bytes is larger than %d", len(args.Data), maxChunkSize)
+	}
+	if crc32.ChecksumIEEE(args.Data) != args.Checksum {
+		return fmt.Errorf("%s at offset %d of %s", errChunkChecksum, args.Offset, args.UploadId)
+	}
+	path, err := r.files().uploadPath(args.UploadId)
+	if err != nil {
+		return err
+	}
+	offset, err := writeChunk(path, args.Offset, args.Data)
+	if err != nil {
+		return err
+	}
+	reply.Offset = offset
+	return nil
 }
 
-func (r *HyDFSReceiver) ReceiveFileFromNode(args *FileTransferArgs, reply *string) error {
-	destPath := fmt.Sprintf("%s/%s", r.DataDir, args.FileId)
-	if err := WriteLocalFile(destPath, args.FileData); err != nil {
-		return fmt.Errorf("failed to store file %s: %v", args.FileId, err)
+// stores a finished upload as a plain file <name> in the data directory, see SendFileToNode
+func (r *HyDFSReceiver) StoreUpload(args *StoreUploadArgs, reply *string) error {
+	path, err := r.files().uploadPath(args.UploadId)
+	if err != nil {
+		return err
+	}
+	if args.Name == "" || filepath.Base(args.Name) != args.Name {
+		return fmt.Errorf("invalid file name %q", args.Name)
+	}
+	sum, size, err := checksumFile(path)
+	if err != nil {
+		return fmt.Errorf("upload %s is missing: %v", args.UploadId, err)
+	}
+	if size != args.Size || sum != args.Checksum {
+		os.Remove(path)
+		MetricCorruptBlocks.With("write").Inc()
+		return fmt.Errorf("%v: upload %s (%d bytes, expected %d)", errBlockCorrupt, args.UploadId, size, args.Size)
+	}
+	if err := os.Rename(path, filepath.Join(r.DataDir, args.Name)); err != nil {
+		return fmt.Errorf("failed to store file %s: %v", args.Name, err)
+	}
+	*reply = fmt.Sprintf("Stored %s (%d bytes)", args.Name, size) // any go rpc method has to have a reply
+	return nil
+}
+
+// one chunk of a block
+func (r *HyDFSReceiver) ReadChunk(args *ReadChunkArgs, reply *ReadChunkReply) error {
+	file, err := r.files().openBlock(args.FileId, args.BlockId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data := make([]byte, min(args.Length, maxChunkSize))
+	n, err := file.ReadAt(data, args.Offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read block %s: %v", args.BlockId, err)
+	}
+	reply.Data = data[:n]
+	reply.Checksum = crc32.ChecksumIEEE(reply.Data)
+	return nil
+}
+
+// drops the data of an upload that can't become a block
+func (r *HyDFSReceiver) dropUpload(uploadId string) {
+	if path, err := r.files().uploadPath(uploadId); err == nil {
+		os.Remove(path)
+	}
+}
+
+// stores a new hydfs file with its first block, fails if this replica already has it
+func (r *HyDFSReceiver) CreateFile(args *BlockArgs, reply *string) error {
+	path, err := r.files().uploadPath(args.UploadId)
+	if err != nil {
+		return err
+	}
+	if err := r.files().create(args.FileName, args.FileId, args.Block, path); err != nil {
+		r.dropUpload(args.UploadId)
+		if errors.Is(err, errBlockCorrupt) {
+			HyDFSLogger.Warn("upload does not match its checksum", "file", args.FileName, "block", args.Block.Id, "err", err)
+			MetricCorruptBlocks.With("write").Inc()
+		}
+		return err
+	}
+	HyDFSLogger.Info("created file", "file", args.FileName, "fileId", args.FileId, "bytes", args.Block.Size)
+	*reply = fmt.Sprintf("Created %s (%d bytes)", args.FileName, args.Block.Size)
+	return nil
+}
+
+// deletes a file this replica created for a create that failed, unless it was written to since
+func (r *HyDFSReceiver) UndoCreate(args *BlockArgs, reply *string) error {
+	removed, err := r.files().removeCreate(args.FileId, args.Block.Id)
+	if err != nil && err.Error() != errFileNotFound {
+		return err
+	}
+	if !removed {
+		*reply = fmt.Sprintf("Kept %s", args.FileName)
+		return nil
+	}
+	HyDFSLogger.Info("undid create", "file", args.FileName, "fileId", args.FileId)
+	*reply = fmt.Sprintf("Removed %s", args.FileName)
+	return nil
+}
+
+// adds a block to a hydfs file. appends of one client are applied in the order of their seq, an
+// append that overtook an earlier one is held back until the earlier one arrives
+func (r *HyDFSReceiver) AppendFile(args *BlockArgs, reply *string) error {
+	path, err := r.files().uploadPath(args.UploadId)
+	if err != nil {
+		return err
+	}
+	applied, err := r.files().appendBlock(args.FileId, args.Block, path)
+	if err != nil {
+		if err.Error() == errFileNotFound {
+			r.dropUpload(args.UploadId)
+		}
+		if errors.Is(err, errBlockCorrupt) {
+			HyDFSLogger.Warn("upload does not match its checksum", "file", args.FileName, "block", args.Block.Id, "err", err)
+			MetricCorruptBlocks.With("write").Inc()
+			r.dropUpload(args.UploadId)
+		}
+		return err
+	}
+	if !applied {
+		// not an ack, the client must not count data no replica applied
+		HyDFSLogger.Warn("append held back until earlier appends of the client arrive", "file", args.FileName, "block", args.Block.Id)
+		return errors.New(errHeldBack)
+	}
+	HyDFSLogger.Debug("appended block", "file", args.FileName, "block", args.Block.Id, "bytes", args.Block.Size)
+	*reply = fmt.Sprintf("Appended %s (%d bytes)", args.Block.Id, args.Block.Size)
+	return nil
+}
+
+// digest of the replica's blocks, lets a merge skip replicas that already agree
+func (r *HyDFSReceiver) GetDigest(args *GetFileArgs, reply *DigestReply) error {
+	meta, err := r.files().meta(args.FileId)
+	if err != nil {
+		return err
+	}
+	reply.Digest = meta.Digest()
+	reply.Canonical = meta.Canonical()
+	reply.Blocks = len(meta.Blocks) + len(meta.Pending)
+	return nil
+}
+
+func (r *HyDFSReceiver) GetMeta(args *GetFileArgs, reply *FileMeta) error {
+	meta, err := r.files().meta(args.FileId)
+	if err != nil {
+		return err
+	}
+	*reply = *meta
+	return nil
+}
+
+// metadata of every file stored on this replica, a joining node picks the files it now
+// replicates from it
+func (r *HyDFSReceiver) ListFiles(args *ListFilesArgs, reply *[]FileMeta) error {
+	store := r.files()
+	fileIds, err := store.list()
+	if err != nil {
+		return err
+	}
+	for _, fileId := range fileIds {
+		if meta, err := store.meta(fileId); err == nil {
+			*reply = append(*reply, *meta)
+		}
+	}
+	return nil
+}
+
+// pulls the blocks of the merged order this replica is missing from the replicas that have
+// them, then makes the merged order the content of the file
+func (r *HyDFSReceiver) MergeFile(args *MergeArgs, reply *string) error {
+	store := r.files()
+	copied := 0
+	for _, block := range args.Order {
+		if store.hasBlockData(args.FileId, block.Id) {
+			continue
+		}
+		if err := fetchBlock(store, args.FileName, args.FileId, block, args.Sources[block.Id], args.Throttled); err != nil {
+			return fmt.Errorf("merge of %s: %v", args.FileName, err)
+		}
+		copied++
+	}
+	if err := store.setOrder(args.FileName, args.FileId, args.Order); err != nil {
+		return err
+	}
+	HyDFSLogger.Info("merged file", "file", args.FileName, "blocks", len(args.Order), "copied", copied)
+	*reply = fmt.Sprintf("Merged %s, copied %d blocks", args.FileName, copied)
+	return nil
+}
+
+// copies a block from the first source that has it. a download that breaks off continues from
+// the next source where it stopped, one that doesn't match the checksum of the block starts over
+// from the next source, which then repairs the one that sent it
+func fetchBlock(store *fileStore, fileName string, fileId string, block BlockInfo, sources []common.MachineId, throttled bool) error {
+	dest := store.blockPath(fileId, block.Id)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directories for %s: %v", dest, err)
+	}
+	part, err := os.OpenFile(dest+".part", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to store block %s: %v", block.Id, err)
+	}
+	defer part.Close()
+	// resume what an earlier attempt already downloaded
+	info, err := part.Stat()
+	if err != nil {
+		return err
+	}
+	done := min(info.Size(), block.Size)
+
+	corrupt := make([]common.MachineId, 0)
+	for _, source := range sources {
+		if done, err = downloadBlock(rpcAddr(source), fileId, block, part, 0, done, throttled); err != nil {
+			if errors.Is(err, errBlockCorrupt) {
+				corrupt = append(corrupt, source)
+				MetricCorruptBlocks.With("replication").Inc()
+			}
+			HyDFSLogger.Warn("could not fetch block", "file", fileName, "block", block.Id, "from", source.Ip, "at", done, "err", err)
+			continue
+		}
+		if err := part.Truncate(block.Size); err != nil {
+			return err
+		}
+		if err := os.Rename(dest+".part", dest); err != nil {
+			return err
+		}
+		repairReplicas(corrupt, fileName, fileId, block, source)
+		return nil
+	}
+	return fmt.Errorf("no replica could send block %s", block.Id)
+}
+
+// fetches a block again from the sources if this replica's copy doesn't match its checksum. a
+// reader that got a corrupt copy asks for this, the copy is checked first in case the data was
+// corrupted on the way
+func (r *HyDFSReceiver) RepairBlock(args *RepairBlockArgs, reply *string) error {
+	store := r.files()
+	err := store.checkBlock(args.FileId, args.Block)
+	if err == nil {
+		*reply = fmt.Sprintf("Block %s is intact", args.Block.Id)
+		return nil
+	}
+	if !errors.Is(err, errBlockCorrupt) && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	HyDFSLogger.Warn("repairing corrupt block", "file", args.FileName, "block", args.Block.Id, "err", err)
+	MetricCorruptBlocks.With("repair").Inc()
+	if err := repairBlock(store, args.FileName, args.FileId, args.Block, args.Sources); err != nil {
+		return err
+	}
+	*reply = fmt.Sprintf("Repaired %s", args.Block.Id)
+	return nil
+}
+
+// replaces the data of a corrupt or missing block with a copy from the first source that has a
+// good one
+func repairBlock(store *fileStore, fileName string, fileId string, block BlockInfo, sources []common.MachineId) error {
+	if err := store.dropBlock(fileId, block.Id); err != nil {
+		return err
+	}
+	if err := fetchBlock(store, fileName, fileId, block, sources, true); err != nil {
+		MetricBlockRepairs.With("failed").Inc()
+		return fmt.Errorf("repair of block %s: %v", block.Id, err)
 	}
-	*reply = fmt.Sprintf("Stored %s (%d bytes)", args.FileId, len(args.FileData)) // any go rpc method has to have a reply
+	MetricBlockRepairs.With("ok").Inc()
+	HyDFSLogger.Info("repaired block", "file", fileName, "block", block.Id)
 	return nil
 }
 
-func InitHyDFS(port string) error {
+// serves the rpc receiver on port until ctx is cancelled, which closes the listener
+func InitHyDFS(ctx context.Context, port string) error {
+	rpcPort = port
 	if err := InitHyDFSDir(); err != nil {
 		return fmt.Errorf("failed to initialize HyDFS directories: %v", err)
 	}
@@ -35,6 +367,7 @@ func InitHyDFS(port string) error {
 	if err := rpc.Register(receiver); err != nil {
 		return fmt.Errorf("failed to register HyDFSReceiver RPC: %v", err)
 	}
+	localStore = receiver.files()
 
 	// start listening for rpc conn
 	l, err := net.Listen("tcp", ":"+port)
@@ -43,16 +376,23 @@ func InitHyDFS(port string) error {
 	}
 
 	// serve rpc requests in this goroutine
-	go func() {
+	common.Go(func() {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
-				HyDFSLogger.Printf("failed to accept HyDFS RPC connection: %v", err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				HyDFSLogger.Error("failed to accept HyDFS RPC connection", "err", err)
 				continue
 			}
 			go rpc.ServeConn(conn)
 		}
-	}()
+	})
+	common.Go(func() {
+		<-ctx.Done()
+		l.Close()
+	})
 
 	return nil
 }
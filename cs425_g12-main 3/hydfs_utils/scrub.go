@@ -0,0 +1,302 @@
+package hydfs_utils
+
+import (
+	"context"
+	"cs425_g12/common"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// scrubbing: a low priority pass over every file stored on this node. every block is read back at
+// the scrub rate and checked against its checksum, then the file is compared with the copies of
+// the other replicas of its replica set. a corrupt or missing block is fetched again from a
+// replica that has it. when a replica is missing the file or its blocks differ, the first replica
+// that holds the file merges it, which brings every replica to the same blocks. the next pass
+// starts an interval after the last one ended
+
+var scrubThrottle = &throttle{rate: 4 << 20}
+
+// sets how many bytes per second the scrubber reads, 0 turns the limit off
+func SetScrubRate(bytesPerSecond int64) {
+	scrubThrottle.mutex.Lock()
+	defer scrubThrottle.mutex.Unlock()
+	scrubThrottle.rate = bytesPerSecond
+}
+
+func GetScrubRate() int64 {
+	scrubThrottle.mutex.Lock()
+	defer scrubThrottle.mutex.Unlock()
+	return scrubThrottle.rate
+}
+
+// findings of the scrubber on this node, shown by the scrub command
+type ScrubStatus struct {
+	Passes         int64
+	LastPass       time.Time
+	LastDuration   time.Duration
+	Files          int   // files checked in the last pass
+	Blocks         int   // blocks checked in the last pass
+	Bytes          int64 // bytes read in the last pass
+	Corrupt        int   // blocks of the last pass that didn't match their checksum
+	MissingBlocks  int   // blocks of the last pass whose data was gone
+	MissingCopies  int   // copies of files the other replicas of the last pass didn't have
+	Diverged       int   // copies of files of the last pass whose blocks differed from ours
+	Repaired       int64 // blocks fetched again since the start
+	RepairFailed   int64 // blocks that could not be fetched again since the start
+	Merged         int64 // files merged because their replicas disagreed since the start
+	RunningSince   time.Time
+	RunningChecked int // files checked so far in the running pass
+}
+
+func (s ScrubStatus) String() string {
+	out := ""
+	if !s.RunningSince.IsZero() {
+		out = fmt.Sprintf("pass running since %s, %d files checked; ", s.RunningSince.Format("15:04:05.000"), s.RunningChecked)
+	}
+	if s.Passes == 0 {
+		return out + "no scrub pass finished yet"
+	}
+	return out + fmt.Sprintf("last pass %s (took %s): %d files, %d blocks, %d bytes checked, %d corrupt, %d missing blocks, %d copies missing on other replicas, %d diverged; %d repaired, %d repairs failed, %d merged since start",
+		s.LastPass.Format("15:04:05.000"), s.LastDuration.Round(time.Millisecond), s.Files, s.Blocks, s.Bytes, s.Corrupt, s.MissingBlocks, s.MissingCopies, s.Diverged, s.Repaired, s.RepairFailed, s.Merged)
+}
+
+var (
+	scrubStatus ScrubStatus
+	scrubMutex  sync.Mutex
+)
+
+func GetScrubStatus() ScrubStatus {
+	scrubMutex.Lock()
+	defer scrubMutex.Unlock()
+	return scrubStatus
+}
+
+// runs a scrub pass every interval
+func StartScrubber(ctx context.Context, list *common.MembershipList, interval time.Duration) {
+	common.Go(func() {
+		for common.SleepContext(ctx, common.GetClock(), interval) {
+			ScrubLocalFiles(ctx, list)
+		}
+	})
+}
+
+// what the scrub of one file found
+type scrubResult struct {
+	blocks        int
+	bytes         int64
+	corrupt       int
+	missingBlocks int
+	missingCopies int
+	diverged      int
+	repaired      int
+	repairFailed  int
+	merged        bool // the replicas disagreed and we merged the file
+}
+
+// one pass over the files stored on this node, stops early when ctx is cancelled
+func ScrubLocalFiles(ctx context.Context, list *common.MembershipList) {
+	if localStore == nil {
+		return
+	}
+	fileIds, err := localStore.list()
+	if err != nil {
+		HyDFSLogger.Error("could not list local files", "err", err)
+		return
+	}
+
+	start := common.Now()
+	scrubMutex.Lock()
+	scrubStatus.RunningSince = start
+	scrubStatus.RunningChecked = 0
+	scrubMutex.Unlock()
+
+	var total scrubResult
+	files := 0
+	for _, fileId := range fileIds {
+		if ctx.Err() != nil {
+			break
+		}
+		meta, err := localStore.meta(fileId)
+		if err != nil {
+			continue
+		}
+		result := scrubFile(list, meta)
+		files++
+		total.blocks += result.blocks
+		total.bytes += result.bytes
+		total.corrupt += result.corrupt
+		total.missingBlocks += result.missingBlocks
+		total.missingCopies += result.missingCopies
+		total.diverged += result.diverged
+		total.repaired += result.repaired
+		total.repairFailed += result.repairFailed
+		if result.merged {
+			MetricScrubFindings.With("merged").Inc()
+		}
+
+		scrubMutex.Lock()
+		scrubStatus.RunningChecked = files
+		if result.merged {
+			scrubStatus.Merged++
+		}
+		scrubMutex.Unlock()
+	}
+	now := common.Now()
+
+	scrubMutex.Lock()
+	s := &scrubStatus
+	s.Passes++
+	s.LastPass = start
+	s.LastDuration = now.Sub(start)
+	s.Files = files
+	s.Blocks = total.blocks
+	s.Bytes = total.bytes
+	s.Corrupt = total.corrupt
+	s.MissingBlocks = total.missingBlocks
+	s.MissingCopies = total.missingCopies
+	s.Diverged = total.diverged
+	s.Repaired += int64(total.repaired)
+	s.RepairFailed += int64(total.repairFailed)
+	s.RunningSince = time.Time{}
+	s.RunningChecked = 0
+	scrubMutex.Unlock()
+
+	MetricScrubLastPass.Set(now.Sub(start).Seconds())
+	found := total.corrupt + total.missingBlocks + total.missingCopies + total.diverged
+	if found > 0 {
+		HyDFSLogger.Warn("scrub pass", "files", files, "blocks", total.blocks, "corrupt", total.corrupt, "missing_blocks", total.missingBlocks,
+			"missing_copies", total.missingCopies, "diverged", total.diverged, "repaired", total.repaired, "repair_failed", total.repairFailed)
+	} else {
+		HyDFSLogger.Debug("scrub pass", "files", files, "blocks", total.blocks, "bytes", total.bytes, "took", now.Sub(start))
+	}
+}
+
+// checks our copy of a file and compares it with the other replicas, repairs what it can
+func scrubFile(list *common.MembershipList, meta *FileMeta) scrubResult {
+	var result scrubResult
+	bad := make([]BlockInfo, 0)
+	for _, block := range append(meta.Blocks, meta.Pending...) {
+		result.blocks++
+		n, err := scrubBlock(meta.FileId, block)
+		result.bytes += n
+		MetricScrubbedBytes.Add(float64(n))
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, fs.ErrNotExist):
+			result.missingBlocks++
+			MetricScrubFindings.With("missing_block").Inc()
+		case errors.Is(err, errBlockCorrupt):
+			result.corrupt++
+			MetricScrubFindings.With("corrupt_block").Inc()
+			MetricCorruptBlocks.With("scrub").Inc()
+		default:
+			HyDFSLogger.Warn("scrub could not read block", "file", meta.FileName, "block", block.Id, "err", err)
+			continue
+		}
+		HyDFSLogger.Warn("scrub found a bad block", "file", meta.FileName, "block", block.Id, "err", err)
+		bad = append(bad, block)
+	}
+
+	// the copies of the other replicas
+	self := common.GetSelf()
+	args := &GetFileArgs{FileName: meta.FileName, FileId: meta.FileId}
+	metas := make(map[common.MachineId]*FileMeta)
+	inSet, selfFirst := false, true
+	for _, replica := range ReplicaSet(list, meta.FileName) {
+		if replica.Ip == self.Ip {
+			inSet = true
+			continue
+		}
+		var other FileMeta
+		if err := callWithTimeout(replica, "HyDFSReceiver.GetMeta", args, &other, readTimeout); err != nil {
+			if err.Error() == errFileNotFound {
+				result.missingCopies++
+				MetricScrubFindings.With("missing_copy").Inc()
+				HyDFSLogger.Warn("scrub found a replica without the file", "file", meta.FileName, "replica", replica.Ip)
+			}
+			continue
+		}
+		if !inSet {
+			// a replica before us holds the file and merges it
+			selfFirst = false
+		}
+		metas[replica] = &other
+		if other.Digest() != meta.Digest() {
+			result.diverged++
+			MetricScrubFindings.With("diverged_copy").Inc()
+			HyDFSLogger.Info("scrub found a replica with other blocks", "file", meta.FileName, "replica", replica.Ip, "blocks", len(other.Blocks)+len(other.Pending), "ours", len(meta.Blocks)+len(meta.Pending))
+		}
+	}
+
+	// fetch bad blocks again from the replicas that have them, unless the file was handed off
+	// in the meantime
+	if _, err := localStore.meta(meta.FileId); err != nil {
+		return result
+	}
+	for _, block := range bad {
+		sources := make([]common.MachineId, 0)
+		for replica, other := range metas {
+			if other.hasBlock(block.Id) {
+				sources = append(sources, replica)
+			}
+		}
+		if len(sources) == 0 {
+			HyDFSLogger.Error("no replica has block to repair it from", "file", meta.FileName, "block", block.Id)
+			result.repairFailed++
+			continue
+		}
+		if err := repairBlock(localStore, meta.FileName, meta.FileId, block, sources); err != nil {
+			HyDFSLogger.Warn("scrub repair failed", "file", meta.FileName, "block", block.Id, "err", err)
+			result.repairFailed++
+			continue
+		}
+		result.repaired++
+	}
+
+	// replicas that are missing the file or disagree are merged by the first replica that holds it
+	if (result.missingCopies > 0 || result.diverged > 0) && inSet && selfFirst {
+		merged, err := Merge(list, meta.FileName)
+		if err != nil {
+			HyDFSLogger.Warn("scrub merge failed", "file", meta.FileName, "err", err)
+		} else {
+			result.merged = true
+			HyDFSLogger.Info("scrub merged file", "file", meta.FileName, "blocks", merged.Blocks, "updated", merged.Updated)
+		}
+	}
+	return result
+}
+
+// reads a block back at the scrub rate and checks it, returns the bytes read
+func scrubBlock(fileId string, block BlockInfo) (int64, error) {
+	file, err := os.Open(localStore.blockPath(fileId, block.Id))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := &scrubReader{r: file}
+	err = checkContent(reader, info.Size(), block)
+	return reader.n, err
+}
+
+// reader that waits for the scrub rate
+type scrubReader struct {
+	r io.Reader
+	n int64
+}
+
+func (s *scrubReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	scrubThrottle.wait(int64(n))
+	return n, err
+}
@@ -0,0 +1,458 @@
+package hydfs_utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// on disk layout of a replica: every hydfs file is a directory named by its fileId with
+// meta.json and one file per block in blocks/. the create is the first block, every append adds
+// one. the content of the file is its applied blocks in order. uploads in progress are in
+// .uploads/
+
+// one create or append
+type BlockInfo struct {
+	Id        string // <client>_<seq>, unique within the file
+	Client    string // client that wrote the block, see ClientId
+	Seq       uint64 // 0 for the create, then 1, 2, ... for the appends of this client
+	Timestamp int64  // clock of the client, increasing for every block of the client
+	Size      int64
+	Checksum  string // sha256 of the data, hex, see checksum.go
+}
+
+type FileMeta struct {
+	FileName string
+	FileId   string
+	Blocks   []BlockInfo // applied blocks in the order of the file
+	Pending  []BlockInfo // appends that arrived before an earlier append of the same client
+}
+
+// blocks of a client are applied in seq order: an append is held back until the ones before it
+// arrived
+func (m *FileMeta) lastSeq(client string) (uint64, bool) {
+	var last uint64
+	found := false
+	for _, block := range m.Blocks {
+		if block.Client == client && (!found || block.Seq > last) {
+			last = block.Seq
+			found = true
+		}
+	}
+	return last, found
+}
+
+func (m *FileMeta) hasBlock(id string) bool {
+	for _, block := range m.Blocks {
+		if block.Id == id {
+			return true
+		}
+	}
+	for _, block := range m.Pending {
+		if block.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// moves pending blocks that are next in line for their client into the applied blocks
+func (m *FileMeta) applyPending() {
+	for applied := true; applied; {
+		applied = false
+		for i, block := range m.Pending {
+			last, found := m.lastSeq(block.Client)
+			if (found && block.Seq == last+1) || (!found && block.Seq <= 1) {
+				m.Blocks = append(m.Blocks, block)
+				m.Pending = append(m.Pending[:i], m.Pending[i+1:]...)
+				applied = true
+				break
+			}
+		}
+	}
+}
+
+// whether this copy of the file is newer than other: blocks are only ever added, so the copy with
+// more applied blocks is newer, on a tie the one whose last block was written later
+func (m *FileMeta) newerThan(other *FileMeta) bool {
+	if len(m.Blocks) != len(other.Blocks) {
+		return len(m.Blocks) > len(other.Blocks)
+	}
+	return len(m.Blocks) > 0 && m.Blocks[len(m.Blocks)-1].Timestamp > other.Blocks[len(other.Blocks)-1].Timestamp
+}
+
+// whether the copy has every block of client up to seq applied
+func (m *FileMeta) hasWritesOf(client string, seq uint64) bool {
+	last, found := m.lastSeq(client)
+	return found && last >= seq
+}
+
+func (m *FileMeta) Size() int64 {
+	var size int64
+	for _, block := range m.Blocks {
+		size += block.Size
+	}
+	return size
+}
+
+// files stored on this replica
+type fileStore struct {
+	dir   string
+	mutex sync.Mutex // one file is changed at a time
+}
+
+func newFileStore(dir string) *fileStore {
+	return &fileStore{dir: dir}
+}
+
+func (s *fileStore) fileDir(fileId string) string {
+	return filepath.Join(s.dir, fileId)
+}
+
+func (s *fileStore) blockPath(fileId string, blockId string) string {
+	return filepath.Join(s.dir, fileId, "blocks", blockId)
+}
+
+// where an upload is stored until a create or append moves it into a file. the id comes from
+// the sender, it must not leave the upload directory
+func (s *fileStore) uploadPath(uploadId string) (string, error) {
+	if uploadId == "" || filepath.Base(uploadId) != uploadId || strings.HasPrefix(uploadId, ".") {
+		return "", fmt.Errorf("invalid upload id %q", uploadId)
+	}
+	return filepath.Join(s.dir, ".uploads", uploadId+".part"), nil
+}
+
+// deletes uploads nothing was written to for maxAge, their sender gave up on them
+func (s *fileStore) dropStaleUploads(maxAge time.Duration, now time.Time) int {
+	entries, err := os.ReadDir(filepath.Join(s.dir, ".uploads"))
+	if err != nil {
+		return 0
+	}
+	dropped := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		if os.Remove(filepath.Join(s.dir, ".uploads", entry.Name())) == nil {
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// moves a downloaded or uploaded block into place
+func moveBlock(from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return fmt.Errorf("failed to create directories for %s: %v", to, err)
+	}
+	if err := os.Rename(from, to); err != nil {
+		return fmt.Errorf("failed to store block: %v", err)
+	}
+	return nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *fileStore) readMeta(fileId string) (*FileMeta, error) {
+	data, err := os.ReadFile(filepath.Join(s.fileDir(fileId), "meta.json"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.New(errFileNotFound)
+		}
+		return nil, fmt.Errorf("failed to read metadata of %s: %v", fileId, err)
+	}
+	var meta FileMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("corrupt metadata of %s: %v", fileId, err)
+	}
+	return &meta, nil
+}
+
+// replaces meta.json through a rename, a crash leaves either the old or the new version
+func (s *fileStore) writeMeta(meta *FileMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.fileDir(meta.FileId), "meta.json")
+	if err := WriteLocalFile(path+".tmp", data); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// stores a new file with its first block, the data of the block is the file at dataPath and has
+// to match the block. fails if the file exists
+func (s *fileStore) create(fileName string, fileId string, block BlockInfo, dataPath string) error {
+	// checked before taking the lock, hashing a large upload would hold up every other write
+	if err := checkData(dataPath, block); err != nil {
+		return fmt.Errorf("data of %s: %w", fileName, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Mkdir(s.fileDir(fileId), 0755); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return errors.New(errFileExists)
+		}
+		return fmt.Errorf("failed to create %s: %v", fileName, err)
+	}
+	if err := moveBlock(dataPath, s.blockPath(fileId, block.Id)); err != nil {
+		os.RemoveAll(s.fileDir(fileId))
+		return err
+	}
+	meta := &FileMeta{FileName: fileName, FileId: fileId, Blocks: []BlockInfo{block}}
+	if err := s.writeMeta(meta); err != nil {
+		os.RemoveAll(s.fileDir(fileId))
+		return err
+	}
+	return nil
+}
+
+// adds a block to an existing file, the data of the block is the file at dataPath and has to
+// match the block. a block that is already there is ignored, so a retried append is applied once.
+// returns false if the block is held back
+func (s *fileStore) appendBlock(fileId string, block BlockInfo, dataPath string) (bool, error) {
+	// checked before taking the lock like in create
+	if err := checkData(dataPath, block); err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	meta, err := s.readMeta(fileId)
+	if err != nil {
+		return false, err
+	}
+	if meta.hasBlock(block.Id) {
+		os.Remove(dataPath)
+		return !containsBlock(meta.Pending, block.Id), nil
+	}
+
+	if err := moveBlock(dataPath, s.blockPath(fileId, block.Id)); err != nil {
+		return false, err
+	}
+	meta.Pending = append(meta.Pending, block)
+	meta.applyPending()
+	if err := s.writeMeta(meta); err != nil {
+		return false, err
+	}
+	return !containsBlock(meta.Pending, block.Id), nil
+}
+
+func containsBlock(blocks []BlockInfo, id string) bool {
+	for _, block := range blocks {
+		if block.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical order of a set of blocks: the create first, then the appends by timestamp, client and
+// seq. the timestamps of a client increase with its seq, so its appends keep their order, and
+// replicas with the same blocks end up with the same file. blocks after a gap of their client
+// stay pending
+func canonicalOrder(blocks []BlockInfo) ([]BlockInfo, []BlockInfo) {
+	unique := make(map[string]BlockInfo)
+	for _, block := range blocks {
+		unique[block.Id] = block
+	}
+	sorted := make([]BlockInfo, 0, len(unique))
+	for _, block := range unique {
+		sorted = append(sorted, block)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if (a.Seq == 0) != (b.Seq == 0) {
+			return a.Seq == 0
+		}
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		return a.Seq < b.Seq
+	})
+
+	// the appends of a client that follow each other without a gap
+	seqs := make(map[string][]uint64)
+	for _, block := range sorted {
+		seqs[block.Client] = append(seqs[block.Client], block.Seq)
+	}
+	contiguous := make(map[string]uint64)
+	for client, list := range seqs {
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		next := uint64(1)
+		if list[0] == 0 {
+			next = 0
+		}
+		for _, seq := range list {
+			if seq != next {
+				break
+			}
+			next++
+		}
+		contiguous[client] = next // first missing seq
+	}
+
+	ordered := make([]BlockInfo, 0, len(sorted))
+	pending := make([]BlockInfo, 0)
+	for _, block := range sorted {
+		if block.Seq < contiguous[block.Client] {
+			ordered = append(ordered, block)
+		} else {
+			pending = append(pending, block)
+		}
+	}
+	return ordered, pending
+}
+
+func blockIds(blocks []BlockInfo) []string {
+	ids := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		ids = append(ids, block.Id)
+	}
+	return ids
+}
+
+// digest of the blocks of a file and their order, replicas with the same digest are identical
+func (m *FileMeta) Digest() string {
+	hash := sha1.New()
+	hash.Write([]byte(strings.Join(blockIds(m.Blocks), "\n")))
+	hash.Write([]byte("|"))
+	hash.Write([]byte(strings.Join(blockIds(m.Pending), "\n")))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// whether the blocks are in canonical order with nothing pending
+func (m *FileMeta) Canonical() bool {
+	if len(m.Pending) > 0 {
+		return false
+	}
+	ordered, _ := canonicalOrder(m.Blocks)
+	for i := range ordered {
+		if ordered[i].Id != m.Blocks[i].Id {
+			return false
+		}
+	}
+	return len(ordered) == len(m.Blocks)
+}
+
+func (s *fileStore) meta(fileId string) (*FileMeta, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.readMeta(fileId)
+}
+
+func (s *fileStore) openBlock(fileId string, blockId string) (*os.File, error) {
+	file, err := os.Open(s.blockPath(fileId, blockId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block %s: %v", blockId, err)
+	}
+	return file, nil
+}
+
+func (s *fileStore) hasBlockData(fileId string, blockId string) bool {
+	_, err := os.Stat(s.blockPath(fileId, blockId))
+	return err == nil
+}
+
+// makes order the content of the file, every other block this replica has stays pending. the
+// data of every block in order must be stored. creates the file if this replica didn't have it
+func (s *fileStore) setOrder(fileName string, fileId string, order []BlockInfo) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, block := range order {
+		if _, err := os.Stat(s.blockPath(fileId, block.Id)); err != nil {
+			return fmt.Errorf("block %s of %s is missing", block.Id, fileName)
+		}
+	}
+
+	meta, err := s.readMeta(fileId)
+	if err != nil {
+		if err.Error() != errFileNotFound {
+			return err
+		}
+		meta = &FileMeta{FileName: fileName, FileId: fileId}
+	}
+	inOrder := make(map[string]bool)
+	for _, block := range order {
+		inOrder[block.Id] = true
+	}
+	pending := make([]BlockInfo, 0)
+	for _, block := range append(meta.Blocks, meta.Pending...) {
+		if !inOrder[block.Id] {
+			pending = append(pending, block)
+		}
+	}
+	meta.Blocks = append([]BlockInfo(nil), order...)
+	meta.Pending = pending
+	meta.applyPending()
+	return s.writeMeta(meta)
+}
+
+// deletes the file if it holds nothing but the create block, returns whether it did
+func (s *fileStore) removeCreate(fileId string, blockId string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	meta, err := s.readMeta(fileId)
+	if err != nil {
+		return false, err
+	}
+	if len(meta.Blocks) != 1 || meta.Blocks[0].Id != blockId || len(meta.Pending) > 0 {
+		return false, nil
+	}
+	return true, os.RemoveAll(s.fileDir(fileId))
+}
+
+// deletes this replica's copy of a file, once the file is stored on the replicas that own it now.
+// the copy is only deleted while its blocks still have digest, so a block written after the
+// replicas confirmed the file is not lost. returns whether it deleted the copy
+func (s *fileStore) removeIfDigest(fileId string, digest string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	meta, err := s.readMeta(fileId)
+	if err != nil {
+		return false, err
+	}
+	if meta.Digest() != digest {
+		return false, nil
+	}
+	return true, os.RemoveAll(s.fileDir(fileId))
+}
+
+// fileIds of every file stored here
+func (s *fileStore) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	fileIds := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			fileIds = append(fileIds, entry.Name())
+		}
+	}
+	return fileIds, nil
+}
@@ -0,0 +1,251 @@
+package hydfs_utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// block seq of client, written at timestamp, with the checksum of blockData
+func testBlock(client string, seq uint64, timestamp int64) BlockInfo {
+	id := fmt.Sprintf("%s_%d", client, seq)
+	data := blockData(id)
+	sum, _ := checksumOf(strings.NewReader(data))
+	return BlockInfo{Id: id, Client: client, Seq: seq, Timestamp: timestamp, Size: int64(len(data)), Checksum: sum}
+}
+
+func blockData(id string) string {
+	return "data of " + id
+}
+
+// writes the data of block to a new file that create or appendBlock can move into the store
+func writeBlockData(t *testing.T, block BlockInfo) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), block.Id)
+	if err := os.WriteFile(path, []byte(blockData(block.Id)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// a store with a file created by the first block and the other blocks appended in the given order
+func storeWith(t *testing.T, blocks ...BlockInfo) *fileStore {
+	t.Helper()
+	store := newFileStore(t.TempDir())
+	if err := store.create("file", "fileid", blocks[0], writeBlockData(t, blocks[0])); err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks[1:] {
+		if _, err := store.appendBlock("fileid", block, writeBlockData(t, block)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestCanonicalOrderIgnoresArrivalOrder(t *testing.T) {
+	create := testBlock("a", 0, 1)
+	a1, a2 := testBlock("a", 1, 5), testBlock("a", 2, 7)
+	b1, b2 := testBlock("b", 1, 3), testBlock("b", 2, 6)
+	c1 := testBlock("c", 1, 5) // same timestamp as a1, ordered by client
+	want := []string{"a_0", "b_1", "a_1", "c_1", "b_2", "a_2"}
+
+	tests := []struct {
+		name    string
+		arrival []BlockInfo
+	}{
+		{"in order", []BlockInfo{create, b1, a1, c1, b2, a2}},
+		{"reversed", []BlockInfo{a2, b2, c1, a1, b1, create}},
+		{"client by client", []BlockInfo{create, a1, a2, b1, b2, c1}},
+		{"create last", []BlockInfo{c1, b1, a2, b2, a1, create}},
+	}
+	var digest string
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ordered, pending := canonicalOrder(test.arrival)
+			if got := blockIds(ordered); !reflect.DeepEqual(got, want) {
+				t.Fatalf("order = %v, want %v", got, want)
+			}
+			if len(pending) != 0 {
+				t.Fatalf("pending = %v, want none", blockIds(pending))
+			}
+			meta := FileMeta{Blocks: ordered, Pending: pending}
+			if digest == "" {
+				digest = meta.Digest()
+			} else if meta.Digest() != digest {
+				t.Fatalf("digest %s differs from the one of the first arrival order %s", meta.Digest(), digest)
+			}
+			if !meta.Canonical() {
+				t.Fatalf("blocks in canonical order are not canonical")
+			}
+		})
+	}
+}
+
+func TestCanonicalOrderPending(t *testing.T) {
+	create := testBlock("a", 0, 1)
+	tests := []struct {
+		name        string
+		blocks      []BlockInfo
+		wantOrdered []string
+		wantPending []string
+	}{
+		{
+			name:        "gap in a client's seq",
+			blocks:      []BlockInfo{create, testBlock("b", 1, 2), testBlock("b", 3, 4), testBlock("b", 4, 5)},
+			wantOrdered: []string{"a_0", "b_1"},
+			wantPending: []string{"b_3", "b_4"},
+		},
+		{
+			name:        "first append missing",
+			blocks:      []BlockInfo{create, testBlock("b", 2, 3), testBlock("c", 1, 4)},
+			wantOrdered: []string{"a_0", "c_1"},
+			wantPending: []string{"b_2"},
+		},
+		{
+			name:        "repeated block",
+			blocks:      []BlockInfo{create, testBlock("b", 1, 2), testBlock("b", 1, 2), create},
+			wantOrdered: []string{"a_0", "b_1"},
+			wantPending: []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ordered, pending := canonicalOrder(test.blocks)
+			if got := blockIds(ordered); !reflect.DeepEqual(got, test.wantOrdered) {
+				t.Errorf("order = %v, want %v", got, test.wantOrdered)
+			}
+			if got := blockIds(pending); !reflect.DeepEqual(got, test.wantPending) {
+				t.Errorf("pending = %v, want %v", got, test.wantPending)
+			}
+		})
+	}
+}
+
+func TestApplyPending(t *testing.T) {
+	create := testBlock("a", 0, 1)
+	tests := []struct {
+		name        string
+		pending     []BlockInfo
+		wantBlocks  []string
+		wantPending []string
+	}{
+		{"next in line", []BlockInfo{testBlock("a", 1, 2)}, []string{"a_0", "a_1"}, []string{}},
+		{"out of order", []BlockInfo{testBlock("a", 3, 4), testBlock("a", 2, 3), testBlock("a", 1, 2)}, []string{"a_0", "a_1", "a_2", "a_3"}, []string{}},
+		{"gap stays pending", []BlockInfo{testBlock("a", 1, 2), testBlock("a", 3, 4)}, []string{"a_0", "a_1"}, []string{"a_3"}},
+		{"first append of a new client", []BlockInfo{testBlock("b", 2, 3), testBlock("b", 1, 2)}, []string{"a_0", "b_1", "b_2"}, []string{}},
+		{"new client after a gap", []BlockInfo{testBlock("b", 2, 3)}, []string{"a_0"}, []string{"b_2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta := FileMeta{Blocks: []BlockInfo{create}, Pending: append([]BlockInfo{}, test.pending...)}
+			meta.applyPending()
+			if got := blockIds(meta.Blocks); !reflect.DeepEqual(got, test.wantBlocks) {
+				t.Errorf("blocks = %v, want %v", got, test.wantBlocks)
+			}
+			if got := blockIds(meta.Pending); !reflect.DeepEqual(got, test.wantPending) {
+				t.Errorf("pending = %v, want %v", got, test.wantPending)
+			}
+		})
+	}
+}
+
+func TestAppendBlockAppliesRepeatedBlockOnce(t *testing.T) {
+	create, a1, a3 := testBlock("a", 0, 1), testBlock("a", 1, 2), testBlock("a", 3, 4)
+	tests := []struct {
+		name        string
+		block       BlockInfo
+		wantApplied bool
+		wantBlocks  []string
+		wantPending []string
+	}{
+		{"applied block", a1, true, []string{"a_0", "a_1"}, []string{"a_3"}},
+		{"held back block", a3, false, []string{"a_0", "a_1"}, []string{"a_3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := storeWith(t, create, a1, a3)
+			applied, err := store.appendBlock("fileid", test.block, writeBlockData(t, test.block))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied != test.wantApplied {
+				t.Errorf("applied = %v, want %v", applied, test.wantApplied)
+			}
+			meta, err := store.meta("fileid")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := blockIds(meta.Blocks); !reflect.DeepEqual(got, test.wantBlocks) {
+				t.Errorf("blocks = %v, want %v", got, test.wantBlocks)
+			}
+			if got := blockIds(meta.Pending); !reflect.DeepEqual(got, test.wantPending) {
+				t.Errorf("pending = %v, want %v", got, test.wantPending)
+			}
+		})
+	}
+}
+
+func TestSetOrder(t *testing.T) {
+	create := testBlock("a", 0, 1)
+	a1, a2 := testBlock("a", 1, 3), testBlock("a", 2, 5)
+	b1, b3 := testBlock("b", 1, 2), testBlock("b", 3, 6)
+	tests := []struct {
+		name        string
+		stored      []BlockInfo // create first, then the appends in arrival order
+		order       []BlockInfo
+		wantBlocks  []string
+		wantPending []string
+	}{
+		{
+			name:        "blocks reordered",
+			stored:      []BlockInfo{create, a1, b1},
+			order:       []BlockInfo{create, b1, a1},
+			wantBlocks:  []string{"a_0", "b_1", "a_1"},
+			wantPending: []string{},
+		},
+		{
+			name:        "extra block moves after the order",
+			stored:      []BlockInfo{create, b1, a1, a2},
+			order:       []BlockInfo{create, a1, a2},
+			wantBlocks:  []string{"a_0", "a_1", "a_2", "b_1"},
+			wantPending: []string{},
+		},
+		{
+			name:        "extra block after a gap stays pending",
+			stored:      []BlockInfo{create, a1, b3, a2},
+			order:       []BlockInfo{create, a1},
+			wantBlocks:  []string{"a_0", "a_1", "a_2"},
+			wantPending: []string{"b_3"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := storeWith(t, test.stored...)
+			if err := store.setOrder("file", "fileid", test.order); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := store.meta("fileid")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := blockIds(meta.Blocks); !reflect.DeepEqual(got, test.wantBlocks) {
+				t.Errorf("blocks = %v, want %v", got, test.wantBlocks)
+			}
+			if got := blockIds(meta.Pending); !reflect.DeepEqual(got, test.wantPending) {
+				t.Errorf("pending = %v, want %v", got, test.wantPending)
+			}
+		})
+	}
+}
+
+func TestSetOrderNeedsEveryBlock(t *testing.T) {
+	create, a1 := testBlock("a", 0, 1), testBlock("a", 1, 2)
+	store := storeWith(t, create)
+	if err := store.setOrder("file", "fileid", []BlockInfo{create, a1}); err == nil {
+		t.Fatal("set an order with a block the replica doesn't have")
+	}
+}
@@ -0,0 +1,61 @@
+package hydfs_utils
+
+import (
+	"cs425_g12/common"
+	"sync"
+	"time"
+)
+
+// limits the rate at which this node pulls replicas from other nodes, so re-replication and
+// rebalancing after a join don't saturate the network. every block waits for its turn before it
+// is fetched, concurrent transfers share the rate
+type throttle struct {
+	mutex sync.Mutex
+	rate  int64     // bytes per second, 0 is unlimited
+	next  time.Time // when the bytes handed out so far are through
+}
+
+var transferThrottle = &throttle{rate: 20 << 20}
+
+// sets the rate of replica transfers into this node in bytes per second, 0 turns the limit off
+func SetTransferRate(bytesPerSecond int64) {
+	transferThrottle.mutex.Lock()
+	defer transferThrottle.mutex.Unlock()
+	transferThrottle.rate = bytesPerSecond
+}
+
+func GetTransferRate() int64 {
+	transferThrottle.mutex.Lock()
+	defer transferThrottle.mutex.Unlock()
+	return transferThrottle.rate
+}
+
+// time size bytes take at the rate
+func (t *throttle) duration(size int64) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(t.rate) * float64(time.Second))
+}
+
+// waits until size more bytes fit into the rate
+func (t *throttle) wait(size int64) {
+	d := t.duration(size)
+	if d == 0 {
+		return
+	}
+	t.mutex.Lock()
+	now := common.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	start := t.next
+	t.next = t.next.Add(d)
+	t.mutex.Unlock()
+
+	if start.After(now) {
+		common.GetClock().Sleep(start.Sub(now))
+	}
+}
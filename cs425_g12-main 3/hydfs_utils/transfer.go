@@ -0,0 +1,241 @@
+package hydfs_utils
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// chunked transfers: data moves between nodes in chunks of at most the chunk size, each with a
+// crc32 checksum, so memory on both ends is bounded by one chunk whatever the size of the file.
+// an upload is written to .uploads/<uploadId>.part on the receiver, which reports how much of it
+// it has, so an interrupted upload resumes from there. a download writes into a local file and
+// resumes at the offset it reached, from the same or another replica
+
+var (
+	chunkSize  = 1 << 20
+	chunkMutex sync.RWMutex
+)
+
+// largest chunk a node sends or accepts
+const maxChunkSize = 64 << 20
+
+// times a chunk is sent again after an error before the transfer gives up on the node
+var chunkRetries = 3
+
+const errChunkChecksum = "chunk checksum mismatch"
+
+// an upload nothing was written to for this long is deleted, its sender gave up on it
+var staleUploadAge = time.Hour
+
+// sets the size of the chunks this node sends and asks for
+func SetChunkSize(size int) {
+	chunkMutex.Lock()
+	defer chunkMutex.Unlock()
+	chunkSize = max(1, min(size, maxChunkSize))
+}
+
+func GetChunkSize() int {
+	chunkMutex.RLock()
+	defer chunkMutex.RUnlock()
+	return chunkSize
+}
+
+type UploadOffsetArgs struct {
+	UploadId string
+}
+
+type UploadChunkArgs struct {
+	UploadId string
+	Offset   int64
+	Data     []byte
+	Checksum uint32 // crc32 of Data
+}
+
+type UploadReply struct {
+	Offset int64 // bytes of the upload the receiver has
+}
+
+type StoreUploadArgs struct {
+	UploadId string
+	Name     string
+	Size     int64
+	Checksum string // sha256 of the file, hex
+}
+
+type ReadChunkArgs struct {
+	FileId  string
+	BlockId string
+	Offset  int64
+	Length  int
+}
+
+type ReadChunkReply struct {
+	Data     []byte
+	Checksum uint32 // crc32 of Data
+}
+
+// writes data at offset into the file at path and returns the new size. anything after offset
+// from an earlier attempt is dropped, a chunk past the end is refused
+func writeChunk(path string, offset int64, data []byte) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directories for %s: %v", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if offset > info.Size() {
+		return 0, fmt.Errorf("chunk at %d is past the %d bytes received", offset, info.Size())
+	}
+	if err := file.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		return 0, err
+	}
+	return offset + int64(len(data)), nil
+}
+
+// uploads the local file to the node at addr as uploadId, continuing from what the node already
+// has. returns the size of the file
+func uploadFile(addr string, uploadId string, localPath string) (int64, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read local file %s: %v", localPath, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	client, err := dialAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { client.Close() }()
+
+	var have UploadReply
+	if err := callClient(client, "HyDFSReceiver.UploadOffset", &UploadOffsetArgs{UploadId: uploadId}, &have, readTimeout); err != nil {
+		return 0, err
+	}
+	offset := have.Offset
+	if offset > size {
+		offset = 0
+	}
+
+	buf := make([]byte, GetChunkSize())
+	failures := 0
+	// an empty file is one empty chunk
+	for {
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("failed to read local file %s: %v", localPath, err)
+		}
+		args := &UploadChunkArgs{UploadId: uploadId, Offset: offset, Data: buf[:n], Checksum: crc32.ChecksumIEEE(buf[:n])}
+		var reply UploadReply
+		if err := callClient(client, "HyDFSReceiver.UploadChunk", args, &reply, writeTimeout); err != nil {
+			failures++
+			if failures > chunkRetries {
+				return 0, fmt.Errorf("upload of %s failed at offset %d: %v", uploadId, offset, err)
+			}
+			HyDFSLogger.Warn("chunk upload failed, resuming", "upload", uploadId, "offset", offset, "err", err)
+			// the connection may be gone, continue from what the receiver has
+			client.Close()
+			redialed, err := dialAddr(addr)
+			if err != nil {
+				return 0, err
+			}
+			client = redialed
+			if err := callClient(client, "HyDFSReceiver.UploadOffset", &UploadOffsetArgs{UploadId: uploadId}, &have, readTimeout); err != nil {
+				return 0, err
+			}
+			if offset = have.Offset; offset > size {
+				offset = 0
+			}
+			continue
+		}
+		failures = 0
+		if offset = reply.Offset; offset >= size {
+			return size, nil
+		}
+	}
+}
+
+// downloads block from the node at addr into out, the block starts at base in out and the first
+// done bytes are there already. the whole block is checked against its checksum at the end.
+// returns how many bytes of the block are in out, also on an error, 0 if the block was corrupt
+func downloadBlock(addr string, fileId string, block BlockInfo, out *os.File, base int64, done int64, throttled bool) (int64, error) {
+	if done >= block.Size {
+		return verifyDownload(out, base, block)
+	}
+	client, err := dialAddr(addr)
+	if err != nil {
+		return done, err
+	}
+	defer client.Close()
+
+	length := GetChunkSize()
+	failures := 0
+	for done < block.Size {
+		want := int(min(int64(length), block.Size-done))
+		if throttled {
+			transferThrottle.wait(int64(want))
+		}
+		args := &ReadChunkArgs{FileId: fileId, BlockId: block.Id, Offset: done, Length: want}
+		var reply ReadChunkReply
+		err := callClient(client, "HyDFSReceiver.ReadChunk", args, &reply, readTimeout)
+		if err == nil && crc32.ChecksumIEEE(reply.Data) != reply.Checksum {
+			err = fmt.Errorf("%s at offset %d of block %s", errChunkChecksum, done, block.Id)
+		}
+		if err == nil && len(reply.Data) == 0 {
+			return done, fmt.Errorf("block %s ends at %d of %d bytes", block.Id, done, block.Size)
+		}
+		if err != nil {
+			failures++
+			if failures > chunkRetries || err.Error() == errFileNotFound || errors.Is(err, rpc.ErrShutdown) {
+				return done, err
+			}
+			HyDFSLogger.Warn("chunk download failed, retrying", "block", block.Id, "offset", done, "err", err)
+			continue
+		}
+		failures = 0
+		if _, err := out.WriteAt(reply.Data, base+done); err != nil {
+			return done, fmt.Errorf("failed to write block %s: %v", block.Id, err)
+		}
+		done += int64(len(reply.Data))
+	}
+	return verifyDownload(out, base, block)
+}
+
+// checks a downloaded block, a corrupt one has to be downloaded again from the start
+func verifyDownload(out *os.File, base int64, block BlockInfo) (int64, error) {
+	if err := checkDownloaded(out, base, block); err != nil {
+		return 0, err
+	}
+	return block.Size, nil
+}
+
+// calls method over an open connection, gives up after timeout
+func callClient(client *rpc.Client, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return fmt.Errorf("%s %w after %s", method, errTimedOut, timeout)
+	}
+}
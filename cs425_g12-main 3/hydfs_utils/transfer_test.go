@@ -0,0 +1,301 @@
+package hydfs_utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"cs425_g12/common"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// port the test receivers listen on, every receiver has its own loopback address
+const testRpcPort = "15052"
+
+// receiver whose connection breaks on one chunk of an upload or download
+type flakyReceiver struct {
+	*HyDFSReceiver
+	mutex   sync.Mutex
+	cutAt   int     // chunk the connection breaks on, counted from 1, 0 for never
+	chunks  int     // chunks asked for so far
+	offsets []int64 // offset of every chunk asked for
+}
+
+// records a chunk at offset, returns true if the connection breaks on it
+func (r *flakyReceiver) cut(offset int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.chunks++
+	r.offsets = append(r.offsets, offset)
+	return r.chunks == r.cutAt
+}
+
+func (r *flakyReceiver) askedFor() []int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]int64(nil), r.offsets...)
+}
+
+// a cut upload chunk is written halfway before the connection breaks
+func (r *flakyReceiver) UploadChunk(args *UploadChunkArgs, reply *UploadReply) error {
+	if r.cut(args.Offset) {
+		half := args.Data[:len(args.Data)/2]
+		torn := &UploadChunkArgs{UploadId: args.UploadId, Offset: args.Offset, Data: half, Checksum: crc32.ChecksumIEEE(half)}
+		if err := r.HyDFSReceiver.UploadChunk(torn, reply); err != nil {
+			return err
+		}
+		return errors.New("connection reset")
+	}
+	return r.HyDFSReceiver.UploadChunk(args, reply)
+}
+
+// after a cut download chunk the receiver reports the block gone, the download stops right away
+func (r *flakyReceiver) ReadChunk(args *ReadChunkArgs, reply *ReadChunkReply) error {
+	if r.cut(args.Offset) {
+		return errors.New(errFileNotFound)
+	}
+	return r.HyDFSReceiver.ReadChunk(args, reply)
+}
+
+// serves a flaky receiver for every ip on a loopback address, chunks are small so a transfer
+// takes many of them
+func startReceivers(t *testing.T, ips ...string) ([]common.MachineId, []*flakyReceiver) {
+	t.Helper()
+	port, size := rpcPort, GetChunkSize()
+	rpcPort = testRpcPort
+	SetChunkSize(64)
+	t.Cleanup(func() {
+		rpcPort = port
+		SetChunkSize(size)
+	})
+
+	ids := make([]common.MachineId, 0, len(ips))
+	receivers := make([]*flakyReceiver, 0, len(ips))
+	for i, ip := range ips {
+		receiver := &flakyReceiver{HyDFSReceiver: &HyDFSReceiver{DataDir: t.TempDir()}}
+		serveReceiver(t, receiver, net.JoinHostPort(ip, testRpcPort))
+		ids = append(ids, common.NewMachineId(ip, 5051, time.Unix(0, int64(i+1))))
+		receivers = append(receivers, receiver)
+	}
+	return ids, receivers
+}
+
+// serves receiver as HyDFSReceiver on addr until the test ends
+func serveReceiver(t *testing.T, receiver any, addr string) {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.RegisterName("HyDFSReceiver", receiver); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+}
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// block seq of client holding data
+func dataBlock(client string, seq uint64, data []byte) BlockInfo {
+	block := testBlock(client, seq, int64(seq)+1)
+	block.Size = int64(len(data))
+	block.Checksum, _ = checksumOf(bytes.NewReader(data))
+	return block
+}
+
+// stores the file with blocks on receiver, data holds the content of each block
+func storeFile(t *testing.T, receiver *HyDFSReceiver, fileId string, blocks []BlockInfo, data [][]byte) {
+	t.Helper()
+	for i, block := range blocks {
+		path := filepath.Join(t.TempDir(), block.Id)
+		if err := os.WriteFile(path, data[i], 0644); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if i == 0 {
+			err = receiver.files().create("file", fileId, block, path)
+		} else {
+			_, err = receiver.files().appendBlock(fileId, block, path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkSha256(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha256.Sum256(got) != sha256.Sum256(want) {
+		t.Fatalf("sha256 of %s differs from the data sent (%d bytes, want %d)", filepath.Base(path), len(got), len(want))
+	}
+}
+
+func TestWriteChunk(t *testing.T) {
+	tests := []struct {
+		name    string
+		have    string
+		offset  int64
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"new file", "", 0, "abc", "abc", false},
+		{"at the end", "abc", 3, "def", "abcdef", false},
+		{"drops what follows the offset", "abcxyz", 3, "de", "abcde", false},
+		{"rewrites from the start", "abcdef", 0, "x", "x", false},
+		{"empty chunk truncates", "abcdef", 2, "", "ab", false},
+		{"past the end", "abc", 4, "def", "abc", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "upload.part")
+			if test.have != "" {
+				if err := os.WriteFile(path, []byte(test.have), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			size, err := writeChunk(path, test.offset, []byte(test.data))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && size != int64(len(test.want)) {
+				t.Errorf("size = %d, want %d", size, len(test.want))
+			}
+			got, _ := os.ReadFile(path)
+			if string(got) != test.want {
+				t.Errorf("file = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUploadResumesAfterCut(t *testing.T) {
+	ids, receivers := startReceivers(t, "127.0.0.1")
+	receiver := receivers[0]
+	receiver.cutAt = 4
+	data := randomData(1000, 1)
+
+	size, err := uploadFile(rpcAddr(ids[0]), "upload", writeTempFile(t, "local", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("uploaded %d bytes, want %d", size, len(data))
+	}
+
+	// the cut chunk at 192 got half written, the upload continues after that half
+	offsets := receiver.askedFor()
+	if len(offsets) < 5 || offsets[3] != 192 || offsets[4] != 192+32 {
+		t.Fatalf("chunk offsets %v, want the one after the cut at %d", offsets, 192+32)
+	}
+
+	sum, _ := checksumOf(bytes.NewReader(data))
+	var reply string
+	if err := receiver.StoreUpload(&StoreUploadArgs{UploadId: "upload", Name: "stored", Size: size, Checksum: sum}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	checkSha256(t, filepath.Join(receiver.DataDir, "stored"), data)
+}
+
+func TestDownloadResumesOnNextReplica(t *testing.T) {
+	ids, receivers := startReceivers(t, "127.0.0.1", "127.0.0.2")
+	cut, good := receivers[0], receivers[1]
+
+	// the cut is in the second block, which starts at 100 in the file
+	data := [][]byte{randomData(100, 1), randomData(1000, 2)}
+	blocks := []BlockInfo{dataBlock("a", 0, data[0]), dataBlock("a", 1, data[1])}
+	for _, receiver := range receivers {
+		storeFile(t, receiver.HyDFSReceiver, "fileid", blocks, data)
+	}
+	cut.cutAt = 5
+	meta, err := cut.files().meta("fileid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(t.TempDir(), "local")
+	candidates := []replicaAnswer{{replica: ids[0], reply: meta}, {replica: ids[1], reply: meta}}
+	if _, err := downloadFile(meta, candidates, local); err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks 1-2 are the first block, 3-4 the start of the second, the next replica picks up there
+	if offsets := good.askedFor(); len(offsets) == 0 || offsets[0] != 128 {
+		t.Fatalf("next replica was asked for %v, want to start at 128", offsets)
+	}
+	checkSha256(t, local, append(append([]byte(nil), data[0]...), data[1]...))
+}
+
+func TestFetchBlockStartsOverAfterCorruptCopy(t *testing.T) {
+	ids, receivers := startReceivers(t, "127.0.0.1", "127.0.0.2")
+	corrupt, good := receivers[0], receivers[1]
+
+	data := randomData(500, 1)
+	block := dataBlock("a", 0, data)
+	for _, receiver := range receivers {
+		storeFile(t, receiver.HyDFSReceiver, "fileid", []BlockInfo{block}, [][]byte{data})
+	}
+	damaged := append([]byte(nil), data...)
+	damaged[300] ^= 0xff
+	if err := os.WriteFile(corrupt.files().blockPath("fileid", block.Id), damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newFileStore(t.TempDir())
+	if err := fetchBlock(store, "file", "fileid", block, ids, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole corrupt copy was read, then the good replica sent the block from the start
+	if offsets := good.askedFor(); len(offsets) == 0 || offsets[0] != 0 {
+		t.Fatalf("good replica was asked for %v, want to start at 0", offsets)
+	}
+	checkSha256(t, store.blockPath("fileid", block.Id), data)
+
+	// the replica that sent the corrupt copy gets repaired from the good one in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for corrupt.files().checkBlock("fileid", block) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("corrupt replica was not repaired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writes data to a new file in the test's temp dir
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
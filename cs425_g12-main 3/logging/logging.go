@@ -0,0 +1,193 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// leveled structured logging. every subsystem has its own Logger, all of them write to a sink:
+// one log file in logfmt or json, rotated by size and appended to across restarts
+
+type Config struct {
+	Dir      string // directory of the log file
+	File     string // name of the log file inside Dir
+	Level    string // debug, info, warn or error
+	Levels   string // per subsystem levels, e.g. "gossip=debug,hydfs=warn"
+	Format   string // "logfmt" or "json"
+	MaxSize  int64  // size in bytes after which the file is rotated
+	MaxFiles int    // number of rotated files kept next to the current one
+}
+
+var DefaultConfig = Config{
+	Dir:      "/home/shared",
+	Level:    "info",
+	Format:   "logfmt",
+	MaxSize:  100 << 20,
+	MaxFiles: 5,
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", s)
+}
+
+// where loggers write to, with the levels to filter by
+type Sink struct {
+	logger *slog.Logger
+	closer io.Closer
+	level  slog.Level
+	levels map[string]slog.Level
+}
+
+func newSink(w io.Writer, format string, level slog.Level) (*Sink, error) {
+	// filtering happens in Logger, the handler gets everything that passed
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	switch format {
+	case "logfmt", "":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("invalid log format %q (expected logfmt or json)", format)
+	}
+	return &Sink{logger: slog.New(handler), level: level, levels: make(map[string]slog.Level)}, nil
+}
+
+// opens the log file of the config for appending
+func Open(config Config) (*Sink, error) {
+	level, err := ParseLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating log directory: %v", err)
+	}
+	file, err := openRotatingFile(filepath.Join(config.Dir, config.File), config.MaxSize, config.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := newSink(file, config.Format, level)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	sink.closer = file
+
+	if config.Levels != "" {
+		for _, part := range strings.Split(config.Levels, ",") {
+			subsystem, value, found := strings.Cut(part, "=")
+			if !found {
+				file.Close()
+				return nil, fmt.Errorf("invalid subsystem level %q (expected subsystem=level)", part)
+			}
+			level, err := ParseLevel(value)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			sink.levels[subsystem] = level
+		}
+	}
+	return sink, nil
+}
+
+// sink writing to w, for tools that log to stderr
+func NewWriterSink(w io.Writer, format string, level slog.Level) (*Sink, error) {
+	return newSink(w, format, level)
+}
+
+func (s *Sink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+func (s *Sink) enabled(subsystem string, level slog.Level) bool {
+	min, ok := s.levels[subsystem]
+	if !ok {
+		min = s.level
+	}
+	return level >= min
+}
+
+// loggers without their own sink write here, nothing is written until SetDefault is called
+var defaultSink atomic.Pointer[Sink]
+
+func init() {
+	sink, _ := newSink(io.Discard, "logfmt", slog.LevelError+1)
+	defaultSink.Store(sink)
+}
+
+func SetDefault(s *Sink) {
+	defaultSink.Store(s)
+}
+
+// logger of one subsystem, every line carries subsystem=<name>
+type Logger struct {
+	subsystem string
+	sink      atomic.Pointer[Sink]
+}
+
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// sends this logger to its own sink instead of the default one
+func (l *Logger) SetSink(s *Sink) {
+	l.sink.Store(s)
+}
+
+func (l *Logger) log(level slog.Level, msg string, args ...any) {
+	sink := l.sink.Load()
+	if sink == nil {
+		sink = defaultSink.Load()
+	}
+	if !sink.enabled(l.subsystem, level) {
+		return
+	}
+	sink.logger.Log(context.Background(), level, msg, append([]any{"subsystem", l.subsystem}, args...)...)
+}
+
+func (l *Logger) Enabled(level slog.Level) bool {
+	sink := l.sink.Load()
+	if sink == nil {
+		sink = defaultSink.Load()
+	}
+	return sink.enabled(l.subsystem, level)
+}
+
+// msg followed by key value pairs
+func (l *Logger) Debug(msg string, args ...any) { l.log(slog.LevelDebug, msg, args...) }
+func (l *Logger) Info(msg string, args ...any)  { l.log(slog.LevelInfo, msg, args...) }
+func (l *Logger) Warn(msg string, args ...any)  { l.log(slog.LevelWarn, msg, args...) }
+func (l *Logger) Error(msg string, args ...any) { l.log(slog.LevelError, msg, args...) }
+
+// unstructured messages are debug output, the formatting only happens when debug is enabled
+func (l *Logger) Printf(format string, args ...any) {
+	if l.Enabled(slog.LevelDebug) {
+		l.log(slog.LevelDebug, strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+	}
+}
+
+func (l *Logger) Println(args ...any) {
+	if l.Enabled(slog.LevelDebug) {
+		l.log(slog.LevelDebug, strings.TrimRight(fmt.Sprintln(args...), "\n"))
+	}
+}
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenFiltersBySubsystemLevel(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  string
+		levels string
+		want   []string // lines that are written, as subsystem:message
+	}{
+		{"default level", "info", "", []string{"gossip:info", "gossip:warn", "hydfs:info", "hydfs:warn"}},
+		{"debug for one subsystem", "info", "gossip=debug", []string{"gossip:debug", "gossip:info", "gossip:warn", "hydfs:info", "hydfs:warn"}},
+		{"quieter subsystem", "debug", "hydfs=warn", []string{"gossip:debug", "gossip:info", "gossip:warn", "hydfs:warn"}},
+		{"every subsystem set", "error", "gossip=warn,hydfs=info", []string{"gossip:warn", "hydfs:info", "hydfs:warn"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sink, err := Open(Config{Dir: dir, File: "node.log", Level: test.level, Levels: test.levels, Format: "json"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, subsystem := range []string{"gossip", "hydfs"} {
+				logger := New(subsystem)
+				logger.SetSink(sink)
+				logger.Debug("debug")
+				logger.Info("info")
+				logger.Warn("warn")
+			}
+			sink.Close()
+
+			got := make([]string, 0)
+			for _, line := range strings.Split(strings.TrimSpace(readFile(t, filepath.Join(dir, "node.log"))), "\n") {
+				if line == "" {
+					continue
+				}
+				var entry struct{ Msg, Subsystem string }
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("line %q is not json: %v", line, err)
+				}
+				got = append(got, entry.Subsystem+":"+entry.Msg)
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("lines = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOpenRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{"level", Config{Level: "loud"}, "invalid log level"},
+		{"subsystem level without =", Config{Levels: "gossip"}, "invalid subsystem level"},
+		{"subsystem level", Config{Levels: "gossip=debug,hydfs=loud"}, "invalid log level"},
+		{"format", Config{Format: "xml"}, "invalid log format"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Dir = t.TempDir()
+			test.config.File = "node.log"
+			sink, err := Open(test.config)
+			if err == nil {
+				sink.Close()
+				t.Fatal("opened an invalid config")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %q, want it to contain %q", err, test.wantErr)
+			}
+		})
+	}
+}
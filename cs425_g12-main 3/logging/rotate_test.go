@@ -0,0 +1,140 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// writes the lines, each one write
+func writeLines(t *testing.T, r *rotatingFile, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRotatesAtMaxSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		lines       []string
+		wantCurrent string
+		wantOld     string // content of file.log.1, empty if there is none
+	}{
+		{"below max size", []string{"aaaa\n", "bbbb\n"}, "aaaa\nbbbb\n", ""},
+		{"exactly max size", []string{"aaaa\n", "bbbb\n", "cc\n"}, "aaaa\nbbbb\ncc\n", ""},
+		{"past max size", []string{"aaaa\n", "bbbb\n", "cccc\n"}, "cccc\n", "aaaa\nbbbb\n"},
+		{"line larger than max size", []string{"aaaaaaaaaaaaaaaaaaaa\n", "b\n"}, "b\n", "aaaaaaaaaaaaaaaaaaaa\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file.log")
+			r, err := openRotatingFile(path, 13, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			writeLines(t, r, test.lines...)
+
+			if got := readFile(t, path); got != test.wantCurrent {
+				t.Errorf("file.log = %q, want %q", got, test.wantCurrent)
+			}
+			old, err := os.ReadFile(path + ".1")
+			if test.wantOld == "" {
+				if err == nil {
+					t.Errorf("file.log.1 = %q, want no rotated file", old)
+				}
+				return
+			}
+			if string(old) != test.wantOld {
+				t.Errorf("file.log.1 = %q, want %q (err %v)", old, test.wantOld, err)
+			}
+		})
+	}
+}
+
+func TestKeepsMaxFiles(t *testing.T) {
+	tests := []struct {
+		maxFiles  int
+		wantFiles []string
+	}{
+		{0, []string{"file.log"}},
+		{1, []string{"file.log", "file.log.1"}},
+		{3, []string{"file.log", "file.log.1", "file.log.2", "file.log.3"}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("maxFiles=%d", test.maxFiles), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "file.log")
+			r, err := openRotatingFile(path, 5, test.maxFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			// every line fills the file, so each one after the first rotates
+			for i := 1; i <= 6; i++ {
+				writeLines(t, r, fmt.Sprintf("%d---\n", i))
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				got = append(got, entry.Name())
+			}
+			if strings.Join(got, " ") != strings.Join(test.wantFiles, " ") {
+				t.Fatalf("files = %v, want %v", got, test.wantFiles)
+			}
+			// the newest lines are kept, file.log.<i> is i lines older than file.log
+			for i, name := range test.wantFiles {
+				if want := fmt.Sprintf("%d---\n", 6-i); readFile(t, filepath.Join(dir, name)) != want {
+					t.Errorf("%s = %q, want %q", name, readFile(t, filepath.Join(dir, name)), want)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendsOnReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.log")
+	r, err := openRotatingFile(path, 20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, r, "first run\n")
+	r.Close()
+
+	r, err = openRotatingFile(path, 20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	writeLines(t, r, "second\n")
+	if got := readFile(t, path); got != "first run\nsecond\n" {
+		t.Fatalf("file.log = %q, want both runs", got)
+	}
+
+	// the size of the earlier run counts towards the rotation
+	writeLines(t, r, "third\n")
+	if got := readFile(t, path); got != "third\n" {
+		t.Errorf("file.log = %q, want it rotated", got)
+	}
+	if got := readFile(t, path+".1"); got != "first run\nsecond\n" {
+		t.Errorf("file.log.1 = %q, want both runs", got)
+	}
+}
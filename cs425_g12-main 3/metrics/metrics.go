@@ -0,0 +1,305 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minimal prometheus compatible metrics: counters, gauges and histograms with labels, written in
+// the prometheus text format on /metrics
+
+// anything that can write itself in the text format
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// all registered metrics
+var (
+	registry      = make(map[string]metric)
+	registryMutex sync.RWMutex
+)
+
+func register(m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, exists := registry[m.name()]; exists {
+		panic(fmt.Sprintf("metric %s registered twice", m.name()))
+	}
+	registry[m.name()] = m
+}
+
+// writes every registered metric sorted by name
+func WriteAll(w io.Writer) {
+	registryMutex.RLock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryMutex.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		registryMutex.RLock()
+		m := registry[name]
+		registryMutex.RUnlock()
+		m.write(w)
+	}
+}
+
+// http handler for /metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteAll(w)
+	})
+}
+
+// serves /metrics on addr in its own goroutine until ctx is cancelled
+func Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Println("Error serving metrics: ", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+}
+
+// label values of one series joined, so they can be used as a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// counter/gauge values per label combination
+type valueVec struct {
+	metricName string
+	help       string
+	kind       string
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]float64
+	labels     map[string][]string
+}
+
+func newValueVec(name string, help string, kind string, labelNames []string) *valueVec {
+	v := &valueVec{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+		labels:     make(map[string][]string),
+	}
+	if len(labelNames) == 0 {
+		// unlabeled metrics always show up, even at zero
+		v.values[""] = 0
+		v.labels[""] = nil
+	}
+	register(v)
+	return v
+}
+
+func (v *valueVec) name() string { return v.metricName }
+
+func (v *valueVec) add(values []string, delta float64, set bool) {
+	if len(values) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.metricName, len(v.labelNames), len(values)))
+	}
+	key := labelKey(values)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if _, exists := v.labels[key]; !exists {
+		v.labels[key] = append([]string(nil), values...)
+	}
+	if set {
+		v.values[key] = delta
+	} else {
+		v.values[key] += delta
+	}
+}
+
+func (v *valueVec) write(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	writeHeader(w, v.metricName, v.help, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, formatLabels(v.labelNames, v.labels[key]), formatValue(v.values[key]))
+	}
+}
+
+// monotonically increasing counter
+type Counter struct {
+	vec    *valueVec
+	values []string
+}
+
+func (c Counter) Inc() {
+	c.vec.add(c.values, 1, false)
+}
+
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		return // counters never go down
+	}
+	c.vec.add(c.values, delta, false)
+}
+
+func NewCounter(name string, help string) Counter {
+	return Counter{vec: newValueVec(name, help, "counter", nil)}
+}
+
+// counter with labels
+type CounterVec struct {
+	vec *valueVec
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) CounterVec {
+	return CounterVec{vec: newValueVec(name, help, "counter", labelNames)}
+}
+
+func (c CounterVec) With(values ...string) Counter {
+	return Counter{vec: c.vec, values: values}
+}
+
+// value that can go up and down
+type Gauge struct {
+	vec    *valueVec
+	values []string
+}
+
+func (g Gauge) Set(value float64) {
+	g.vec.add(g.values, value, true)
+}
+
+func (g Gauge) Add(delta float64) {
+	g.vec.add(g.values, delta, false)
+}
+
+func NewGauge(name string, help string) Gauge {
+	return Gauge{vec: newValueVec(name, help, "gauge", nil)}
+}
+
+// gauge that is computed when scraped, fn returns the value for each value of the label
+type gaugeFunc struct {
+	metricName string
+	help       string
+	labelName  string
+	fn         func() map[string]float64
+}
+
+func NewGaugeFunc(name string, help string, labelName string, fn func() map[string]float64) {
+	register(&gaugeFunc{metricName: name, help: help, labelName: labelName, fn: fn})
+}
+
+func (g *gaugeFunc) name() string { return g.metricName }
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	values := g.fn()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := ""
+		if g.labelName != "" {
+			labels = formatLabels([]string{g.labelName}, []string{key})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, labels, formatValue(values[key]))
+	}
+}
+
+// histogram with fixed buckets
+type Histogram struct {
+	metricName string
+	help       string
+	buckets    []float64
+	mutex      sync.Mutex
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+// latency buckets in seconds, from 1ms to 10s
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		metricName: name,
+		help:       help,
+		buckets:    append([]float64(nil), buckets...),
+		counts:     make([]uint64, len(buckets)),
+	}
+	sort.Float64s(h.buckets)
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeHeader(w, h.metricName, h.help, "histogram")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(nil, nil, "le", formatValue(bound)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(nil, nil, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, h.count)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"cs425_g12/admin"
+	"cs425_g12/common"
+	"cs425_g12/experiment"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// experiment controller for real nodes: starts an experiment on every node through the admin
+// api, kills one node, collects what every node recorded and prints detection latency and false
+// positives. the admin api of every node must be reachable from here (adminAddr 0.0.0.0:7070)
+// usage: expctl -nodes host1:7070,host2:7070,... [-victim host3:7070] [-runs 3] [-warmup 10s] [-wait 20s] [-kill-cmd "ssh {ip} pkill failure_detector"]
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// calls a command of the admin api and decodes its result into out
+func call(addr string, method string, command string, query url.Values, out interface{}) error {
+	endpoint := url.URL{Scheme: "http", Host: addr, Path: "/" + command, RawQuery: query.Encode()}
+	var resp *http.Response
+	var err error
+	if method == http.MethodGet {
+		resp, err = client.Get(endpoint.String())
+	} else {
+		resp, err = client.Post(endpoint.String(), "application/json", nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Ok     bool            `json:"ok"`
+		Error  string          `json:"error"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("could not decode response: %v", err)
+	}
+	if !body.Ok {
+		return fmt.Errorf("%s", body.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body.Result, out)
+}
+
+type controller struct {
+	nodes   []string
+	victim  string
+	warmup  time.Duration
+	wait    time.Duration
+	recover time.Duration
+	killCmd string
+}
+
+// kills the victim, returns the kill time on the controller clock. without a kill command the
+// victim is cut off with a fault rule dropping everything, it keeps running and answers the
+// admin api
+func (c *controller) kill(victim common.MachineId) (time.Time, error) {
+	before := time.Now()
+	var err error
+	if c.killCmd != "" {
+		var output bytes.Buffer
+		cmd := exec.Command("sh", "-c", strings.ReplaceAll(c.killCmd, "{ip}", victim.Ip))
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err = cmd.Run(); err != nil {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(output.String()))
+		}
+	} else {
+		err = call(c.victim, http.MethodPost, "fault_add", url.Values{"spec": {"dir=both,drop=1"}}, nil)
+	}
+	after := time.Now()
+	// the kill happened somewhere while the command ran
+	return before.Add(after.Sub(before) / 2), err
+}
+
+func (c *controller) run(n int) (experiment.Result, error) {
+	var self admin.SelfInfo
+	if err := call(c.victim, http.MethodGet, "list_self", nil, &self); err != nil {
+		return experiment.Result{}, fmt.Errorf("could not reach victim %s: %v", c.victim, err)
+	}
+
+	for _, node := range c.nodes {
+		if err := call(node, http.MethodPost, "start_exp", nil, nil); err != nil {
+			return experiment.Result{}, fmt.Errorf("start_exp on %s: %v", node, err)
+		}
+	}
+	fmt.Printf("run %d: experiment started on %d nodes, killing %s in %s\n", n, len(c.nodes), self.Self, c.warmup)
+	time.Sleep(c.warmup)
+
+	killedAt, err := c.kill(self.Self)
+	if err != nil {
+		fmt.Println("Error killing victim: ", err)
+	}
+	fmt.Printf("run %d: killed %s at %s, collecting in %s\n", n, self.Self, killedAt.Format("15:04:05.000"), c.wait)
+	time.Sleep(c.wait)
+
+	reports := make([]experiment.NodeReport, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		var record common.ExperimentRecord
+		before := time.Now()
+		if err := call(node, http.MethodPost, "stop_exp", nil, &record); err != nil {
+			fmt.Printf("run %d: no record from %s: %v\n", n, node, err)
+			continue
+		}
+		after := time.Now()
+		// the node stopped recording halfway through the request
+		offset := record.Stopped.Sub(before.Add(after.Sub(before) / 2))
+		reports = append(reports, experiment.NodeReport{Record: record, Offset: offset})
+	}
+
+	if c.killCmd == "" {
+		// bring the victim back, it rejoins according to its self failure policy
+		if err := call(c.victim, http.MethodPost, "fault_clear", nil, nil); err != nil {
+			fmt.Println("Error clearing fault rules on victim: ", err)
+		}
+	}
+
+	kill := experiment.Kill{Member: self.Self, At: killedAt}
+	return experiment.Analyze([]experiment.Kill{kill}, reports), nil
+}
+
+func main() {
+	nodes := flag.String("nodes", "", "comma separated admin api addresses of all nodes")
+	victim := flag.String("victim", "", "admin api address of the node to kill, the last node by default")
+	runs := flag.Int("runs", 1, "number of runs")
+	warmup := flag.Duration("warmup", 10*time.Second, "time between starting the experiment and the kill")
+	wait := flag.Duration("wait", 20*time.Second, "time between the kill and collecting the records")
+	recoverTime := flag.Duration("recover", 15*time.Second, "time for the victim to rejoin between runs")
+	killCmd := flag.String("kill-cmd", "", "shell command that kills the victim, {ip} is replaced by its ip; cuts it off with a fault rule if empty")
+	out := flag.String("out", "", "file to append the results of every run to as json")
+	flag.Parse()
+
+	c := &controller{victim: *victim, warmup: *warmup, wait: *wait, recover: *recoverTime, killCmd: *killCmd}
+	for _, node := range strings.Split(*nodes, ",") {
+		if node != "" {
+			c.nodes = append(c.nodes, node)
+		}
+	}
+	if len(c.nodes) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if c.victim == "" {
+		c.victim = c.nodes[len(c.nodes)-1]
+	}
+	if c.killCmd != "" && *runs > 1 {
+		fmt.Println("a killed node has to be restarted by hand, running once")
+		*runs = 1
+	}
+
+	var first, full []time.Duration
+	falseFailures := 0
+	for n := 1; n <= *runs; n++ {
+		result, err := c.run(n)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(result)
+
+		if *out != "" {
+			file, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Println("Error opening output file: ", err)
+			} else {
+				json.NewEncoder(file).Encode(result)
+				file.Close()
+			}
+		}
+
+		for _, kill := range result.Kills {
+			if kill.FirstDetection >= 0 {
+				first = append(first, kill.FirstDetection)
+			}
+			if kill.FullDissemination >= 0 {
+				full = append(full, kill.FullDissemination)
+			}
+		}
+		falseFailures += result.FalseFailures
+		if n < *runs {
+			time.Sleep(c.recover)
+		}
+	}
+
+	if *runs > 1 {
+		fmt.Printf("%d runs: first detection mean %s, full dissemination mean %s (%d of %d runs), %d false failures\n",
+			*runs, mean(first), mean(full), len(full), *runs, falseFailures)
+	}
+}
+
+func mean(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return "never"
+	}
+	var sum time.Duration
+	for _, d := range durations {
+		sum += d
+	}
+	return (sum / time.Duration(len(durations))).Round(time.Millisecond).String()
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"cs425_g12/admin"
 	"cs425_g12/common"
 	"cs425_g12/gossip"
 	"cs425_g12/hydfs_utils"
+	"cs425_g12/logging"
+	"cs425_g12/metrics"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -32,6 +39,57 @@ var Tgossip = 200 * time.Millisecond
 var Tping = 500 * time.Millisecond
 var Tsuscheck = 500 * time.Millisecond
 var Tfailcheck = 500 * time.Millisecond
+var Tpartition = 5 * time.Second
+var Treconnect = 2 * time.Second
+var reconnectRetention = 5 * time.Minute
+
+// address of the prometheus /metrics endpoint, only local by default
+var metricsAddr = "127.0.0.1:2112"
+
+// address of the admin api, localhost only by default
+var adminAddr = admin.DefaultAddr
+
+// what to do when the group declares this node failed: rejoin, stayout or exit
+var selfFailurePolicy = "rejoin"
+
+// port of the hydfs rpc server
+var hydfsPort = "5052"
+
+// how often every node merges the hydfs files it is the first replica of
+var Tmerge = 30 * time.Second
+
+// how often every node checks that the hydfs files it stores are at full replication, a check
+// also runs right after every failure
+var Trereplicate = 10 * time.Second
+
+// bytes per second this node pulls replicas at during re-replication and rebalancing, 0 is unlimited
+var transferRate int64 = 20 << 20
+
+// bytes per chunk of a hydfs transfer, what a transfer holds in memory on each end
+var chunkSize = 1 << 20
+
+// how long the scrubber waits between passes over the stored hydfs files, and the bytes per
+// second it reads them back at, 0 is unlimited
+var Tscrub = 10 * time.Minute
+var scrubRate int64 = 4 << 20
+
+// replicas a hydfs write (W) and read (R) wait for: one, quorum or all
+var writeConsistency = "quorum"
+var readConsistency = "quorum"
+
+// how long a shutdown may take before the process exits anyway
+var shutdownTimeout = 5 * time.Second
+
+// while a partition is suspected, only fail members a majority of the reachable group agrees on
+var partitionDamping = false
+
+// logging: directory, level (debug, info, warn, error), per subsystem levels
+// ("gossip=debug,hydfs=warn"), format (logfmt or json) and size after which a file is rotated
+var logDir = "/home/shared"
+var logLevel = "info"
+var logLevels = ""
+var logFormat = "logfmt"
+var logMaxSize int64 = 100 << 20
 
 var introducer_ip = "172.22.94.224"
 
@@ -44,11 +102,18 @@ func main() {
 	hydfs_utils.InitHyDFSDir()
 
 	// initialize gossip logger and hydfs logger
-	common.InitializeLogger("machine" + machineNo)
-	hydfs_utils.InitializeLogger("machine" + machineNo)
+	logConfig := logging.DefaultConfig
+	logConfig.Dir = logDir
+	logConfig.Level = logLevel
+	logConfig.Levels = logLevels
+	logConfig.Format = logFormat
+	logConfig.MaxSize = logMaxSize
+	common.InitializeLogger("machine"+machineNo, logConfig)
+	logConfig.Dir = filepath.Join(logDir, "hydfs", "logs")
+	hydfs_utils.InitializeLogger("machine"+machineNo, logConfig)
 
 	if err != nil {
-		common.Logger.Printf("Error converting drop rate to float; defaulting to 0.0 drop rate")
+		common.Logger.Warn("invalid drop rate, defaulting to 0.0", "err", err)
 		DropRate = 0.0
 	}
 
@@ -62,6 +127,13 @@ func main() {
 	list := common.NewMembershipList()
 	common.Introducer = introducer
 
+	// every other vm is a seed for reconnecting after a partition
+	for _, ip := range ip_map {
+		if ip != ip_map[machineNo] {
+			common.Seeds = append(common.Seeds, common.MachineId{Ip: ip, Port: common.GlobalPort})
+		}
+	}
+
 	if common.GetSelf().Ip == introducer_ip {
 		fmt.Println("this is the introducer")
 		introMember := common.NewMember(common.GetSelf())
@@ -79,88 +151,85 @@ func main() {
 		common.IsMemberInGroup = true
 	}
 
-	if runSus == "withSus" {
-		common.SetSuspicionMode(true)
-	} else if runSus == "withNoSus" {
-		common.SetSuspicionMode(false)
+	// start mode of this node, a group that is already running overrides it through the cluster mode
+	protocolMode, err := common.ParseProtocolMode(protocol)
+	if err != nil {
+		common.Logger.Warn("invalid protocol, defaulting to gossip", "err", err)
 	}
+	common.InitClusterMode(protocolMode, runSus == "withSus")
 
-	if protocol == "pingack" {
-		common.SetProtocolMode(true)
-	} else if protocol == "gossip" {
-		common.SetProtocolMode(false)
+	policy, err := gossip.ParseSelfFailurePolicy(selfFailurePolicy)
+	if err != nil {
+		common.Logger.Warn("invalid self failure policy, defaulting to rejoin", "err", err)
 	}
+	gossip.SetSelfFailurePolicy(policy)
+
+	partitionConfig := common.DefaultPartitionConfig
+	partitionConfig.Window = Tpartition
+	partitionConfig.Damping = partitionDamping
+	list.SetPartitionConfig(partitionConfig)
+
+	// every loop stops when ctx is cancelled by the shutdown
+	ctx, stop := context.WithCancel(context.Background())
+	gossip.SetNodeContext(ctx)
+
+	list.RegisterMetrics()
+	metrics.Serve(ctx, metricsAddr)
 
 	// GOSSIP GOROUTINES
-	list.StartChecker(Tsus, Tfail, Tclean, Tsuscheck, Tfailcheck)
-	gossip.GossipListener(list, DropRate)
-	gossip.StartProtocol(list, Tgossip, Tping, Tfail)
+	list.StartChecker(ctx, Tsus, Tfail, Tclean, Tsuscheck, Tfailcheck)
+	gossip.GossipListener(ctx, list, DropRate, gossip.DefaultPipelineConfig)
+	gossip.StartProtocol(ctx, list, Tgossip, Tping, Tfail)
+	gossip.StartReconnect(ctx, list, gossip.ReconnectConfig{Interval: Treconnect, Retention: reconnectRetention})
+	admin.Serve(ctx, adminAddr, list)
 
 	// HYDFS GOROUTINES
+	if err := hydfs_utils.InitHyDFS(ctx, hydfsPort); err != nil {
+		fmt.Println(err)
+	}
+	if err := setConsistency(writeConsistency, readConsistency); err != nil {
+		hydfs_utils.HyDFSLogger.Warn("invalid consistency, defaulting to quorum", "err", err)
+	}
+	hydfs_utils.StartMerger(ctx, list, Tmerge)
+	hydfs_utils.SetTransferRate(transferRate)
+	hydfs_utils.SetChunkSize(chunkSize)
+	hydfs_utils.StartRereplicator(ctx, list, Trereplicate)
+	hydfs_utils.SetScrubRate(scrubRate)
+	hydfs_utils.StartScrubber(ctx, list, Tscrub)
 
 	go func() {
 		for {
-			var command, protocolMode, susMode string
-			fmt.Scanln(&command, &protocolMode, &susMode)
+			var command, arg1, arg2 string
+			fmt.Scanln(&command, &arg1, &arg2)
 
 			switch command {
 			// FAILURE DETECTOR COMMANDS
 			case "switch":
-				if protocolMode == "gossip" && susMode == "withNoSus" {
-					common.SetSuspicionMode(false)
-					common.SetProtocolMode(false)
-					common.Logger.Println("Switched to gossip withNoSus mode.")
-				} else if protocolMode == "gossip" && susMode == "withSus" {
-					common.SetSuspicionMode(true)
-					common.SetProtocolMode(false)
-					common.Logger.Println("Switched to gossip withSus mode.")
-				} else if protocolMode == "pingack" && susMode == "withNoSus" {
-					common.SetSuspicionMode(false)
-					common.SetProtocolMode(true)
-					common.Logger.Println("Switched to pingack withNoSus mode.")
-				} else if protocolMode == "pingack" && susMode == "withSus" {
-					common.SetSuspicionMode(true)
-					common.SetProtocolMode(true)
-					common.Logger.Println("Switched to pingack withSus mode.")
+				if mode, err := admin.Switch(list, arg1, arg2); err != nil {
+					fmt.Println(err)
 				} else {
-					common.Logger.Printf("Invalid switch parameters: %s %s", protocolMode, susMode)
+					fmt.Println("Switching cluster to", mode)
 				}
 			case "list_mem":
-				membersPrint := list.GetEntireList()
 				fmt.Println("Membership list : ")
-				for _, m := range membersPrint {
+				for _, m := range admin.ListMembers(list) {
 					fmt.Println("  ", m)
 				}
-				common.Logger.Printf("Called getEntireList")
 			case "list_self":
-				fmt.Println("Self ID:", common.GetSelf())
-				common.Logger.Printf("Called getSelf")
+				info := admin.ListSelf()
+				fmt.Println("Self ID:", info.Self)
+				fmt.Printf("Declared dead %d times, rejoined %d times (policy: %s)\n", info.DeclaredDead, info.Rejoined, info.FailurePolicy)
 			case "leave":
-				self := common.GetSelf()
-				if member := list.GetMember(self); member != nil {
-					member.SuspicionState = common.StateFailed
-				}
-				common.IsMemberInGroup = false
+				admin.Leave(list)
 				fmt.Println("Left the group voluntarily")
 			case "join":
-				if common.IsMemberInGroup {
-					fmt.Println("already in the group")
+				if err := admin.Join(list); err != nil {
+					fmt.Println(err)
 				} else {
-					joined := gossip.RequestJoin(common.Introducer, list)
-					if joined {
-						common.IsMemberInGroup = true
-						fmt.Println("Joined the group")
-					} else {
-						fmt.Println("Failed to Join")
-					}
+					fmt.Println("Joined the group")
 				}
 			case "display_suspects":
-				suspectedMachines := []common.Member{}
-				for _, machine := range list.GetEntireList() {
-					if machine.SuspicionState == common.StateSuspicious {
-						suspectedMachines = append(suspectedMachines, machine)
-					}
-				}
+				suspectedMachines := admin.DisplaySuspects(list)
 				if len(suspectedMachines) == 0 {
 					fmt.Println("No suspected machines")
 				} else {
@@ -169,36 +238,149 @@ func main() {
 						fmt.Println(" ", suspect)
 					}
 				}
-			case "display_protocol":
-				var protocol string
-				var sus string
-				if common.GetProtocolMode() {
-					protocol = "ping"
+			case "display_partition":
+				status := list.GetPartitionStatus()
+				if status.Suspected {
+					fmt.Printf("Partition suspected since %s\n", status.Since.Format("15:04:05.000"))
+					fmt.Println("Unreachable: ", status.Unreachable)
+					fmt.Println("Merged back: ", status.Merged)
 				} else {
-					protocol = "gossip"
+					fmt.Println("No partition suspected")
 				}
-				if common.GetSuspicionMode() {
-					sus = "suspect"
-				} else {
-					sus = "nosuspect"
+				fmt.Println("Reachable: ", status.Reachable)
+			case "display_queue":
+				stats := gossip.GetQueueStats()
+				fmt.Printf("Queue depth: %d (priority %d, max %d)\n", stats.Depth, stats.PriorityDepth, stats.MaxDepth)
+				fmt.Printf("Received: %d, processed: %d, dropped on overload: %d, decode errors: %d, unknown type: %d\n",
+					stats.Received, stats.Processed, stats.DroppedOverload, stats.DecodeErrors, stats.UnknownType)
+			case "display_protocol":
+				fmt.Println(admin.DisplayProtocol(list))
+			case "fault":
+				// fault add <spec> | fault remove <id> | fault clear | fault list
+				switch arg1 {
+				case "add":
+					if id, err := admin.AddFault(arg2); err != nil {
+						fmt.Println(err)
+					} else {
+						fmt.Println("Added fault rule", id)
+					}
+				case "remove":
+					if err := admin.RemoveFault(arg2); err != nil {
+						fmt.Println(err)
+					} else {
+						fmt.Println("Removed fault rule", arg2)
+					}
+				case "clear":
+					gossip.ClearFaultRules()
+					fmt.Println("Cleared all fault rules")
+				case "list", "":
+					rules := gossip.ListFaultRules()
+					if len(rules) == 0 {
+						fmt.Println("No fault rules")
+					}
+					for _, rule := range rules {
+						fmt.Println(" ", rule)
+					}
+				default:
+					fmt.Println("usage: fault add <spec> | fault remove <id> | fault clear | fault list")
 				}
-				fmt.Printf("<%s, %s>\n", protocol, sus)
 			case "start_exp":
-				gossip.IsExperimentRunning.Store(true)
-				go gossip.LogExperiments()
-				fmt.Println("Experiment started, logging bandwidth stats.")
+				if err := admin.StartExperiment(ctx); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println("Experiment started, logging bandwidth stats.")
+				}
 			case "stop_exp":
-				gossip.IsExperimentRunning.Store(false)
-				fmt.Println("Experiment stopped.")
+				if record, err := admin.StopExperiment(); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Printf("Experiment stopped after %s, %d detections:\n", record.Stopped.Sub(record.Started).Round(time.Millisecond), len(record.Detections))
+					for _, detection := range record.Detections {
+						fmt.Printf("  [%s] %s %s (%s)\n", detection.At.Format("15:04:05.000"), detection.Member, detection.State, detection.Source)
+					}
+				}
 
 			// HYDFS COMMANDS
+			case "create":
+				if report, err := hydfs_utils.Create(list, arg1, arg2); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Printf("Created %s from %s\n", arg2, arg1)
+					fmt.Println(report)
+				}
+			case "append":
+				if report, err := hydfs_utils.Append(list, arg1, arg2); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Printf("Appended %s to %s\n", arg1, arg2)
+					fmt.Println(report)
+				}
+			case "merge":
+				if result, err := hydfs_utils.Merge(list, arg1); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Println(result)
+				}
+			case "get":
+				if report, err := hydfs_utils.Get(list, arg1, arg2); err != nil {
+					fmt.Println(err)
+				} else {
+					fmt.Printf("Fetched %s into %s\n", arg1, arg2)
+					fmt.Println(report)
+				}
+			case "replication":
+				fmt.Println("Re-replication:", hydfs_utils.GetReplicationStatus())
+			case "scrub":
+				fmt.Println("Scrub:", hydfs_utils.GetScrubStatus())
+			case "consistency":
+				if arg1 != "" {
+					if err := setConsistency(arg1, arg2); err != nil {
+						fmt.Println(err)
+					}
+				}
+				write, read := hydfs_utils.GetConsistency()
+				fmt.Printf("Writes wait for %s (W), reads for %s (R)\n", write, read)
 
 			default:
-				common.Logger.Printf("Unknown command: %s %s %s", command, protocolMode, susMode)
+				common.Logger.Printf("Unknown command: %s %s %s", command, arg1, arg2)
 			}
 		}
 	}()
 
 	fmt.Println("gossip/pingack started; ur life is ruined")
-	select {} // block forever
+
+	// run until SIGINT/SIGTERM, then leave the group and stop cleanly
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		fmt.Printf("Received %s, shutting down\n", sig)
+	case <-gossip.ExitRequested():
+		// the exit self failure policy, leave like on a signal but exit with an error
+		exitCode = 1
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := gossip.Shutdown(shutdownCtx, list, stop); err != nil {
+		fmt.Println("Shutdown did not finish cleanly: ", err)
+	}
+	cancel()
+	os.Exit(exitCode)
+}
+
+// sets the hydfs consistency from the names of W and R, R stays the same if it is empty
+func setConsistency(writeName string, readName string) error {
+	write, err := hydfs_utils.ParseConsistency(writeName)
+	if err != nil {
+		return err
+	}
+	_, read := hydfs_utils.GetConsistency()
+	if readName != "" {
+		if read, err = hydfs_utils.ParseConsistency(readName); err != nil {
+			return err
+		}
+	}
+	hydfs_utils.SetConsistency(write, read)
+	return nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"cs425_g12/admin"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// small client for the failure detector admin api
+// usage: fdctl [-addr host:port] <command> [args]
+
+// commands that only read state
+var getCommands = map[string]bool{
+	"list_mem":          true,
+	"list_self":         true,
+	"display_suspects":  true,
+	"display_protocol":  true,
+	"display_partition": true,
+	"display_queue":     true,
+	"fault_list":        true,
+}
+
+// commands that change state
+var postCommands = map[string]bool{
+	"join":      true,
+	"leave":     true,
+	"switch":    true,
+	"start_exp": true,
+	"stop_exp":  true,
+
+	"fault_add":    true,
+	"fault_remove": true,
+	"fault_clear":  true,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: fdctl [-addr host:port] <command> [args]")
+	fmt.Fprintln(os.Stderr, "commands: list_mem, list_self, display_suspects, display_protocol, display_partition, display_queue,")
+	fmt.Fprintln(os.Stderr, "          join, leave, switch {gossip, pingack, hybrid} {withSus, withNoSus}, start_exp, stop_exp,")
+	fmt.Fprintln(os.Stderr, "          fault_list, fault_add <spec>, fault_remove <id>, fault_clear")
+	os.Exit(2)
+}
+
+func main() {
+	addr := flag.String("addr", admin.DefaultAddr, "address of the admin api")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	command := args[0]
+
+	endpoint := url.URL{Scheme: "http", Host: *addr, Path: "/" + command}
+	client := &http.Client{Timeout: 30 * time.Second} // join can take a while if seeds are down
+
+	var resp *http.Response
+	var err error
+	if getCommands[command] {
+		resp, err = client.Get(endpoint.String())
+	} else if postCommands[command] {
+		switch command {
+		case "switch":
+			if len(args) != 3 {
+				usage()
+			}
+			endpoint.RawQuery = url.Values{"protocol": {args[1]}, "sus": {args[2]}}.Encode()
+		case "fault_add":
+			if len(args) != 2 {
+				usage()
+			}
+			endpoint.RawQuery = url.Values{"spec": {args[1]}}.Encode()
+		case "fault_remove":
+			if len(args) != 2 {
+				usage()
+			}
+			endpoint.RawQuery = url.Values{"id": {args[1]}}.Encode()
+		}
+		resp, err = client.Post(endpoint.String(), "application/json", nil)
+	} else {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", command)
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "request failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	var body admin.Response
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		fmt.Fprintf(os.Stderr, "could not decode response: %v\n", err)
+		os.Exit(1)
+	}
+	if !body.Ok {
+		fmt.Fprintf(os.Stderr, "error: %s\n", body.Error)
+		os.Exit(1)
+	}
+
+	out, _ := json.MarshalIndent(body.Result, "", "  ")
+	fmt.Println(string(out))
+}
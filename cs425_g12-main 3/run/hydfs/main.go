@@ -27,81 +27,167 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 
 	"cs425_g12/hydfs_utils"
+	"cs425_g12/logging"
 )
 
+// tests a file transfer between two receivers. without flags it sends a small file within this
+// process. with -listen it only serves, with -send it streams a file to a receiver started with
+// -listen, e.g. a multi-GB one from -size, and checks that it arrived intact
 func main() {
+	listenAddr := flag.String("listen", "", "only serve the receiver on this address")
+	sendAddr := flag.String("send", "", "send the file to the receiver at this address")
+	dataDir := flag.String("dir", "./testdata", "data directory of the receiver")
+	localFile := flag.String("file", "", "file to send, generated if empty")
+	size := flag.Int64("size", 2, "bytes of the generated file")
+	chunk := flag.Int("chunk", hydfs_utils.GetChunkSize(), "bytes per chunk")
+	fileID := flag.String("id", "file1", "name of the file on the receiver")
+	flag.Parse()
+
+	// SIGINT/SIGTERM stops the test and closes the listener
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// 1. Create a simple directory for the receiver
-	hydfs_utils.InitializeLogger("testingmach1")
-	dataDir := "./testdata"
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	logConfig := logging.DefaultConfig
+	logConfig.Dir = "/home/shared/hydfs/logs"
+	hydfs_utils.InitializeLogger("testingmach1", logConfig)
+	hydfs_utils.SetChunkSize(*chunk)
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
 		fmt.Printf("failed to create dataDir: %v\n", err)
 		return
 	}
 	// defer os.RemoveAll(dataDir)
 
-	// 2. Initialize and register the HyDFSReceiver
-	receiver := &hydfs_utils.HyDFSReceiver{DataDir: dataDir}
-	if err := rpc.Register(receiver); err != nil {
-		fmt.Printf("failed to register receiver: %v\n", err)
+	targetAddr := *sendAddr
+	if targetAddr == "" {
+		// 2. Serve a receiver on the listen address or a free port
+		addr := *listenAddr
+		if addr == "" {
+			addr = ":0"
+		}
+		l, err := serve(ctx, addr, *dataDir)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer l.Close()
+		port := l.Addr().(*net.TCPAddr).Port
+		fmt.Printf("RPC server listening on port %d\n", port)
+		if *listenAddr != "" {
+			<-ctx.Done()
+			return
+		}
+		targetAddr = "127.0.0.1:" + strconv.Itoa(port)
+	}
+
+	// 3. Create the file to send
+	localPath := *localFile
+	if localPath == "" {
+		localPath = filepath.Join(os.TempDir(), "hydfs_localfile_"+strconv.Itoa(os.Getpid()))
+		if err := generateFile(localPath, *size); err != nil {
+			fmt.Printf("failed to write local file: %v\n", err)
+			return
+		}
+		defer os.Remove(localPath)
+	}
+	want, err := hashFile(localPath)
+	if err != nil {
+		fmt.Printf("failed to read local file: %v\n", err)
+		return
+	}
+
+	// 4. Send the file
+	start := time.Now()
+	if err := hydfs_utils.SendFileToNode(targetAddr, *fileID, localPath); err != nil {
+		fmt.Printf("SendFileToNode failed: %v\n", err)
 		return
 	}
+	took := time.Since(start)
 
-	// 3. Listen on a free port
-	l, err := net.Listen("tcp", ":0")
+	// 5. Verify file was received, the receiver has to use the same -dir
+	storedPath := filepath.Join(*dataDir, *fileID)
+	got, err := hashFile(storedPath)
 	if err != nil {
-		fmt.Printf("failed to listen: %v\n", err)
+		fmt.Printf("failed to read stored file: %v\n", err)
+		return
+	}
+	if got != want {
+		fmt.Printf("file content mismatch, got sha256 %s, want %s\n", got, want)
 		return
 	}
-	defer l.Close()
-	port := l.Addr().(*net.TCPAddr).Port
-	fmt.Printf("RPC server listening on port %d\n", port)
 
-	// 4. Serve RPC requests in a goroutine
+	fmt.Printf("Test succeeded! File sent and received correctly (sha256 %s, took %s).\n", want, took.Round(time.Millisecond))
+}
+
+// serves a receiver on addr until ctx is cancelled
+func serve(ctx context.Context, addr string, dataDir string) (net.Listener, error) {
+	receiver := &hydfs_utils.HyDFSReceiver{DataDir: dataDir}
+	if err := rpc.Register(receiver); err != nil {
+		return nil, fmt.Errorf("failed to register receiver: %v", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
 	go func() {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				continue
 			}
 			go rpc.ServeConn(conn)
 		}
 	}()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	return l, nil
+}
 
-	// 5. Create a tiny file to send
-	content := []byte("hi")
-	localPath := dataDir + "/localfile.txt"
-	if err := os.WriteFile(localPath, content, 0644); err != nil {
-		fmt.Printf("failed to write local file: %v\n", err)
-		return
+// writes size pseudo random bytes to path, one buffer at a time
+func generateFile(path string, size int64) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
 	}
-
-	// 6. Send the file
-	fileID := "file1"
-	targetAddr := "127.0.0.1:" + strconv.Itoa(port)
-	if err := hydfs_utils.SendFileToNode(targetAddr, fileID, localPath); err != nil {
-		fmt.Printf("SendFileToNode failed: %v\n", err)
-		return
+	defer file.Close()
+	if _, err := io.CopyN(file, rand.New(rand.NewSource(size)), size); err != nil {
+		return err
 	}
+	return file.Close()
+}
 
-	// 7. Verify file was received
-	storedPath := dataDir + "/" + fileID
-	storedData, err := os.ReadFile(storedPath)
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		fmt.Printf("failed to read stored file: %v\n", err)
-		return
+		return "", err
 	}
-
-	if string(storedData) != string(content) {
-		fmt.Printf("file content mismatch, got %s, want %s\n", string(storedData), string(content))
-		return
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
 	}
-
-	fmt.Println("Test succeeded! File sent and received correctly.")
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
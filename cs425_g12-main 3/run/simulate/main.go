@@ -0,0 +1,81 @@
+package main
+
+import (
+	"cs425_g12/common"
+	"cs425_g12/sim"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runs the membership protocol in the deterministic simulator and prints the report
+// usage: simulate [-nodes 10] [-seed 1] [-protocol gossip] [-sus] [-duration 1m] [-drop 0.05] [-crash 3@10s,5@20s] [-script faults.txt]
+
+func main() {
+	config := sim.DefaultConfig
+	nodes := flag.Int("nodes", config.Nodes, "number of nodes")
+	seed := flag.Int64("seed", config.Seed, "seed of the run, the same seed replays the same run")
+	protocol := flag.String("protocol", "gossip", "gossip, pingack or hybrid")
+	suspicion := flag.Bool("sus", false, "run with suspicion")
+	duration := flag.Duration("duration", config.Duration, "simulated time")
+	drop := flag.Float64("drop", 0, "drop rate for every message")
+	latency := flag.Duration("latency", config.Latency, "one way network latency")
+	crash := flag.String("crash", "", "comma separated node@time crashes, e.g. 3@10s,5@20s")
+	script := flag.String("script", "", "file with scripted crashes, partitions and drop rates")
+	verbose := flag.Bool("v", false, "keep the output of the nodes")
+	flag.Parse()
+
+	var err error
+	config.Nodes = *nodes
+	config.Seed = *seed
+	config.Suspicion = *suspicion
+	config.Duration = *duration
+	config.DropRate = *drop
+	config.Latency = *latency
+	if config.Protocol, err = common.ParseProtocolMode(*protocol); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *script != "" {
+		file, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not open script:", err)
+			os.Exit(2)
+		}
+		config.Script, err = sim.ParseScript(file, config.Nodes)
+		file.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid script:", err)
+			os.Exit(2)
+		}
+	}
+	if *crash != "" {
+		for _, spec := range strings.Split(*crash, ",") {
+			node, at, found := strings.Cut(spec, "@")
+			if !found {
+				fmt.Fprintf(os.Stderr, "invalid crash %q (expected node@time)\n", spec)
+				os.Exit(2)
+			}
+			action, err := sim.ParseAction(at+" crash "+node, config.Nodes)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			config.Script = append(config.Script, action)
+		}
+	}
+
+	// the protocol prints every failure to stdout, only the report is interesting here
+	stdout := os.Stdout
+	if !*verbose {
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stdout = devNull
+		}
+	}
+	report := sim.New(config).Run()
+	os.Stdout = stdout
+
+	fmt.Print(report)
+}
@@ -0,0 +1,76 @@
+package sim
+
+import (
+	"cs425_g12/common"
+	"cs425_g12/gossip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// in memory transport of one node. messages are delivered by the event loop after the network
+// latency, unless they are dropped, cross a partition or go to a crashed node
+type endpoint struct {
+	sim  *Simulation
+	node *node
+}
+
+func (e *endpoint) WriteTo(p []byte, addr net.Addr) (int, error) {
+	s := e.sim
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	target, ok := s.byIp[host]
+	if !ok {
+		return 0, fmt.Errorf("no simulated node at %s", addr)
+	}
+
+	msgType := peekType(p)
+	s.stats.sent(msgType, len(p))
+
+	if !s.reachable(e.node, target) || s.rng.Float64() < s.dropRate {
+		s.stats.dropped++
+		return len(p), nil // looks like a successful udp send
+	}
+
+	delay := s.config.Latency
+	if s.config.Jitter > 0 {
+		delay += time.Duration(s.rng.Int63n(int64(s.config.Jitter)))
+	}
+	data := append([]byte(nil), p...)
+	from := &net.UDPAddr{IP: net.ParseIP(e.node.ip), Port: common.GlobalPort}
+	s.schedule(delay, func() { s.deliver(target, data, from) })
+	return len(p), nil
+}
+
+func (e *endpoint) ReadFrom(p []byte) (int, net.Addr, error) {
+	return 0, nil, errors.New("simulated transport is read by the event loop")
+}
+
+func (e *endpoint) Close() error {
+	return nil
+}
+
+func (s *Simulation) deliver(n *node, data []byte, from net.Addr) {
+	if n.crashed || n.list == nil {
+		s.stats.dropped++
+		return
+	}
+	s.activate(n)
+	if err := gossip.HandleMessage(n.list, data, from); err != nil {
+		common.Logger.Printf("Simulated node %s could not handle message: %v\n", n.ip, err)
+	}
+	s.checkAck(n)
+	s.done(n)
+}
+
+func peekType(data []byte) string {
+	var msg gossip.MessageType
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return ""
+	}
+	return msg.Type
+}
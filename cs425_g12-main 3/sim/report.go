@@ -0,0 +1,303 @@
+package sim
+
+import (
+	"cs425_g12/common"
+	"cs425_g12/experiment"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// measurements of a run, updated after every step of a node
+type stats struct {
+	bytesSent    uint64
+	messagesSent map[string]uint64
+	dropped      uint64
+
+	seen    map[int]map[common.MachineId]common.SuspicionState // observer -> member -> last state seen
+	crashes []*crashStats
+
+	falseSuspicions   int
+	falseFailures     int
+	partitionFailures int
+
+	converged time.Duration // -1 until every node lists every other node as alive
+	events    []string
+}
+
+type crashStats struct {
+	node       *node
+	at         time.Time
+	first      time.Duration // -1 until the first node declared it failed
+	full       time.Duration // -1 until every live node declared it failed or removed it
+	detectedBy map[int]bool
+}
+
+func (st *stats) init() {
+	st.messagesSent = make(map[string]uint64)
+	st.seen = make(map[int]map[common.MachineId]common.SuspicionState)
+	st.converged = -1
+}
+
+func (st *stats) sent(msgType string, size int) {
+	st.bytesSent += uint64(size)
+	st.messagesSent[msgType]++
+}
+
+func (st *stats) crashed(n *node, at time.Time) {
+	st.crashes = append(st.crashes, &crashStats{node: n, at: at, first: -1, full: -1, detectedBy: make(map[int]bool)})
+}
+
+func (st *stats) log(line string) {
+	st.events = append(st.events, line)
+}
+
+// a node that is part of the group and still running
+func (n *node) live() bool {
+	return n.joined && n.inGroup && !n.crashed
+}
+
+// looks at the list of n after it ran a step: new suspicions and failures, detection of crashes
+// and convergence
+func (s *Simulation) observe(n *node) {
+	st := &s.stats
+	elapsed := s.Elapsed()
+	members := n.list.GetEntireList()
+
+	seen, ok := st.seen[n.index]
+	if !ok {
+		seen = make(map[common.MachineId]common.SuspicionState)
+		st.seen[n.index] = seen
+	}
+
+	for _, member := range members {
+		subject := s.byIp[member.MachineId.Ip]
+		if subject == n {
+			continue
+		}
+		previous, known := seen[member.MachineId]
+		seen[member.MachineId] = member.SuspicionState
+		if known && previous == member.SuspicionState {
+			continue
+		}
+
+		switch member.SuspicionState {
+		case common.StateSuspicious:
+			if !subject.crashed && s.reachable(n, subject) {
+				st.falseSuspicions++
+			}
+		case common.StateFailed:
+			if subject.crashed {
+				for _, crash := range st.crashes {
+					if crash.node == subject && crash.first < 0 {
+						crash.first = s.clock.Now().Sub(crash.at)
+					}
+				}
+			} else if !s.reachable(n, subject) {
+				st.partitionFailures++
+			} else {
+				st.falseFailures++
+			}
+		}
+	}
+
+	// a crash is fully disseminated once no live node lists the crashed node as alive or suspicious
+	for _, crash := range st.crashes {
+		if crash.full >= 0 || !n.live() {
+			continue
+		}
+		if !listsAsRunning(members, crash.node.ip) {
+			crash.detectedBy[n.index] = true
+		}
+		all := true
+		for _, other := range s.nodes {
+			if other.live() && !crash.detectedBy[other.index] {
+				all = false
+				break
+			}
+		}
+		if all {
+			crash.full = s.clock.Now().Sub(crash.at)
+		}
+	}
+
+	if st.converged < 0 {
+		s.checkConvergence(elapsed)
+	}
+}
+
+func listsAsRunning(members []common.Member, ip string) bool {
+	for _, member := range members {
+		if member.MachineId.Ip == ip && member.SuspicionState != common.StateFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// every node joined and every live node lists every other live node as alive
+func (s *Simulation) checkConvergence(elapsed time.Duration) {
+	for _, n := range s.nodes {
+		if !n.joined {
+			return
+		}
+	}
+	for _, n := range s.nodes {
+		if !n.live() {
+			continue
+		}
+		alive := make(map[string]bool)
+		for _, member := range n.list.GetEntireList() {
+			if member.SuspicionState == common.StateAlive {
+				alive[member.MachineId.Ip] = true
+			}
+		}
+		for _, other := range s.nodes {
+			if other.live() && !alive[other.ip] {
+				return
+			}
+		}
+	}
+	s.stats.converged = elapsed
+}
+
+type CrashReport struct {
+	Node           int
+	At             time.Duration
+	FirstDetection time.Duration // -1 if no node detected it
+	FullDetection  time.Duration // -1 if the failure never reached every live node
+	DetectedBy     int
+}
+
+type Report struct {
+	Nodes     int
+	Seed      int64
+	Protocol  string
+	Suspicion bool
+	Duration  time.Duration
+
+	Convergence time.Duration // time until every node listed every other node as alive, -1 if never
+	Crashes     []CrashReport
+
+	FalseSuspicions   int     // reachable running nodes marked suspicious
+	FalseFailures     int     // reachable running nodes declared failed
+	PartitionFailures int     // nodes declared failed across a partition
+	FalsePositiveRate float64 // false failures per node per minute
+	SelfFailures      int     // running nodes that were declared failed by the group and stayed out
+
+	BytesSent        uint64
+	BandwidthPerNode float64 // bytes sent per second per node
+	MessagesSent     map[string]uint64
+	MessagesDropped  uint64 // dropped by the network, cut by a partition or sent to a crashed node
+
+	// the detection records of every node run through the same analysis as a real experiment
+	Detection experiment.Result
+
+	Events []string
+}
+
+func (s *Simulation) Report() Report {
+	st := s.stats
+	duration := s.Elapsed()
+	report := Report{
+		Nodes:             s.config.Nodes,
+		Seed:              s.config.Seed,
+		Protocol:          s.config.Protocol.String(),
+		Suspicion:         s.config.Suspicion,
+		Duration:          duration,
+		Convergence:       st.converged,
+		FalseSuspicions:   st.falseSuspicions,
+		FalseFailures:     st.falseFailures,
+		PartitionFailures: st.partitionFailures,
+		BytesSent:         st.bytesSent,
+		MessagesSent:      st.messagesSent,
+		MessagesDropped:   st.dropped,
+		Events:            st.events,
+	}
+	if minutes := duration.Minutes() * float64(s.config.Nodes); minutes > 0 {
+		report.FalsePositiveRate = float64(st.falseFailures) / minutes
+	}
+	if seconds := duration.Seconds() * float64(s.config.Nodes); seconds > 0 {
+		report.BandwidthPerNode = float64(st.bytesSent) / seconds
+	}
+	for _, n := range s.nodes {
+		if n.joined && !n.inGroup && !n.crashed {
+			report.SelfFailures++
+		}
+	}
+	report.Detection = s.analyzeDetections()
+	for _, crash := range st.crashes {
+		report.Crashes = append(report.Crashes, CrashReport{
+			Node:           crash.node.index,
+			At:             crash.at.Sub(s.start),
+			FirstDetection: crash.first,
+			FullDetection:  crash.full,
+			DetectedBy:     len(crash.detectedBy),
+		})
+	}
+	return report
+}
+
+// the crashes are the kills, every node that joined reports its record
+func (s *Simulation) analyzeDetections() experiment.Result {
+	kills := make([]experiment.Kill, 0, len(s.stats.crashes))
+	for _, crash := range s.stats.crashes {
+		kills = append(kills, experiment.Kill{Member: common.MachineId{Ip: crash.node.ip, Port: common.GlobalPort}, At: crash.at})
+	}
+	reports := make([]experiment.NodeReport, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		if !n.joined {
+			continue
+		}
+		s.activate(n)
+		record, ok := common.ExperimentSnapshot()
+		if !ok {
+			continue
+		}
+		record.Stopped = s.clock.Now()
+		reports = append(reports, experiment.NodeReport{Record: record})
+	}
+	return experiment.Analyze(kills, reports)
+}
+
+func formatLatency(d time.Duration) string {
+	if d < 0 {
+		return "never"
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	sus := "nosuspect"
+	if r.Suspicion {
+		sus = "suspect"
+	}
+	fmt.Fprintf(&b, "%d nodes, <%s, %s>, seed %d, %s simulated\n", r.Nodes, r.Protocol, sus, r.Seed, r.Duration)
+	for _, event := range r.Events {
+		fmt.Fprintf(&b, "  %s\n", event)
+	}
+	fmt.Fprintf(&b, "convergence: %s\n", formatLatency(r.Convergence))
+	for _, crash := range r.Crashes {
+		fmt.Fprintf(&b, "crash of node %d at %s: first detection %s, full dissemination %s (%d nodes)\n",
+			crash.Node, crash.At, formatLatency(crash.FirstDetection), formatLatency(crash.FullDetection), crash.DetectedBy)
+	}
+	fmt.Fprintf(&b, "false positives: %d suspicions, %d failures (%.4f per node per minute), %d failures across partitions, %d nodes declared failed\n",
+		r.FalseSuspicions, r.FalseFailures, r.FalsePositiveRate, r.PartitionFailures, r.SelfFailures)
+	fmt.Fprintf(&b, "per node detections:\n")
+	for _, line := range strings.Split(strings.TrimRight(r.Detection.String(), "\n"), "\n") {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	fmt.Fprintf(&b, "bandwidth: %d bytes sent, %.1f B/s per node, %d messages dropped or lost\n", r.BytesSent, r.BandwidthPerNode, r.MessagesDropped)
+
+	types := make([]string, 0, len(r.MessagesSent))
+	for msgType := range r.MessagesSent {
+		types = append(types, msgType)
+	}
+	sort.Strings(types)
+	for _, msgType := range types {
+		fmt.Fprintf(&b, "  %s: %d\n", msgType, r.MessagesSent[msgType])
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scripted fault, one per line of a script file:
+//
+//	10s crash 3            stop node 3 (several nodes: crash 3,4)
+//	20s partition 0,1,2 3,4  split the nodes into groups, nodes in no group form one more group
+//	40s heal               remove the partition
+//	50s drop 0.1           drop rate for every message from now on
+//
+// lines starting with # are comments
+type Action struct {
+	At     time.Duration
+	Kind   string // "crash", "partition", "heal" or "drop"
+	Nodes  []int
+	Groups [][]int
+	Rate   float64
+}
+
+func (s *Simulation) apply(action Action) {
+	prefix := fmt.Sprintf("[%s] %s", action.At, action.Kind)
+	switch action.Kind {
+	case "crash":
+		for _, i := range action.Nodes {
+			s.Crash(i)
+		}
+		s.stats.log(fmt.Sprintf("%s %v", prefix, action.Nodes))
+	case "partition":
+		s.Partition(action.Groups)
+		s.stats.log(fmt.Sprintf("%s %v", prefix, action.Groups))
+	case "heal":
+		s.Heal()
+		s.stats.log(prefix)
+	case "drop":
+		s.SetDropRate(action.Rate)
+		s.stats.log(fmt.Sprintf("%s %g", prefix, action.Rate))
+	}
+}
+
+func ParseScript(r io.Reader, nodes int) ([]Action, error) {
+	actions := make([]Action, 0)
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action, err := ParseAction(line, nodes)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		actions = append(actions, action)
+	}
+	return actions, scanner.Err()
+}
+
+func ParseAction(line string, nodes int) (Action, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Action{}, fmt.Errorf("expected <time> <action> [args], got %q", line)
+	}
+	at, err := time.ParseDuration(fields[0])
+	if err != nil {
+		return Action{}, fmt.Errorf("invalid time %q: %v", fields[0], err)
+	}
+	action := Action{At: at, Kind: fields[1]}
+	args := fields[2:]
+
+	switch action.Kind {
+	case "crash":
+		if len(args) != 1 {
+			return action, fmt.Errorf("crash takes a list of nodes")
+		}
+		action.Nodes, err = parseNodes(args[0], nodes)
+	case "partition":
+		if len(args) == 0 {
+			return action, fmt.Errorf("partition takes at least one group of nodes")
+		}
+		for _, arg := range args {
+			group, err := parseNodes(arg, nodes)
+			if err != nil {
+				return action, err
+			}
+			action.Groups = append(action.Groups, group)
+		}
+	case "heal":
+		if len(args) != 0 {
+			return action, fmt.Errorf("heal takes no arguments")
+		}
+	case "drop":
+		if len(args) != 1 {
+			return action, fmt.Errorf("drop takes a rate")
+		}
+		action.Rate, err = strconv.ParseFloat(args[0], 64)
+		if err == nil && (action.Rate < 0 || action.Rate > 1) {
+			err = fmt.Errorf("drop rate %v is not between 0 and 1", action.Rate)
+		}
+	default:
+		return action, fmt.Errorf("unknown action %q (expected crash, partition, heal or drop)", action.Kind)
+	}
+	return action, err
+}
+
+func parseNodes(arg string, nodes int) ([]int, error) {
+	out := make([]int, 0)
+	for _, part := range strings.Split(arg, ",") {
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || i >= nodes {
+			return nil, fmt.Errorf("invalid node %q (expected 0 to %d)", part, nodes-1)
+		}
+		out = append(out, i)
+	}
+	return out, nil
+}
@@ -0,0 +1,353 @@
+package sim
+
+import (
+	"container/heap"
+	"cs425_g12/common"
+	"cs425_g12/gossip"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// deterministic simulation of the membership protocol: N nodes over an in memory network, a
+// virtual clock and seeded randomness. the real protocol functions (SendGossip, SendProbe, the
+// checkers and the merges) run step by step on one goroutine, so a run with the same seed and
+// script is replayed exactly. the protocol keeps per node state in package globals, so only one
+// simulation can run in a process at a time
+
+type Config struct {
+	Nodes     int
+	Seed      int64
+	Protocol  common.ProtocolMode
+	Suspicion bool
+	Duration  time.Duration
+
+	// protocol timings, same meaning as in run/failure_detector
+	Tsus       time.Duration
+	Tfail      time.Duration
+	Tclean     time.Duration
+	Tgossip    time.Duration
+	Tping      time.Duration
+	Tsuscheck  time.Duration
+	Tfailcheck time.Duration
+	Reconnect  gossip.ReconnectConfig
+
+	JoinInterval time.Duration // node i joins at i*JoinInterval
+	Latency      time.Duration // one way network latency
+	Jitter       time.Duration // random extra latency up to this much
+	DropRate     float64       // drop probability for every message
+
+	Script []Action
+}
+
+var DefaultConfig = Config{
+	Nodes:        10,
+	Seed:         1,
+	Protocol:     common.ProtocolGossip,
+	Suspicion:    false,
+	Duration:     time.Minute,
+	Tsus:         2 * time.Second,
+	Tfail:        3 * time.Second,
+	Tclean:       6 * time.Second,
+	Tgossip:      200 * time.Millisecond,
+	Tping:        500 * time.Millisecond,
+	Tsuscheck:    500 * time.Millisecond,
+	Tfailcheck:   500 * time.Millisecond,
+	Reconnect:    gossip.DefaultReconnectConfig,
+	JoinInterval: 100 * time.Millisecond,
+	Latency:      time.Millisecond,
+	Jitter:       time.Millisecond,
+}
+
+type event struct {
+	at  time.Time
+	seq uint64 // events at the same time run in the order they were scheduled
+	fn  func()
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x any)   { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// one simulated node
+type node struct {
+	index   int
+	ip      string
+	list    *common.MembershipList
+	common  *common.NodeState
+	gossip  *gossip.NodeState
+	joined  bool // join was sent
+	inGroup bool // common.IsMemberInGroup after the last step
+	crashed bool
+
+	probing     bool
+	probeTarget common.MachineId
+	probeSeq    uint64 // ignores deadlines of probes that were already acked
+}
+
+type Simulation struct {
+	config Config
+	clock  *common.FakeClock // virtual time, moves to the time of the next event
+	start  time.Time
+	events eventQueue
+	seq    uint64
+	rng    *rand.Rand // network randomness, the protocol uses gossip's seeded source
+	nodes  []*node
+	byIp   map[string]*node
+
+	group    map[int]int // partition group of each node, nil without a partition
+	dropRate float64
+
+	stats stats
+}
+
+func New(config Config) *Simulation {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &Simulation{
+		config:   config,
+		clock:    common.NewFakeClock(start),
+		start:    start,
+		rng:      rand.New(rand.NewSource(config.Seed)),
+		byIp:     make(map[string]*node),
+		dropRate: config.DropRate,
+	}
+	s.stats.init()
+
+	common.SetClock(s.clock)
+	gossip.SeedRandom(config.Seed)
+	gossip.RunPoliciesInline(true)
+	// a node declared failed by the group stays out, rejoining needs a real socket
+	gossip.SetSelfFailurePolicy(gossip.PolicyStayOut)
+
+	common.Seeds = nil
+	for i := range config.Nodes {
+		n := &node{index: i, ip: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)}
+		s.nodes = append(s.nodes, n)
+		s.byIp[n.ip] = n
+		common.Seeds = append(common.Seeds, common.MachineId{Ip: n.ip, Port: common.GlobalPort})
+	}
+
+	for _, n := range s.nodes {
+		s.schedule(time.Duration(n.index)*config.JoinInterval, func() { s.startNode(n) })
+	}
+	for _, action := range config.Script {
+		s.schedule(action.At, func() { s.apply(action) })
+	}
+	return s
+}
+
+func (s *Simulation) schedule(after time.Duration, fn func()) {
+	s.seq++
+	heap.Push(&s.events, &event{at: s.clock.Now().Add(after), seq: s.seq, fn: fn})
+}
+
+// time since the start of the run
+func (s *Simulation) Elapsed() time.Duration {
+	return s.clock.Now().Sub(s.start)
+}
+
+// runs the next event, returns false once the run is over
+func (s *Simulation) Step() bool {
+	if len(s.events) == 0 {
+		return false
+	}
+	next := s.events[0]
+	if next.at.Sub(s.start) > s.config.Duration {
+		return false
+	}
+	heap.Pop(&s.events)
+	s.clock.AdvanceTo(next.at)
+	next.fn()
+	return true
+}
+
+// runs until the virtual time reached d
+func (s *Simulation) RunUntil(d time.Duration) {
+	for len(s.events) > 0 && s.events[0].at.Sub(s.start) <= d && s.Step() {
+	}
+}
+
+// runs the whole configured duration and reports the results
+func (s *Simulation) Run() Report {
+	for s.Step() {
+	}
+	return s.Report()
+}
+
+// membership list of node i, for inspecting a run step by step
+func (s *Simulation) Members(i int) []common.Member {
+	return s.nodes[i].list.GetEntireList()
+}
+
+// swaps the globals of the protocol to node n, every step of a node runs between activate and
+// done
+func (s *Simulation) activate(n *node) {
+	n.common.Activate()
+	n.gossip.Activate()
+}
+
+func (s *Simulation) done(n *node) {
+	n.inGroup = common.IsMemberInGroup
+	s.observe(n)
+}
+
+func (s *Simulation) startNode(n *node) {
+	self := common.NewMachineId(n.ip, common.GlobalPort, s.clock.Now())
+	n.list = common.NewMembershipList()
+	n.common = common.NewNodeState(self)
+	n.gossip = gossip.NewNodeState(&endpoint{sim: s, node: n})
+
+	s.activate(n)
+	n.list.Insert(common.NewMember(self))
+	common.StartExperimentRecording(s.clock.Now())
+	common.IsMemberInGroup = true
+	common.InitClusterMode(s.config.Protocol, s.config.Suspicion)
+	if n.index == 0 {
+		common.Introducer = self
+	} else {
+		gossip.SendJoin(common.Introducer)
+		s.schedule(time.Second, func() { s.retryJoin(n) })
+	}
+	n.joined = true
+	s.done(n)
+
+	s.schedule(s.config.Tgossip, func() { s.gossipRound(n) })
+	s.schedule(s.config.Tping, func() { s.probeRound(n) })
+	s.schedule(s.config.Tfailcheck, func() { s.checkerRound(n) })
+	s.schedule(s.config.Reconnect.Interval, func() { s.reconnectRound(n) })
+}
+
+// the join or its answer may have been dropped
+func (s *Simulation) retryJoin(n *node) {
+	if n.crashed || len(n.list.GetEntireList()) > 1 {
+		return
+	}
+	s.activate(n)
+	gossip.SendJoin(common.Introducer)
+	s.done(n)
+	s.schedule(time.Second, func() { s.retryJoin(n) })
+}
+
+// same as the gossip loop in gossip.StartProtocol
+func (s *Simulation) gossipRound(n *node) {
+	if n.crashed {
+		return
+	}
+	s.activate(n)
+	if common.IsMemberInGroup && common.GetProtocolMode().UsesGossip() {
+		gossip.SendGossip(n.list, s.config.Tgossip)
+	}
+	s.done(n)
+	s.schedule(s.config.Tgossip, func() { s.gossipRound(n) })
+}
+
+// same as the probe loop in gossip.StartProtocol, the wait for the ack is a scheduled deadline
+func (s *Simulation) probeRound(n *node) {
+	if n.crashed {
+		return
+	}
+	s.activate(n)
+	n.list.ApplyPendingMode()
+	started := false
+	if common.IsMemberInGroup && common.GetProtocolMode().UsesProbes() {
+		n.probeTarget, started = gossip.SendProbe(n.list)
+	}
+	s.done(n)
+
+	if !started {
+		s.schedule(s.config.Tping, func() { s.probeRound(n) })
+		return
+	}
+	n.probing = true
+	n.probeSeq++
+	seq := n.probeSeq
+	s.schedule(s.config.Tfail, func() { s.probeDeadline(n, seq) })
+}
+
+func (s *Simulation) probeDeadline(n *node, seq uint64) {
+	if n.crashed || !n.probing || n.probeSeq != seq {
+		return
+	}
+	s.activate(n)
+	gossip.ProbeTimedOut(n.probeTarget, n.list)
+	n.probing = false
+	s.done(n)
+	s.schedule(s.config.Tping, func() { s.probeRound(n) })
+}
+
+// called after every message a node handled
+func (s *Simulation) checkAck(n *node) {
+	if n.probing && gossip.ProbeAcked(n.probeTarget) {
+		n.probing = false
+		s.schedule(s.config.Tping, func() { s.probeRound(n) })
+	}
+}
+
+func (s *Simulation) checkerRound(n *node) {
+	if n.crashed {
+		return
+	}
+	s.activate(n)
+	next := n.list.RunCheckers(s.config.Tsus, s.config.Tfail, s.config.Tclean, s.config.Tsuscheck, s.config.Tfailcheck)
+	s.done(n)
+	s.schedule(next, func() { s.checkerRound(n) })
+}
+
+func (s *Simulation) reconnectRound(n *node) {
+	if n.crashed {
+		return
+	}
+	s.activate(n)
+	gossip.Reconnect(n.list, s.config.Reconnect)
+	s.done(n)
+	s.schedule(s.config.Reconnect.Interval, func() { s.reconnectRound(n) })
+}
+
+// stops node i, it doesn't send or receive anything afterwards
+func (s *Simulation) Crash(i int) {
+	n := s.nodes[i]
+	if n.crashed {
+		return
+	}
+	n.crashed = true
+	s.stats.crashed(n, s.clock.Now())
+}
+
+// splits the nodes into groups that can't reach each other, nodes in no group form one more group
+func (s *Simulation) Partition(groups [][]int) {
+	s.group = make(map[int]int)
+	for _, n := range s.nodes {
+		s.group[n.index] = -1
+	}
+	for g, members := range groups {
+		for _, i := range members {
+			s.group[i] = g
+		}
+	}
+}
+
+func (s *Simulation) Heal() {
+	s.group = nil
+}
+
+func (s *Simulation) SetDropRate(rate float64) {
+	s.dropRate = rate
+}
+
+func (s *Simulation) reachable(a *node, b *node) bool {
+	return s.group == nil || s.group[a.index] == s.group[b.index]
+}
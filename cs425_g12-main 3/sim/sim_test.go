@@ -0,0 +1,88 @@
+package sim
+
+import (
+	"cs425_g12/common"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runs config with the output of the protocol, which prints every failure to stdout, thrown away
+func run(t *testing.T, config Config) Report {
+	t.Helper()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+	return New(config).Run()
+}
+
+func crashConfig(protocol common.ProtocolMode, suspicion bool, seed int64) Config {
+	config := DefaultConfig
+	config.Protocol = protocol
+	config.Suspicion = suspicion
+	config.Seed = seed
+	config.Duration = 30 * time.Second
+	config.Script = []Action{{At: 10 * time.Second, Kind: "crash", Nodes: []int{3}}}
+	return config
+}
+
+func TestSameSeedSameReport(t *testing.T) {
+	for _, protocol := range []common.ProtocolMode{common.ProtocolGossip, common.ProtocolPingAck, common.ProtocolHybrid} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			config := crashConfig(protocol, true, 7)
+			config.DropRate = 0.05
+			config.Script = append(config.Script, Action{At: 15 * time.Second, Kind: "partition", Groups: [][]int{{0, 1, 2, 4}, {5, 6, 7, 8, 9}}},
+				Action{At: 20 * time.Second, Kind: "heal"})
+
+			first := run(t, config)
+			second := run(t, config)
+			if first.String() != second.String() {
+				t.Fatalf("runs with the same seed differ:\n%s\n---\n%s", first, second)
+			}
+			if !reflect.DeepEqual(first.Events, second.Events) {
+				t.Fatalf("runs with the same seed logged different events")
+			}
+		})
+	}
+}
+
+func TestCrashDetectedInTime(t *testing.T) {
+	for _, protocol := range []common.ProtocolMode{common.ProtocolGossip, common.ProtocolHybrid} {
+		for _, suspicion := range []bool{false, true} {
+			for seed := int64(1); seed <= 3; seed++ {
+				t.Run(fmt.Sprintf("%s/sus=%v/seed=%d", protocol, suspicion, seed), func(t *testing.T) {
+					config := crashConfig(protocol, suspicion, seed)
+					report := run(t, config)
+					if len(report.Crashes) != 1 {
+						t.Fatalf("got %d crashes, want 1", len(report.Crashes))
+					}
+					crash := report.Crashes[0]
+
+					// the last heartbeat can be a gossip round old, the checker runs every Tfailcheck
+					detection := config.Tfail + config.Tfailcheck + config.Tgossip
+					// gossip reaches every node in about log2(n) rounds, allow twice that
+					rounds := 2 * int(math.Ceil(math.Log2(float64(config.Nodes))))
+					dissemination := time.Duration(rounds) * config.Tgossip
+
+					if crash.FirstDetection < 0 || crash.FirstDetection > detection {
+						t.Errorf("first detection after %v, want within %v", crash.FirstDetection, detection)
+					}
+					if crash.FullDetection < 0 || crash.FullDetection > detection+dissemination {
+						t.Errorf("full detection after %v, want within %v", crash.FullDetection, detection+dissemination)
+					}
+					if crash.DetectedBy != config.Nodes-1 {
+						t.Errorf("detected by %d nodes, want %d", crash.DetectedBy, config.Nodes-1)
+					}
+				})
+			}
+		}
+	}
+}